@@ -2,6 +2,7 @@ package main
 
 import (
 	"file-service/internal/api"
+	fileconfig "file-service/internal/config"
 	"file-service/internal/models"
 	"fmt"
 	"log"
@@ -16,6 +17,7 @@ import (
 func main() {
 	// Step 1: Load configuration
 	cfg, _ := config.LoadConfig()
+	fileCfg := fileconfig.LoadFileServiceConfig()
 
 	fmt.Println(cfg.LogLevel)
 
@@ -28,11 +30,22 @@ func main() {
 		utils.Logger.Fatal("Failed to connect to the Postgres database", zap.Error(err))
 	}
 
-	if err := database.DB.AutoMigrate(&models.FileMetadata{}); err != nil {
+	if err := database.DB.AutoMigrate(&models.FileMetadata{}, &models.FileVersion{}, &models.TrashRetentionPolicy{}, &models.Folder{}, &models.FileSearchDocument{}, &models.FileShare{}, &models.ShareLink{}, &models.ShareLinkAccess{}, &models.FileRequest{}, &models.FileRequestUpload{}); err != nil {
 		log.Fatalf("Failed to run database migrations: %v", err)
 	}
+	if err := models.DropLegacySharedWith(database.DB); err != nil {
+		log.Fatalf("Failed to drop the legacy shared_with_raw column: %v", err)
+	}
+	if err := models.MigrateFileListIndexes(database.DB); err != nil {
+		log.Fatalf("Failed to create file listing indexes: %v", err)
+	}
+
+	// Step 4: Connect to Redis when it backs the upload sessions
+	if fileCfg.UploadSessionStore == "redis" {
+		database.ConnectRedis(cfg.RedisURL)
+	}
 
-	// Step 4: Start the API server
+	// Step 5: Start the API server
 	utils.Logger.Info("Starting API server...", zap.String("port", cfg.ServerPort))
-	api.StartServer(cfg, utils.Logger)
+	api.StartServer(cfg, fileCfg, utils.Logger)
 }
@@ -0,0 +1,63 @@
+// reconcile compares the stored objects with the file_metadata table once and
+// reports the drift: objects no file points at and files whose versions are
+// missing. With -repair, orphan objects are moved below the quarantine/
+// prefix of their bucket and broken files are flagged. It reads the same .env
+// file as file-service and can run while file-service is serving.
+//
+// Usage: go run ./cmd/reconcile [-repair] [-min-age 72h]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"file-service/internal/api"
+	fileconfig "file-service/internal/config"
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/amine-bouhoula/safedocs-mvp/sdlib/config"
+	"github.com/amine-bouhoula/safedocs-mvp/sdlib/database"
+	"github.com/amine-bouhoula/safedocs-mvp/sdlib/utils"
+
+	"go.uber.org/zap"
+)
+
+func main() {
+	cfg, _ := config.LoadConfig()
+	fileCfg := fileconfig.LoadFileServiceConfig()
+
+	repair := flag.Bool("repair", false, "quarantine orphan objects and flag files with missing versions")
+	minAge := flag.Duration("min-age", fileCfg.ReconcileMinAge, "skip objects younger than this, their upload may still be completing")
+	flag.Parse()
+
+	utils.InitLogger(cfg.LogLevel)
+	log := utils.Logger
+
+	if err := database.ConnectDB(cfg.DatabaseURL); err != nil {
+		log.Fatal("Failed to connect to the Postgres database", zap.Error(err))
+	}
+	// The flag column may not exist yet when file-service was not upgraded
+	if err := database.DB.AutoMigrate(&models.FileMetadata{}, &models.FileVersion{}); err != nil {
+		log.Fatal("Failed to run database migrations", zap.Error(err))
+	}
+
+	storageService, _, err := api.OpenStorageService(cfg, fileCfg, log)
+	if err != nil {
+		log.Fatal("Failed to initialize storage service", zap.Error(err))
+	}
+
+	reconciler := fileservices.NewStorageReconciler(database.DB, storageService, *minAge, 0, *repair, log)
+	report, err := reconciler.Run(context.Background(), *repair)
+	fmt.Printf("objects=%d orphans=%d orphan-bytes=%d quarantined=%d files=%d broken=%d flagged=%d unflagged=%d failed=%d repair=%t\n",
+		report.ObjectsChecked, report.OrphanObjects, report.OrphanBytes, report.Quarantined,
+		report.FilesChecked, report.BrokenFiles, report.Flagged, report.Unflagged, report.Failed, *repair)
+	if err != nil {
+		log.Fatal("Reconciliation stopped", zap.Error(err))
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
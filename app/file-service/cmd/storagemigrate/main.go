@@ -0,0 +1,59 @@
+// storagemigrate moves the objects of existing files to the location given by
+// the configured STORAGE_LAYOUT and points their metadata at the new objects.
+// It reads the same .env file as file-service and must run while file-service
+// is stopped. Files already in place are left alone, so it can be run again
+// after a failure.
+//
+// Usage: go run ./cmd/storagemigrate [-dry-run]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"file-service/internal/api"
+	fileconfig "file-service/internal/config"
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/amine-bouhoula/safedocs-mvp/sdlib/config"
+	"github.com/amine-bouhoula/safedocs-mvp/sdlib/database"
+	"github.com/amine-bouhoula/safedocs-mvp/sdlib/utils"
+
+	"go.uber.org/zap"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "only log the files that would be moved")
+	flag.Parse()
+
+	cfg, _ := config.LoadConfig()
+	fileCfg := fileconfig.LoadFileServiceConfig()
+	utils.InitLogger(cfg.LogLevel)
+	log := utils.Logger
+
+	if err := database.ConnectDB(cfg.DatabaseURL); err != nil {
+		log.Fatal("Failed to connect to the Postgres database", zap.Error(err))
+	}
+	// The location columns may not exist yet when file-service was not upgraded
+	if err := database.DB.AutoMigrate(&models.FileMetadata{}, &models.FileVersion{}); err != nil {
+		log.Fatal("Failed to run database migrations", zap.Error(err))
+	}
+
+	storageService, _, err := api.OpenStorageService(cfg, fileCfg, log)
+	if err != nil {
+		log.Fatal("Failed to initialize storage service", zap.Error(err))
+	}
+
+	migrator := fileservices.NewStorageMigrator(database.DB, storageService, log)
+	report, err := migrator.Run(context.Background(), *dryRun)
+	fmt.Printf("layout=%s checked=%d moved=%d failed=%d dry-run=%t\n", fileCfg.StorageLayout, report.Checked, report.Moved, report.Failed, *dryRun)
+	if err != nil {
+		log.Fatal("Storage migration stopped", zap.Error(err))
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
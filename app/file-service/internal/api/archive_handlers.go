@@ -0,0 +1,148 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// maxArchiveSelection bounds the number of IDs of one archive request
+const maxArchiveSelection = 1000
+
+// archiveHandler streams a ZIP of the selected files and folders. Every file
+// and folder is authorized before the first byte is sent; folders bring their
+// whole subtree, limited to the files the caller may read. Name clashes get a
+// " (n)" suffix.
+func archiveHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, folders *fileservices.FolderService, access *fileservices.AccessService, maxSize int64, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		FileIDs   []string `json:"fileIds"`
+		FolderIDs []string `json:"folderIds"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	selected := len(request.FileIDs) + len(request.FolderIDs)
+	if selected == 0 || selected > maxArchiveSelection {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Select between 1 and %d files or folders", maxArchiveSelection)})
+		return
+	}
+
+	names := fileservices.NewArchiveNames()
+	seen := make(map[string]bool)
+	var dirs []string
+	var entries []fileservices.ArchiveEntry
+	var totalSize int64
+
+	addFile := func(dir string, file models.FileMetadata) {
+		// A file selected directly and through its folder is archived once
+		if seen[file.FileID] {
+			return
+		}
+		seen[file.FileID] = true
+		entries = append(entries, fileservices.ArchiveEntry{Name: names.Unique(dir, file.FileName), File: file})
+		totalSize += file.Size
+	}
+
+	for _, fileID := range request.FileIDs {
+		file, err := metadata.GetFileByID(fileID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found", "fileId": fileID})
+			return
+		}
+		if err != nil {
+			log.Error("Failed to load file metadata", zap.String("fileID", fileID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file"})
+			return
+		}
+
+		readable, err := access.CanReadFile(file, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file"})
+			return
+		}
+		if !readable {
+			log.Warn("Access to file denied", zap.String("fileID", fileID), zap.String("userID", userID))
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found", "fileId": fileID})
+			return
+		}
+		addFile("", *file)
+	}
+
+	for _, folderID := range request.FolderIDs {
+		folder, ok := loadBrowsableFolder(c, folders, access, userID, folderID, log)
+		if !ok {
+			return
+		}
+
+		tree, files, err := folders.FolderTreeContents(folder, access.ReadableFiles(userID))
+		if err != nil {
+			log.Error("Failed to list folder tree", zap.String("folderID", folderID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve folder"})
+			return
+		}
+
+		// Folders are named first, a file never takes the name of a folder and
+		// two selected folders with the same name get distinct roots
+		renamed := names.UniqueDirs(tree)
+		for _, dir := range tree {
+			dirs = append(dirs, renamed[dir])
+		}
+		for _, file := range files {
+			addFile(renamed[file.Dir], file.File)
+		}
+	}
+
+	// Sizes are checked again while streaming, the metadata may be stale
+	if totalSize > maxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":   "The selection is too large to be downloaded at once",
+			"size":    totalSize,
+			"maxSize": maxSize,
+		})
+		return
+	}
+
+	fileName := "files.zip"
+	if len(request.FileIDs) == 0 && len(request.FolderIDs) == 1 && len(dirs) > 0 {
+		fileName = dirs[0] + ".zip"
+	}
+
+	log.Info("Streaming archive",
+		zap.String("userID", userID),
+		zap.Int("files", len(entries)),
+		zap.Int("folders", len(dirs)),
+		zap.Int64("size", totalSize),
+	)
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", contentDisposition(fileName))
+	c.Status(http.StatusOK)
+
+	err := fileservices.WriteArchive(c.Writer, dirs, entries, maxSize, func(file *models.FileMetadata) (io.ReadCloser, error) {
+		object, _, err := storage.GetFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return object, nil
+	})
+	if err != nil {
+		// The status is already sent: the client gets a truncated archive
+		log.Error("Failed to stream archive", zap.String("userID", userID), zap.Error(err))
+		c.Abort()
+		return
+	}
+}
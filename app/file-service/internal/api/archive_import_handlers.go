@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// errOneArchive rejects uploads carrying more than one archive
+var errOneArchive = errors.New("only one archive can be imported at a time")
+
+// importArchiveHandler receives a ZIP archive and expands it into a new folder
+// named after it, under the optional "folderId" field or at the root. The
+// archive is checked before answering; the expansion runs in the background
+// and reports its progress over the WebSocket of the caller.
+func importArchiveHandler(c *gin.Context, importer *fileservices.ArchiveImporter, folders *fileservices.FolderService, tempRoot string, maxSize int64, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
+		return
+	}
+
+	// The archive is staged on disk: a ZIP is read from its central directory, at the end
+	var archivePath, archiveName string
+	values, err := fileservices.StreamMultipartForm(reader, maxSize, nil, func(fileName string, content io.Reader) error {
+		if archivePath != "" {
+			return errOneArchive
+		}
+		path, err := fileservices.SaveArchiveUpload(tempRoot, content)
+		if err != nil {
+			return err
+		}
+		archivePath, archiveName = path, fileName
+		return nil
+	})
+	discard := func() {
+		if archivePath != "" {
+			os.Remove(archivePath)
+		}
+	}
+	if errors.Is(err, fileservices.ErrFileTooLarge) {
+		discard()
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Archive is too large. Max allowed size is %d bytes", maxSize)})
+		return
+	}
+	if errors.Is(err, errOneArchive) {
+		discard()
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		discard()
+		log.Error("Failed to receive archive", zap.String("userID", userID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to receive archive"})
+		return
+	}
+	if archivePath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No archive uploaded"})
+		return
+	}
+
+	folderID := values["folderId"]
+	if folderID != "" {
+		if ok := checkTargetFolder(c, folders, userID, folderID, log); !ok {
+			discard()
+			return
+		}
+	}
+
+	imp, err := importer.Prepare(archivePath)
+	switch {
+	case err == nil:
+	case errors.Is(err, fileservices.ErrInvalidArchive),
+		errors.Is(err, fileservices.ErrArchiveUnsafePath),
+		errors.Is(err, fileservices.ErrArchiveTooManyEntries),
+		errors.Is(err, fileservices.ErrArchiveBomb):
+		log.Warn("Archive rejected", zap.String("userID", userID), zap.String("archive", archiveName), zap.Error(err))
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error("Failed to check archive", zap.String("userID", userID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check archive"})
+		return
+	}
+
+	importer.Start(imp, userID, folderID, archiveName)
+	log.Info("Archive import started", zap.String("importID", imp.ID), zap.String("userID", userID), zap.String("archive", archiveName))
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"importId": imp.ID,
+		"files":    imp.Files(),
+		"folders":  imp.Folders(),
+	})
+}
@@ -0,0 +1,436 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	minDirectPartSize  = 5 * 1024 * 1024 // S3 refuses smaller parts, except the last one
+	maxDirectParts     = 10000           // S3 refuses more parts
+	maxPresignedParts  = 1000            // Most part URLs renewed by one request
+	proxiedChunkSize   = 5 * 1024 * 1024 // Chunks of the uploads falling back to file-service
+	directUploadMethod = http.MethodPut
+)
+
+// directTransferUnavailable tells whether err means the content must go
+// through file-service: it is encrypted at rest, or the storage driver cannot
+// presign URLs
+func directTransferUnavailable(err error) bool {
+	return errors.Is(err, fileservices.ErrPresignEncrypted) ||
+		errors.Is(err, fileservices.ErrPresignNotSupported) ||
+		errors.Is(err, fileservices.ErrMultipartNotSupported)
+}
+
+// startProxiedUpload answers a direct upload request the storage cannot take
+// with a chunked upload session, whose chunks go through file-service
+func startProxiedUpload(c *gin.Context, uploadSessions fileservices.UploadSessionStore, userID, fileName string, fileSize int64, sha256, folderID, tempRoot string, log *zap.Logger) {
+	session, err := newChunkedUploadSession(c.Request.Context(), uploadSessions, userID, fileName, fileSize, proxiedChunkSize, sha256, folderID, tempRoot)
+	if err != nil {
+		log.Error("Failed to start proxied upload", zap.String("fileName", fileName), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start direct upload"})
+		return
+	}
+
+	log.Info("Direct upload falling back to a chunked upload", zap.String("uploadSessionId", session.ID), zap.String("userID", userID))
+	c.JSON(http.StatusOK, gin.H{
+		"uploadSessionId": session.ID,
+		"fileName":        session.FileName,
+		"direct":          false,
+		"method":          http.MethodPut,
+		"chunkSize":       session.ChunkSize,
+		"totalChunks":     session.TotalChunks,
+		"chunkUrl":        "/api/v1/files/upload/" + session.ID + "/chunks/{index}",
+		"completeUrl":     "/api/v1/files/upload/" + session.ID + "/complete",
+	})
+}
+
+// directPartSize returns the part size of a direct upload of fileSize bytes,
+// grown when needed to stay within maxDirectParts
+func directPartSize(fileSize, partSize int64) int64 {
+	partSize = max(partSize, minDirectPartSize)
+	if minimum := (fileSize + maxDirectParts - 1) / maxDirectParts; partSize < minimum {
+		partSize = minimum
+	}
+	return partSize
+}
+
+// startDirectUploadHandler opens a direct upload session: the client sends
+// the content straight to the storage through the returned presigned URLs,
+// one PUT per part, then calls the complete endpoint. Files up to the part
+// size are sent in a single part, whose URL is also returned as "url". Every
+// upload is a multipart upload so that its URLs stop working once it is
+// completed or aborted. When the content must be encrypted by file-service,
+// or the storage cannot presign URLs, a chunked upload session is opened
+// instead and the response has "direct": false.
+func startDirectUploadHandler(c *gin.Context, uploadSessions fileservices.UploadSessionStore, storage *fileservices.StorageService, folders *fileservices.FolderService, maxFileSize, partSize int64, urlTTL time.Duration, tempRoot string, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		FileName string `json:"fileName" binding:"required"`
+		FileSize int64  `json:"fileSize"`
+		SHA256   string `json:"sha256"`   // Optional hex encoded SHA-256, verified on completion
+		FolderID string `json:"folderId"` // Optional folder receiving the file
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if request.FileSize <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid fileSize"})
+		return
+	}
+	if request.FileSize > maxFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File is too large. Max allowed size is %d bytes", maxFileSize)})
+		return
+	}
+	if request.SHA256 != "" && !fileservices.ValidSHA256(request.SHA256) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sha256, must be a hex encoded SHA-256 digest"})
+		return
+	}
+	if request.FolderID != "" {
+		if ok := checkTargetFolder(c, folders, userID, request.FolderID, log); !ok {
+			return
+		}
+	}
+
+	fileID, location, err := storage.NewFileLocation(userID, request.FolderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start direct upload"})
+		return
+	}
+
+	session := &fileservices.UploadSession{
+		ID:            generateSessionID(),
+		UserID:        userID,
+		FileName:      request.FileName,
+		FileSize:      request.FileSize,
+		ChunkSize:     request.FileSize,
+		SHA256:        request.SHA256,
+		FolderID:      request.FolderID,
+		TotalChunks:   1,
+		CreatedAt:     time.Now(),
+		Direct:        true,
+		FileID:        fileID,
+		StorageBucket: location.StorageBucket,
+		ObjectKey:     location.ObjectKey,
+	}
+
+	expiresAt := time.Now().Add(urlTTL)
+	response := gin.H{
+		"uploadSessionId": session.ID,
+		"fileName":        session.FileName,
+		"direct":          true,
+		"method":          directUploadMethod,
+		"completeUrl":     "/api/v1/files/direct-uploads/" + session.ID + "/complete",
+		"expiresAt":       expiresAt,
+	}
+
+	session.ChunkSize = directPartSize(request.FileSize, partSize)
+	session.TotalChunks = int((request.FileSize + session.ChunkSize - 1) / session.ChunkSize)
+	session.MultipartUploadID, err = storage.StartMultipartUpload(location, "application/octet-stream")
+	if directTransferUnavailable(err) {
+		startProxiedUpload(c, uploadSessions, userID, request.FileName, request.FileSize, request.SHA256, request.FolderID, tempRoot, log)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start direct upload"})
+		return
+	}
+
+	parts := make([]gin.H, 0, session.TotalChunks)
+	for number := 1; number <= session.TotalChunks; number++ {
+		partURL, err := storage.PresignUploadPart(location, session.MultipartUploadID, number, urlTTL)
+		if err != nil {
+			log.Error("Failed to presign upload part", zap.String("fileID", fileID), zap.Int("partNumber", number), zap.Error(err))
+			storage.DiscardDirectUpload(location, session.MultipartUploadID)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start direct upload"})
+			return
+		}
+		parts = append(parts, gin.H{"partNumber": number, "url": partURL.String()})
+	}
+	response["partSize"] = session.ChunkSize
+	response["parts"] = parts
+	if len(parts) == 1 {
+		response["url"] = parts[0]["url"]
+	}
+
+	if err := uploadSessions.Create(c.Request.Context(), session); err != nil {
+		log.Error("Failed to store upload session", zap.String("uploadSessionId", session.ID), zap.Error(err))
+		storage.DiscardDirectUpload(location, session.MultipartUploadID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start direct upload"})
+		return
+	}
+
+	log.Info("Direct upload started",
+		zap.String("uploadSessionId", session.ID),
+		zap.String("userID", userID),
+		zap.String("fileID", fileID),
+		zap.Int64("fileSize", session.FileSize),
+		zap.Int("parts", session.TotalChunks),
+	)
+	c.JSON(http.StatusOK, response)
+}
+
+// presignDirectUploadPartsHandler renews the URLs of some parts of a direct
+// multipart upload, for uploads outliving their URLs
+func presignDirectUploadPartsHandler(c *gin.Context, uploadSessions fileservices.UploadSessionStore, storage *fileservices.StorageService, urlTTL time.Duration, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	session, ok := lookupUploadSession(c, uploadSessions, userID, true, log)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		PartNumbers []int `json:"partNumbers" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || len(request.PartNumbers) == 0 || len(request.PartNumbers) > maxPresignedParts {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("partNumbers must list between 1 and %d parts", maxPresignedParts)})
+		return
+	}
+
+	parts := make([]gin.H, 0, len(request.PartNumbers))
+	for _, number := range request.PartNumbers {
+		if number < 1 || number > session.TotalChunks {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Part numbers must be between 1 and %d", session.TotalChunks)})
+			return
+		}
+		partURL, err := storage.PresignUploadPart(session.Location(), session.MultipartUploadID, number, urlTTL)
+		if err != nil {
+			log.Error("Failed to presign upload part", zap.String("uploadSessionId", session.ID), zap.Int("partNumber", number), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to presign upload parts"})
+			return
+		}
+		parts = append(parts, gin.H{"partNumber": number, "url": partURL.String()})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"method":    directUploadMethod,
+		"partSize":  session.ChunkSize,
+		"parts":     parts,
+		"expiresAt": time.Now().Add(urlTTL),
+	})
+}
+
+// completeDirectUploadHandler records the file of a direct upload once the
+// storage holds all of it. The stored content is checked like a proxied
+// upload: its size, its type against the content policy and, when the client
+// announced one, its SHA-256, which is computed in any case. Content failing a
+// check is removed along with the session. Completing the multipart upload
+// also voids its part URLs, no other version can be stored through them.
+func completeDirectUploadHandler(c *gin.Context, uploadSessions fileservices.UploadSessionStore, storage *fileservices.StorageService, metadata *fileservices.MetadataService, policy *fileservices.ContentPolicy, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	session, ok := lookupUploadSession(c, uploadSessions, userID, true, log)
+	if !ok {
+		return
+	}
+	sessionID := session.ID
+	location := session.Location()
+
+	acquired, err := uploadSessions.StartCompleting(c.Request.Context(), sessionID)
+	if err != nil {
+		log.Error("Failed to lock upload session", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+	if !acquired {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload session is already being completed"})
+		return
+	}
+
+	// reject drops the content and the session, the client has to start over
+	reject := func(status int, message string) {
+		if err := storage.DiscardDirectUpload(location, session.MultipartUploadID); err != nil {
+			log.Error("Failed to discard direct upload", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		}
+		if err := uploadSessions.Delete(c.Request.Context(), sessionID); err != nil {
+			log.Warn("Failed to delete upload session", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		}
+		c.JSON(status, gin.H{"error": message})
+	}
+
+	fileVersion, err := storage.CompleteMultipartUpload(location, session.MultipartUploadID, session.TotalChunks, session.FileSize)
+	if errors.Is(err, fileservices.ErrObjectNotFound) {
+		// An earlier attempt completed the upload then failed, nothing else
+		// can store a version at location so its version is the current one
+		var info fileservices.ObjectInfo
+		if info, err = storage.StatFileVersion(location, ""); err == nil {
+			fileVersion = info.VersionID
+		}
+	}
+	if errors.Is(err, fileservices.ErrIncompleteMultipart) {
+		uploadSessions.StopCompleting(c.Request.Context(), sessionID)
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to complete direct upload", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		uploadSessions.StopCompleting(c.Request.Context(), sessionID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+
+	object, _, err := storage.GetFileVersion(location, fileVersion, models.FileEncryption{})
+	if err != nil {
+		log.Error("Failed to read direct upload", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		uploadSessions.StopCompleting(c.Request.Context(), sessionID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+	defer object.Close()
+
+	contentType, content, err := policy.Sniff(session.FileName, object)
+	if errors.Is(err, fileservices.ErrContentTypeDenied) || errors.Is(err, fileservices.ErrContentTypeMismatch) {
+		log.Warn("Direct upload rejected by the content policy", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		reject(http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	// Every stored file gets a digest computed by file-service
+	checksum := fileservices.NewChecksumReader(content)
+	if err == nil {
+		_, err = io.Copy(io.Discard, checksum)
+	}
+	if err == nil && checksum.Verify(session.SHA256) != nil {
+		log.Warn("Checksum mismatch on direct upload", zap.String("uploadSessionId", sessionID), zap.String("expected", session.SHA256), zap.String("computed", checksum.Sum()))
+		reject(http.StatusBadRequest, "Checksum mismatch, the file was altered in transit")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to read direct upload", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		uploadSessions.StopCompleting(c.Request.Context(), sessionID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+
+	sha256 := checksum.Sum()
+	err = metadata.SaveFileMetadata(userID, session.FileID, session.FileName, fileVersion, session.FileSize, sha256, contentType, models.FileEncryption{}, location, session.FolderID)
+	if errors.Is(err, fileservices.ErrFolderNotFound) {
+		reject(http.StatusConflict, "The target folder no longer exists")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to save file metadata", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		uploadSessions.StopCompleting(c.Request.Context(), sessionID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+		return
+	}
+
+	if err := uploadSessions.Delete(c.Request.Context(), sessionID); err != nil {
+		log.Warn("Failed to delete upload session", zap.String("uploadSessionId", sessionID), zap.Error(err))
+	}
+
+	log.Info("Direct upload completed",
+		zap.String("uploadSessionId", sessionID),
+		zap.String("fileID", session.FileID),
+		zap.String("fileVersion", fileVersion),
+		zap.Int64("size", session.FileSize),
+	)
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "File uploaded successfully",
+		"fileID":      session.FileID,
+		"fileName":    session.FileName,
+		"fileVersion": fileVersion,
+		"size":        session.FileSize,
+		"sha256":      sha256,
+		"contentType": contentType,
+	})
+}
+
+// abortDirectUploadHandler gives up a direct upload and drops what the client
+// already sent to the storage
+func abortDirectUploadHandler(c *gin.Context, uploadSessions fileservices.UploadSessionStore, storage *fileservices.StorageService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	session, ok := lookupUploadSession(c, uploadSessions, userID, true, log)
+	if !ok {
+		return
+	}
+
+	acquired, err := uploadSessions.StartCompleting(c.Request.Context(), session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to abort upload"})
+		return
+	}
+	if !acquired {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload session is being completed"})
+		return
+	}
+
+	if err := storage.DiscardDirectUpload(session.Location(), session.MultipartUploadID); err != nil {
+		log.Error("Failed to discard direct upload", zap.String("uploadSessionId", session.ID), zap.Error(err))
+		uploadSessions.StopCompleting(c.Request.Context(), session.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to abort upload"})
+		return
+	}
+	if err := uploadSessions.Delete(c.Request.Context(), session.ID); err != nil {
+		log.Warn("Failed to delete upload session", zap.String("uploadSessionId", session.ID), zap.Error(err))
+	}
+
+	log.Info("Direct upload aborted", zap.String("uploadSessionId", session.ID), zap.String("userID", userID))
+	c.Status(http.StatusNoContent)
+}
+
+// downloadURLHandler authorizes the caller like downloadFileHandler and
+// returns a presigned URL downloading the current version straight from the
+// storage. Encrypted files, and files of a storage unable to presign URLs, get
+// the URL of downloadFileHandler instead, with "direct": false.
+func downloadURLHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, access *fileservices.AccessService, urlTTL time.Duration, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadReadableFile(c, metadata, access, userID, log)
+	if !ok {
+		return
+	}
+
+	downloadURL, err := storage.PresignDownload(file, contentDisposition(file.FileName), urlTTL)
+	if directTransferUnavailable(err) {
+		// The proxied download is authorized again, it needs the caller's token
+		c.JSON(http.StatusOK, gin.H{
+			"url":    "/api/v1/files/" + file.FileID + "/download",
+			"direct": false,
+			"method": http.MethodGet,
+			"sha256": file.SHA256,
+		})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to presign download", zap.String("fileID", file.FileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to presign download"})
+		return
+	}
+
+	log.Info("Download URL issued", zap.String("fileID", file.FileID), zap.String("userID", userID))
+	c.JSON(http.StatusOK, gin.H{
+		"url":       downloadURL.String(),
+		"direct":    true,
+		"method":    http.MethodGet,
+		"expiresAt": time.Now().Add(urlTTL),
+		"sha256":    file.SHA256,
+	})
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveObject answers a download from a stored object. Range requests, single
+// or multiple ranges, get a 206, If-None-Match and If-Modified-Since are checked
+// against the object ETag and LastModified, and HEAD requests only get headers.
+func serveObject(c *gin.Context, object fileservices.Object, info fileservices.ObjectInfo, fileName, contentType, sha256 string) {
+	// The detected type is recorded in the metadata, objects sent straight to
+	// the storage by clients do not carry it
+	if contentType == "" {
+		contentType = info.ContentType
+	}
+	c.Header("Content-Disposition", contentDisposition(fileName))
+	c.Header("Content-Type", contentType)
+	c.Header("ETag", `"`+info.ETag+`"`)
+	if sha256 != "" {
+		c.Header("Digest", fileservices.DigestHeader(sha256))
+	}
+
+	// The object is seekable: each range is fetched from the storage on demand
+	http.ServeContent(c.Writer, c.Request, fileName, info.LastModified, object)
+}
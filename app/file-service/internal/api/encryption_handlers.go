@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// rotateCompanyKeyHandler lets a company admin replace the key-encryption key
+// of the company. The data keys of its files are re-wrapped with the new KEK,
+// the stored content is left as it is.
+func rotateCompanyKeyHandler(c *gin.Context, encryptor *fileservices.FileEncryptor, access *fileservices.AccessService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		CompanyID string `json:"companyId" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if _, err := uuid.Parse(request.CompanyID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid companyId"})
+		return
+	}
+
+	isAdmin, err := access.IsCompanyAdmin(userID, request.CompanyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+		return
+	}
+	if !isAdmin {
+		log.Warn("KEK rotation denied", zap.String("userID", userID), zap.String("companyID", request.CompanyID))
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only company admins can rotate the encryption key"})
+		return
+	}
+
+	if encryptor == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Encryption at rest is disabled"})
+		return
+	}
+
+	keyID, rewrapped, err := encryptor.RotateCompanyKey(c.Request.Context(), request.CompanyID)
+	if keyID == "" {
+		log.Error("Failed to rotate KEK", zap.String("companyID", request.CompanyID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate the encryption key"})
+		return
+	}
+	if err != nil {
+		// The new KEK is current, the keys left behind are re-wrapped by the next rotation
+		log.Error("Failed to re-wrap data keys", zap.String("companyID", request.CompanyID), zap.String("keyID", keyID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Encryption key rotated but some data keys were not re-wrapped", "keyId": keyID, "rewrapped": rewrapped})
+		return
+	}
+
+	log.Info("KEK rotated", zap.String("companyID", request.CompanyID), zap.String("keyID", keyID), zap.Int("rewrapped", rewrapped), zap.String("userID", userID))
+	c.JSON(http.StatusOK, gin.H{"companyId": request.CompanyID, "keyId": keyID, "rewrapped": rewrapped})
+}
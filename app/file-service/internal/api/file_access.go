@@ -0,0 +1,83 @@
+package api
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// loadOwnedFile loads the file named in the URL and makes sure the caller owns it.
+// Files of other users are reported as not found.
+func loadOwnedFile(c *gin.Context, metadata *fileservices.MetadataService, userID string, log *zap.Logger) (*models.FileMetadata, bool) {
+	fileID := c.Param("fileID")
+
+	file, err := metadata.GetFileByID(fileID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && file.UserID != userID) {
+		log.Warn("File not found", zap.String("fileID", fileID), zap.String("userID", userID))
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Error("Failed to load file metadata", zap.String("fileID", fileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file"})
+		return nil, false
+	}
+	return file, true
+}
+
+// loadFileWithRole loads the file named in the URL and makes sure the caller
+// holds at least minRole on it. Files the caller cannot see are reported as
+// not found, files they can see but not act on as forbidden.
+func loadFileWithRole(c *gin.Context, metadata *fileservices.MetadataService, access *fileservices.AccessService, userID string, minRole string, log *zap.Logger) (*models.FileMetadata, bool) {
+	fileID := c.Param("fileID")
+
+	file, err := metadata.GetFileByID(fileID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Warn("File not found", zap.String("fileID", fileID), zap.String("userID", userID))
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Error("Failed to load file metadata", zap.String("fileID", fileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file"})
+		return nil, false
+	}
+
+	role, err := access.FileRole(file, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file"})
+		return nil, false
+	}
+	if role == "" {
+		log.Warn("Access to file denied", zap.String("fileID", fileID), zap.String("userID", userID))
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+	if models.FileRoleRank(role) < models.FileRoleRank(minRole) {
+		log.Warn("File role too low", zap.String("fileID", fileID), zap.String("userID", userID), zap.String("role", role), zap.String("required", minRole))
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to do this on this file"})
+		return nil, false
+	}
+	return file, true
+}
+
+// loadReadableFile loads the file named in the URL and makes sure the caller
+// may read it. Files the caller cannot see are reported as not found.
+func loadReadableFile(c *gin.Context, metadata *fileservices.MetadataService, access *fileservices.AccessService, userID string, log *zap.Logger) (*models.FileMetadata, bool) {
+	return loadFileWithRole(c, metadata, access, userID, models.FileRoleViewer, log)
+}
+
+// contentDisposition builds an attachment header that survives non-ASCII file names
+func contentDisposition(fileName string) string {
+	if header := mime.FormatMediaType("attachment", map[string]string{"filename": fileName}); header != "" {
+		return header
+	}
+	return "attachment"
+}
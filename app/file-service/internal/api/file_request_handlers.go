@@ -0,0 +1,385 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+var (
+	errUploaderName  = errors.New("uploader name missing or too long")
+	errUploaderEmail = errors.New("uploader email address missing or invalid")
+)
+
+const (
+	maxFileRequestTitleLength   = 200
+	maxFileRequestMessageLength = 2000
+	maxUploaderNameLength       = 200
+)
+
+// createFileRequestHandler creates an upload-only link collecting files into
+// a folder of the caller. The token is only returned by this call.
+func createFileRequestHandler(c *gin.Context, requests *fileservices.FileRequestService, defaultTTL, maxTTL time.Duration, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		FolderID  string     `json:"folderId" binding:"required"`
+		Title     string     `json:"title" binding:"required"`
+		Message   string     `json:"message"`   // Optional instructions for the uploaders
+		ExpiresAt *time.Time `json:"expiresAt"` // Defaults to now plus the default request lifetime
+		MaxFiles  int        `json:"maxFiles"`  // 0 for unlimited
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	title := strings.TrimSpace(request.Title)
+	if title == "" || len(title) > maxFileRequestTitleLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid title"})
+		return
+	}
+	if len(request.Message) > maxFileRequestMessageLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message is too long"})
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(defaultTTL)
+	if request.ExpiresAt != nil {
+		expiresAt = *request.ExpiresAt
+	}
+	if !expiresAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+		return
+	}
+	if expiresAt.After(now.Add(maxTTL)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt is too far in the future", "maxExpiresAt": now.Add(maxTTL)})
+		return
+	}
+	if request.MaxFiles < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "maxFiles must be positive, or 0 for unlimited"})
+		return
+	}
+
+	fileRequest, token, err := requests.CreateRequest(userID, request.FolderID, title, request.Message, expiresAt, request.MaxFiles)
+	if err != nil {
+		folderError(c, err, log)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"request": fileRequest,
+		"token":   token,
+		"url":     fileservices.PublicPathPrefix + "requests/" + token + "/upload",
+	})
+}
+
+// listFileRequestsHandler returns the file requests of the caller, closed and
+// expired ones included
+func listFileRequestsHandler(c *gin.Context, requests *fileservices.FileRequestService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	fileRequests, err := requests.ListRequests(userID)
+	if err != nil {
+		log.Error("Failed to list file requests", zap.String("userID", userID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list file requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"requests": fileRequests})
+}
+
+// revokeFileRequestHandler closes a file request of the caller
+func revokeFileRequestHandler(c *gin.Context, requests *fileservices.FileRequestService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	requestID, err := strconv.ParseUint(c.Param("requestID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file request ID"})
+		return
+	}
+
+	err = requests.RevokeRequest(userID, uint(requestID))
+	if errors.Is(err, fileservices.ErrFileRequestNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File request not found or already closed"})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to revoke file request", zap.Uint64("requestID", requestID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close file request"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// listFileRequestUploadsHandler returns the files received through a file
+// request of the caller, with the name and email of their uploaders
+func listFileRequestUploadsHandler(c *gin.Context, requests *fileservices.FileRequestService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	requestID, err := strconv.ParseUint(c.Param("requestID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file request ID"})
+		return
+	}
+
+	uploads, err := requests.ListUploads(userID, uint(requestID))
+	if errors.Is(err, fileservices.ErrFileRequestNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File request not found"})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to list file request uploads", zap.Uint64("requestID", requestID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list file request uploads"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"uploads": uploads})
+}
+
+// resolvePublicFileRequest loads the file request of the token in the URL and
+// checks that it still accepts files
+func resolvePublicFileRequest(c *gin.Context, requests *fileservices.FileRequestService, log *zap.Logger) (*models.FileRequest, bool) {
+	request, err := requests.ResolveRequest(c.Param("token"))
+	switch {
+	case err == nil:
+		return request, true
+	case errors.Is(err, fileservices.ErrFileRequestNotFound):
+		log.Warn("Unknown file request", zap.String("clientIP", c.ClientIP()))
+		c.JSON(http.StatusNotFound, gin.H{"error": "File request not found"})
+	case errors.Is(err, fileservices.ErrFileRequestRevoked),
+		errors.Is(err, fileservices.ErrFileRequestExpired),
+		errors.Is(err, fileservices.ErrFileRequestFull):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		log.Error("Failed to resolve file request", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file request"})
+	}
+	return nil, false
+}
+
+// publicFileRequestHandler describes a file request to the people invited to
+// answer it. The target folder and its content are never revealed.
+func publicFileRequestHandler(c *gin.Context, requests *fileservices.FileRequestService, log *zap.Logger) {
+	request, ok := resolvePublicFileRequest(c, requests, log)
+	if !ok {
+		return
+	}
+
+	response := gin.H{
+		"title":     request.Title,
+		"message":   request.Message,
+		"expiresAt": request.ExpiresAt,
+	}
+	if request.MaxFiles > 0 {
+		response["remainingFiles"] = request.MaxFiles - request.FileCount
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// publicFileRequestUploadHandler receives the files of an anonymous uploader.
+// The multipart form carries the "name" and "email" of the uploader, which
+// must come before the "files" so that they are checked before anything is
+// stored. The files are stored in the folder of the request and attributed
+// to its owner. The route is anonymous, so the whole body is bounded as well
+// as each file.
+func publicFileRequestUploadHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, requests *fileservices.FileRequestService, policy *fileservices.ContentPolicy, maxFileSize, maxRequestSize int64, log *zap.Logger) {
+	request, ok := resolvePublicFileRequest(c, requests, log)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRequestSize)
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
+		return
+	}
+
+	type uploadedFile struct {
+		fileID      string
+		fileName    string
+		fileVersion string
+		contentType string
+		checksum    *fileservices.ChecksumReader
+		encryption  models.FileEncryption
+		location    models.ObjectLocation
+	}
+	var stored []uploadedFile
+
+	// discardStored removes the objects streamed but not saved
+	discardStored := func(files []uploadedFile) {
+		for _, file := range files {
+			storage.RemoveFileVersion(file.location, file.fileVersion)
+		}
+	}
+
+	var name string
+	var address *mail.Address
+	checkField := func(field, value string) error {
+		switch field {
+		case "name":
+			name = strings.TrimSpace(value)
+			if name == "" || len(name) > maxUploaderNameLength {
+				return errUploaderName
+			}
+		case "email":
+			parsed, err := mail.ParseAddress(strings.TrimSpace(value))
+			if err != nil {
+				return errUploaderEmail
+			}
+			address = parsed
+		}
+		return nil
+	}
+
+	_, err = fileservices.StreamMultipartForm(reader, maxFileSize, checkField, func(fileName string, content io.Reader) error {
+		// The uploader must be known before the first file is stored
+		if name == "" {
+			return errUploaderName
+		}
+		if address == nil {
+			return errUploaderEmail
+		}
+		// Stop reading as soon as the request cannot take more files
+		if request.MaxFiles > 0 && request.FileCount+len(stored) >= request.MaxFiles {
+			return fileservices.ErrFileRequestFull
+		}
+
+		contentType, content, err := policy.Sniff(fileName, content)
+		if err != nil {
+			return err
+		}
+		checksum := fileservices.NewChecksumReader(content)
+		fileID, location, err := storage.NewFileLocation(request.OwnerID, request.FolderID)
+		if err != nil {
+			return err
+		}
+		fileVersion, encryption, err := storage.UploadFile(checksum, -1, location, fileName, contentType, request.OwnerID, request.FolderID)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, uploadedFile{fileID: fileID, fileName: fileName, fileVersion: fileVersion, contentType: contentType, checksum: checksum, encryption: encryption, location: location})
+		return nil
+	})
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		discardStored(stored)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request is too large. Max allowed size is %d bytes", maxRequestSize)})
+		return
+	}
+	if errors.Is(err, errUploaderName) {
+		discardStored(stored)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Your name is required"})
+		return
+	}
+	if errors.Is(err, errUploaderEmail) {
+		discardStored(stored)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid email address is required"})
+		return
+	}
+	if errors.Is(err, fileservices.ErrFileTooLarge) {
+		discardStored(stored)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File is too large. Max allowed size is %d bytes", maxFileSize)})
+		return
+	}
+	if errors.Is(err, fileservices.ErrFileRequestFull) {
+		discardStored(stored)
+		c.JSON(http.StatusConflict, gin.H{"error": "Too many files for this file request", "remainingFiles": request.MaxFiles - request.FileCount})
+		return
+	}
+	if err != nil {
+		discardStored(stored)
+		if contentTypeRejected(c, err, log) {
+			return
+		}
+		log.Error("Failed to upload file to MinIO", zap.Uint("requestID", request.ID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file to storage"})
+		return
+	}
+
+	if len(stored) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files uploaded"})
+		return
+	}
+
+	// The slots are only taken once the whole body was received
+	err = requests.ReserveUploads(request.ID, len(stored))
+	if errors.Is(err, fileservices.ErrFileRequestFull) {
+		discardStored(stored)
+		c.JSON(http.StatusGone, gin.H{"error": "This file request does not accept files anymore"})
+		return
+	}
+	if err != nil {
+		discardStored(stored)
+		log.Error("Failed to reserve file request slots", zap.Uint("requestID", request.ID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save files"})
+		return
+	}
+
+	var received []gin.H
+	for i, file := range stored {
+		err := metadata.SaveFileMetadata(request.OwnerID, file.fileID, file.fileName, file.fileVersion, file.checksum.Size(), file.checksum.Sum(), file.contentType, file.encryption, file.location, request.FolderID)
+		if err != nil {
+			// Files saved so far are kept, the others are discarded and their slots given back
+			discardStored(stored[i:])
+			if releaseErr := requests.ReleaseUploads(request.ID, len(stored)-i); releaseErr != nil {
+				log.Error("Failed to release file request slots", zap.Uint("requestID", request.ID), zap.Error(releaseErr))
+			}
+			if errors.Is(err, fileservices.ErrFolderNotFound) {
+				c.JSON(http.StatusGone, gin.H{"error": "This file request does not accept files anymore", "files": received})
+				return
+			}
+			log.Error("Failed to save file metadata", zap.Uint("requestID", request.ID), zap.String("fileID", file.fileID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save files", "files": received})
+			return
+		}
+
+		// The file is saved, a missing tag is only logged
+		_ = requests.RecordUpload(&models.FileRequestUpload{
+			RequestID:     request.ID,
+			FileID:        file.fileID,
+			UploaderName:  name,
+			UploaderEmail: address.Address,
+			ClientIP:      c.ClientIP(),
+		})
+
+		log.Info("File received through file request",
+			zap.Uint("requestID", request.ID),
+			zap.String("fileID", file.fileID),
+			zap.String("file name", file.fileName),
+			zap.String("uploader", address.Address),
+		)
+		received = append(received, gin.H{"fileName": file.fileName, "size": file.checksum.Size()})
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Files uploaded successfully",
+		"files":   received,
+	})
+}
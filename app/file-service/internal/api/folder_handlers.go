@@ -0,0 +1,228 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// folderError answers the errors returned by the FolderService
+func folderError(c *gin.Context, err error, log *zap.Logger) {
+	switch {
+	case errors.Is(err, fileservices.ErrFolderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+	case errors.Is(err, fileservices.ErrInvalidFolderName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder name"})
+	case errors.Is(err, fileservices.ErrFolderNameTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "A folder with this name already exists here"})
+	case errors.Is(err, fileservices.ErrFolderCycle):
+		c.JSON(http.StatusConflict, gin.H{"error": "A folder cannot be moved into itself or one of its subfolders"})
+	case errors.Is(err, fileservices.ErrFolderNotEmpty):
+		c.JSON(http.StatusConflict, gin.H{"error": "Folder is not empty, use recursive=true to delete its content"})
+	case errors.Is(err, fileservices.ErrFolderCompanyMismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": "Folder belongs to another company"})
+	default:
+		log.Error("Folder operation failed", zap.String("folderID", c.Param("folderID")), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Folder operation failed"})
+	}
+}
+
+// checkTargetFolder makes sure files can be stored in folderID by userID
+func checkTargetFolder(c *gin.Context, folders *fileservices.FolderService, userID, folderID string, log *zap.Logger) bool {
+	if _, err := folders.GetOwnedFolder(userID, folderID); err != nil {
+		folderError(c, err, log)
+		return false
+	}
+	return true
+}
+
+// loadBrowsableFolder loads the folder named by folderID and makes sure the
+// caller may list it. Folders the caller cannot see are reported as not found.
+func loadBrowsableFolder(c *gin.Context, folders *fileservices.FolderService, access *fileservices.AccessService, userID, folderID string, log *zap.Logger) (*models.Folder, bool) {
+	folder, err := folders.GetFolder(folderID)
+	if err != nil {
+		folderError(c, err, log)
+		return nil, false
+	}
+
+	allowed, err := access.CanBrowseFolder(folder, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve folder"})
+		return nil, false
+	}
+	if !allowed {
+		log.Warn("Access to folder denied", zap.String("folderID", folderID), zap.String("userID", userID))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return nil, false
+	}
+	return folder, true
+}
+
+// createFolderHandler creates a folder at the root or under a parent folder.
+// Top-level folders can be scoped to a company the caller belongs to.
+func createFolderHandler(c *gin.Context, folders *fileservices.FolderService, access *fileservices.AccessService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name      string `json:"name" binding:"required"`
+		ParentID  string `json:"parentId"`
+		CompanyID string `json:"companyId"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if request.CompanyID != "" {
+		if _, err := uuid.Parse(request.CompanyID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid companyId"})
+			return
+		}
+		member, err := access.IsCompanyMember(userID, request.CompanyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+			return
+		}
+		if !member {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this company"})
+			return
+		}
+	}
+
+	folder, err := folders.CreateFolder(userID, request.Name, request.ParentID, request.CompanyID)
+	if err != nil {
+		folderError(c, err, log)
+		return
+	}
+
+	c.JSON(http.StatusCreated, folder)
+}
+
+// renameFolderHandler changes the name of a folder of the caller
+func renameFolderHandler(c *gin.Context, folders *fileservices.FolderService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	folder, err := folders.RenameFolder(userID, c.Param("folderID"), request.Name)
+	if err != nil {
+		folderError(c, err, log)
+		return
+	}
+
+	log.Info("Folder renamed", zap.String("folderID", folder.ID), zap.String("name", folder.Name))
+	c.JSON(http.StatusOK, folder)
+}
+
+// moveFolderHandler moves a folder of the caller, with its content, under
+// another folder or to the root when parentId is empty
+func moveFolderHandler(c *gin.Context, folders *fileservices.FolderService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		ParentID string `json:"parentId"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	folder, err := folders.MoveFolder(userID, c.Param("folderID"), request.ParentID)
+	if err != nil {
+		folderError(c, err, log)
+		return
+	}
+
+	c.JSON(http.StatusOK, folder)
+}
+
+// deleteFolderHandler deletes a folder of the caller. With ?recursive=true its
+// subfolders are deleted too and its files are moved to the trash.
+func deleteFolderHandler(c *gin.Context, storage *fileservices.StorageService, folders *fileservices.FolderService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	folderID := c.Param("folderID")
+	recursive := c.Query("recursive") == "true"
+
+	type marker struct {
+		fileID, versionID string
+		location          models.ObjectLocation
+	}
+	var markers []marker
+	trashed, err := folders.DeleteFolder(userID, folderID, recursive, func(file *models.FileMetadata) (string, error) {
+		markerVersionID, err := storage.DeleteFile(file.Location())
+		if markerVersionID != "" {
+			markers = append(markers, marker{fileID: file.FileID, versionID: markerVersionID, location: file.Location()})
+		}
+		return markerVersionID, err
+	})
+	if err != nil {
+		// The files are still listed, make their objects visible again
+		for _, m := range markers {
+			if err := storage.RemoveFileVersion(m.location, m.versionID); err != nil {
+				log.Error("Failed to remove delete marker", zap.String("fileID", m.fileID), zap.String("markerVersionID", m.versionID), zap.Error(err))
+			}
+		}
+		folderError(c, err, log)
+		return
+	}
+
+	log.Info("Folder deleted", zap.String("userID", userID), zap.String("folderID", folderID), zap.Int("trashedFiles", trashed))
+	c.Status(http.StatusNoContent)
+}
+
+// moveFileHandler moves a file of the caller into a folder, or to the root
+// when folderId is empty
+func moveFileHandler(c *gin.Context, folders *fileservices.FolderService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		FolderID string `json:"folderId"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	fileID := c.Param("fileID")
+	file, err := folders.MoveFile(userID, fileID, request.FolderID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		folderError(c, err, log)
+		return
+	}
+
+	log.Info("File moved", zap.String("fileID", fileID), zap.String("folderID", request.FolderID))
+	c.JSON(http.StatusOK, file)
+}
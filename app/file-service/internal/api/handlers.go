@@ -1,41 +1,35 @@
 package api
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	fileconfig "file-service/internal/config"
+	"file-service/internal/models"
 	fileservices "file-service/internal/services"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"path/filepath"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/amine-bouhoula/safedocs-mvp/sdlib/config"
 	"github.com/amine-bouhoula/safedocs-mvp/sdlib/database"
 	"github.com/amine-bouhoula/safedocs-mvp/sdlib/services"
 	"github.com/gin-contrib/cors"
-	"github.com/google/uuid"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
-type UploadSession struct {
-	FileName       string
-	FileSize       int64
-	ChunkSize      int64
-	UploadedChunks map[int]bool // Track received chunks
-	TotalChunks    int
-	TempDir        string    // Directory for storing temporary chunks
-	CreatedAt      time.Time // Timestamp for session creation
-}
-
 type ChunkMetadata struct {
 	FileName       string
 	FileSize       int64
@@ -45,14 +39,7 @@ type ChunkMetadata struct {
 	TempDir        string
 }
 
-var uploadSessions = struct {
-	sync.Mutex
-	Sessions map[string]*UploadSession
-}{
-	Sessions: make(map[string]*UploadSession),
-}
-
-func StartServer(cfg *config.Config, log *zap.Logger) {
+func StartServer(cfg *config.Config, fileCfg *fileconfig.FileServiceConfig, log *zap.Logger) {
 	// Ensure logger is not nil
 	if log == nil {
 		panic("Logger is required but not provided")
@@ -70,16 +57,15 @@ func StartServer(cfg *config.Config, log *zap.Logger) {
 
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:3039"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Content-Type", "Authorization"},
+		AllowMethods:     []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Content-Type", "Authorization", "X-Chunk-SHA256", "Range", "If-None-Match", "If-Modified-Since", "X-Share-Password"},
 		AllowCredentials: true,
-		ExposeHeaders:    []string{"Content-Length", "Authorization"},
+		ExposeHeaders:    []string{"Content-Length", "Authorization", "Digest", "ETag", "Accept-Ranges", "Content-Range", "Last-Modified"},
 		MaxAge:           12 * time.Hour, // Caching preflight requests
 	}))
 
 	// Initialize services with proper error handling
-	log.Info("Initializing storage service")
-	storageService, err := fileservices.ConnectMinio(cfg.MinIOURL, cfg.MinIOUser, cfg.MinIOPass, log)
+	storageService, encryptor, err := OpenStorageService(cfg, fileCfg, log)
 	if err != nil {
 		log.Fatal("Failed to initialize storage service", zap.Error(err))
 	}
@@ -92,6 +78,37 @@ func StartServer(cfg *config.Config, log *zap.Logger) {
 	}
 	log.Info("Metadata service initialized successfully")
 
+	accessService := fileservices.NewAccessService(database.DB, log)
+	folderService := fileservices.NewFolderService(database.DB, log)
+	searchService := fileservices.NewSearchService(database.DB, log)
+	shareService := fileservices.NewShareService(database.DB, log)
+	shareLinkService := fileservices.NewShareLinkService(database.DB, log)
+	fileRequestService := fileservices.NewFileRequestService(database.DB, log)
+	var ws = fileservices.NewWebSocketServer(log)
+	userDirectory := fileservices.NewUserDirectory(fileCfg.UserServiceURL)
+
+	// Types of the uploaded files, detected from their content
+	contentPolicy := fileservices.NewContentPolicy(fileCfg.AllowedTypes, fileCfg.DeniedTypes)
+
+	// Expands uploaded ZIP archives in the background
+	archiveImporter := fileservices.NewArchiveImporter(storageService, metadataService, folderService, ws, contentPolicy, fileservices.ArchiveImportLimits{
+		MaxEntries:      fileCfg.ImportMaxEntries,
+		MaxExpandedSize: fileCfg.ImportMaxExpanded,
+		MaxRatio:        fileCfg.ImportMaxRatio,
+	}, log)
+
+	log.Info("Initializing upload session store", zap.String("store", fileCfg.UploadSessionStore))
+	var uploadSessions fileservices.UploadSessionStore
+	switch fileCfg.UploadSessionStore {
+	case "redis":
+		uploadSessions = fileservices.NewRedisUploadSessionStore(database.RedisClient, fileCfg.UploadSessionTTL)
+	case "memory":
+		uploadSessions = fileservices.NewMemoryUploadSessionStore(fileCfg.UploadSessionTTL)
+	default:
+		log.Fatal("Unknown upload session store", zap.String("store", fileCfg.UploadSessionStore))
+	}
+	log.Info("Upload session store initialized successfully")
+
 	// Load the RSA public key
 	log.Info("Loading RSA public key", zap.String("public_key_path", cfg.PublicKeyPath))
 	publicKey, err := services.LoadPublicKey(cfg.PublicKeyPath)
@@ -108,88 +125,319 @@ func StartServer(cfg *config.Config, log *zap.Logger) {
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	router.POST("/api/v1/files/start-upload", func(c *gin.Context) {
-		startUpload(c, log)
+		startUpload(c, uploadSessions, folderService, fileCfg.UploadTempDir, log)
+	})
+
+	router.PUT("/api/v1/files/upload/:sessionId/chunks/:index", func(c *gin.Context) {
+		uploadChunkHandler(c, uploadSessions, log)
+	})
+
+	router.GET("/api/v1/files/upload/:sessionId", func(c *gin.Context) {
+		uploadStatusHandler(c, uploadSessions, log)
+	})
+
+	router.POST("/api/v1/files/upload/:sessionId/complete", func(c *gin.Context) {
+		completeUploadHandler(c, uploadSessions, storageService, metadataService, contentPolicy, log)
+	})
+
+	// Direct uploads go from the client to the storage through presigned URLs
+	router.POST("/api/v1/files/direct-uploads", func(c *gin.Context) {
+		startDirectUploadHandler(c, uploadSessions, storageService, folderService, fileCfg.DirectMaxFileSize, fileCfg.DirectPartSize, fileCfg.DirectURLTTL, fileCfg.UploadTempDir, log)
+	})
+
+	router.POST("/api/v1/files/direct-uploads/:sessionId/parts", func(c *gin.Context) {
+		presignDirectUploadPartsHandler(c, uploadSessions, storageService, fileCfg.DirectURLTTL, log)
+	})
+
+	router.POST("/api/v1/files/direct-uploads/:sessionId/complete", func(c *gin.Context) {
+		completeDirectUploadHandler(c, uploadSessions, storageService, metadataService, contentPolicy, log)
+	})
+
+	router.DELETE("/api/v1/files/direct-uploads/:sessionId", func(c *gin.Context) {
+		abortDirectUploadHandler(c, uploadSessions, storageService, log)
 	})
 
 	// Define routes
 	log.Info("Defining routes")
 	router.POST("/api/v1/files/upload", func(c *gin.Context) {
 		log.Info("Handling /upload request", zap.String("method", c.Request.Method))
-		singleFileUploadHandler(c, storageService, metadataService, log)
+		singleFileUploadHandler(c, storageService, metadataService, folderService, contentPolicy, fileCfg.UploadMaxFileSize, fileCfg.UploadMaxRequest, log)
+	})
+
+	router.POST("/api/v1/files/upload/archive", func(c *gin.Context) {
+		importArchiveHandler(c, archiveImporter, folderService, fileCfg.UploadTempDir, fileCfg.ImportMaxSize, log)
 	})
 
 	router.GET("/api/v1/files/list", func(c *gin.Context) {
 		log.Info("Handling /download request", zap.String("method", c.Request.Method), zap.String("path", c.Request.URL.Path))
-		fileslisterHandler(c, metadataService, log)
+		fileslisterHandler(c, metadataService, folderService, accessService, log)
+	})
+
+	router.POST("/api/v1/files/archive", func(c *gin.Context) {
+		archiveHandler(c, storageService, metadataService, folderService, accessService, fileCfg.ArchiveMaxSize, log)
+	})
+
+	router.GET("/api/v1/files/search", func(c *gin.Context) {
+		searchFilesHandler(c, searchService, accessService, log)
+	})
+
+	router.GET("/api/v1/files/shared-with-me", func(c *gin.Context) {
+		sharedWithMeHandler(c, shareService, log)
+	})
+
+	router.POST("/api/v1/files/:fileID/shares", func(c *gin.Context) {
+		shareFileHandler(c, metadataService, shareService, accessService, userDirectory, log)
+	})
+
+	router.GET("/api/v1/files/:fileID/shares", func(c *gin.Context) {
+		listFileSharesHandler(c, metadataService, shareService, log)
+	})
+
+	router.DELETE("/api/v1/files/:fileID/shares/:shareID", func(c *gin.Context) {
+		revokeFileShareHandler(c, metadataService, shareService, log)
+	})
+
+	router.POST("/api/v1/files/:fileID/links", func(c *gin.Context) {
+		createShareLinkHandler(c, metadataService, shareLinkService, fileCfg.ShareLinkDefaultTTL, fileCfg.ShareLinkMaxTTL, log)
+	})
+
+	router.GET("/api/v1/files/:fileID/links", func(c *gin.Context) {
+		listShareLinksHandler(c, metadataService, shareLinkService, log)
+	})
+
+	router.DELETE("/api/v1/files/:fileID/links/:linkID", func(c *gin.Context) {
+		revokeShareLinkHandler(c, metadataService, shareLinkService, log)
+	})
+
+	router.GET("/api/v1/files/:fileID/links/:linkID/accesses", func(c *gin.Context) {
+		listShareLinkAccessesHandler(c, metadataService, shareLinkService, log)
+	})
+
+	// Public share link endpoints, skipped by the authentication middleware
+	router.GET("/api/v1/public/links/:token", func(c *gin.Context) {
+		publicShareLinkHandler(c, shareLinkService, log)
+	})
+
+	publicDownloadHandler := func(c *gin.Context) {
+		publicShareLinkDownloadHandler(c, storageService, shareLinkService, log)
+	}
+	router.GET("/api/v1/public/links/:token/download", publicDownloadHandler)
+	router.HEAD("/api/v1/public/links/:token/download", publicDownloadHandler)
+	router.POST("/api/v1/public/links/:token/download", publicDownloadHandler)
+
+	router.POST("/api/v1/file-requests", func(c *gin.Context) {
+		createFileRequestHandler(c, fileRequestService, fileCfg.FileRequestTTL, fileCfg.FileRequestMaxTTL, log)
+	})
+
+	router.GET("/api/v1/file-requests", func(c *gin.Context) {
+		listFileRequestsHandler(c, fileRequestService, log)
+	})
+
+	router.DELETE("/api/v1/file-requests/:requestID", func(c *gin.Context) {
+		revokeFileRequestHandler(c, fileRequestService, log)
+	})
+
+	router.GET("/api/v1/file-requests/:requestID/uploads", func(c *gin.Context) {
+		listFileRequestUploadsHandler(c, fileRequestService, log)
+	})
+
+	// Public file request endpoints, skipped by the authentication middleware
+	router.GET("/api/v1/public/requests/:token", func(c *gin.Context) {
+		publicFileRequestHandler(c, fileRequestService, log)
+	})
+
+	router.POST("/api/v1/public/requests/:token/upload", func(c *gin.Context) {
+		publicFileRequestUploadHandler(c, storageService, metadataService, fileRequestService, contentPolicy, fileCfg.FileRequestMaxSize, fileCfg.FileRequestMaxBody, log)
 	})
 
 	router.DELETE("/api/v1/files/:fileID", func(c *gin.Context) {
 		log.Info("Handling /delete request", zap.String("method", c.Request.Method), zap.String("path", c.Request.URL.Path))
-		singleFileDeleteHandler(c, metadataService, log)
+		singleFileDeleteHandler(c, storageService, metadataService, accessService, log)
 	})
 
-	var ws = fileservices.NewWebSocketServer(log)
+	router.POST("/api/v1/files/:fileID/versions", func(c *gin.Context) {
+		uploadFileVersionHandler(c, storageService, metadataService, accessService, contentPolicy, fileCfg.UploadMaxFileSize, log)
+	})
+
+	router.GET("/api/v1/files/:fileID/versions", func(c *gin.Context) {
+		listFileVersionsHandler(c, metadataService, accessService, log)
+	})
+
+	downloadVersionHandler := func(c *gin.Context) {
+		downloadFileVersionHandler(c, storageService, metadataService, accessService, log)
+	}
+	router.GET("/api/v1/files/:fileID/versions/:version/download", downloadVersionHandler)
+	router.HEAD("/api/v1/files/:fileID/versions/:version/download", downloadVersionHandler)
+
+	router.POST("/api/v1/files/:fileID/versions/:version/restore", func(c *gin.Context) {
+		restoreFileVersionHandler(c, storageService, metadataService, accessService, log)
+	})
+
+	router.PUT("/api/v1/files/:fileID/folder", func(c *gin.Context) {
+		moveFileHandler(c, folderService, log)
+	})
+
+	router.POST("/api/v1/folders", func(c *gin.Context) {
+		createFolderHandler(c, folderService, accessService, log)
+	})
+
+	router.PATCH("/api/v1/folders/:folderID", func(c *gin.Context) {
+		renameFolderHandler(c, folderService, log)
+	})
+
+	router.POST("/api/v1/folders/:folderID/move", func(c *gin.Context) {
+		moveFolderHandler(c, folderService, log)
+	})
+
+	router.DELETE("/api/v1/folders/:folderID", func(c *gin.Context) {
+		deleteFolderHandler(c, storageService, folderService, log)
+	})
+
+	router.GET("/api/v1/files/trash", func(c *gin.Context) {
+		listTrashHandler(c, metadataService, log)
+	})
+
+	router.POST("/api/v1/files/:fileID/restore", func(c *gin.Context) {
+		restoreTrashedFileHandler(c, storageService, metadataService, log)
+	})
+
+	router.PUT("/api/v1/files/trash/retention", func(c *gin.Context) {
+		setTrashRetentionHandler(c, metadataService, accessService, log)
+	})
+
+	router.POST("/api/v1/files/encryption/rotate", func(c *gin.Context) {
+		rotateCompanyKeyHandler(c, encryptor, accessService, log)
+	})
 
 	router.GET("/api/v1/files/ws-connection", func(c *gin.Context) {
 		ws.HandleConnection(c, publicKey)
 	})
 
-	router.GET("/api/v1/files/download/:bucket/:file", func(c *gin.Context) {
+	downloadHandler := func(c *gin.Context) {
 		log.Info("Handling /download request", zap.String("method", c.Request.Method), zap.String("path", c.Request.URL.Path))
-		downloadFileHandler(c, storageService)
+		downloadFileHandler(c, storageService, metadataService, accessService, log)
+	}
+	router.GET("/api/v1/files/:fileID/download", downloadHandler)
+	router.HEAD("/api/v1/files/:fileID/download", downloadHandler)
+
+	router.GET("/api/v1/files/:fileID/download-url", func(c *gin.Context) {
+		downloadURLHandler(c, storageService, metadataService, accessService, fileCfg.DirectURLTTL, log)
 	})
 
+	// Reclaim abandoned uploads in the background
+	janitor := fileservices.NewUploadJanitor(uploadSessions, storageService, fileCfg.UploadTempDir, fileCfg.UploadMaxAge, fileCfg.JanitorInterval, log)
+	janitor.Start()
+
+	// Purge the files whose trash retention elapsed
+	purger := fileservices.NewTrashPurger(metadataService, storageService, fileCfg.TrashRetention, fileCfg.TrashPurgeInterval, log)
+	purger.Start()
+
+	// Extract the text of new files and versions for the full-text search
+	indexer := fileservices.NewSearchIndexer(searchService, storageService, fileCfg.SearchMaxFileSize, fileCfg.SearchIndexInterval, log)
+	indexer.Start()
+
+	// Report, and optionally repair, the drift between the storage and the metadata
+	reconciler := fileservices.NewStorageReconciler(database.DB, storageService, fileCfg.ReconcileMinAge, fileCfg.ReconcileInterval, fileCfg.ReconcileRepair, log)
+	reconciler.Start()
+
 	// Start the server
 	port := cfg.ServerPort
-	log.Info("Starting server", zap.String("port", port))
-	if err := router.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server", zap.Error(err))
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	go func() {
+		log.Info("Starting server", zap.String("port", port))
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Failed to start server", zap.Error(err))
+		}
+	}()
+
+	// Wait for a termination signal, then drain requests and background jobs
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Info("Shutting down server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error("Server forced to shut down", zap.Error(err))
 	}
+	janitor.Stop()
+	purger.Stop()
+	indexer.Stop()
+	reconciler.Stop()
+	archiveImporter.Stop()
+	log.Info("Server stopped")
 }
 
-func downloadFileHandler(c *gin.Context, storageService *fileservices.StorageService) {
-	bucketName := c.Param("bucket")
-	fileName := c.Param("file")
-
-	// Get the file and its content type
-	object, contentType, err := storageService.GetFile(bucketName, fileName)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download file: " + err.Error()})
+// downloadFileHandler streams the current version of a file to the caller once
+// they are authorized as its owner, a share recipient or a company admin
+func downloadFileHandler(c *gin.Context, storageService *fileservices.StorageService, metadata *fileservices.MetadataService, access *fileservices.AccessService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
-	defer object.Close()
 
-	// Set appropriate headers
-	c.Header("Content-Disposition", "attachment; filename="+filepath.Base(fileName))
-	c.Header("Content-Type", contentType)
+	file, ok := loadReadableFile(c, metadata, access, userID, log)
+	if !ok {
+		return
+	}
 
-	// Stream the object directly to the response
-	_, err = io.Copy(c.Writer, object)
+	// Get the object, named after the fileID, and its content type
+	object, info, err := storageService.GetFile(file)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stream file: " + err.Error()})
+		log.Error("Failed to get file from storage", zap.String("fileID", file.FileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download file"})
 		return
 	}
-}
+	defer object.Close()
 
-func listFileVersionsHandler(c *gin.Context, storage *fileservices.StorageService) {
-	bucketName := c.Param("bucket")
-	fileName := c.Param("file")
+	serveObject(c, object, info, file.FileName, file.ContentType, file.SHA256)
+}
 
-	versions, err := storage.ListFileVersions(bucketName, fileName)
+// newChunkedUploadSession stores the session of a chunked upload, whose chunks
+// are kept in a new directory below tempRoot until the upload is completed
+func newChunkedUploadSession(ctx context.Context, uploadSessions fileservices.UploadSessionStore, userID, fileName string, fileSize, chunkSize int64, sha256, folderID, tempRoot string) (*fileservices.UploadSession, error) {
+	sessionID := generateSessionID()
+	tempDir, err := fileservices.NewChunkDir(tempRoot, sessionID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list file versions: " + err.Error()})
-		return
+		return nil, fmt.Errorf("error creating chunk directory: %w", err)
+	}
+
+	session := &fileservices.UploadSession{
+		ID:             sessionID,
+		UserID:         userID,
+		FileName:       fileName,
+		FileSize:       fileSize,
+		ChunkSize:      chunkSize,
+		SHA256:         sha256,
+		FolderID:       folderID,
+		UploadedChunks: make(map[int]bool),
+		TotalChunks:    int((fileSize + chunkSize - 1) / chunkSize),
+		TempDir:        tempDir,
+		CreatedAt:      time.Now(),
 	}
 
-	c.JSON(http.StatusOK, versions)
+	// Store the session so that any replica can receive its chunks
+	if err := uploadSessions.Create(ctx, session); err != nil {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("error storing upload session: %w", err)
+	}
+	return session, nil
 }
 
-// StartUpload initializes an upload session
-func startUpload(c *gin.Context, log *zap.Logger) {
+// startUpload initializes an upload session
+func startUpload(c *gin.Context, uploadSessions fileservices.UploadSessionStore, folders *fileservices.FolderService, tempRoot string, log *zap.Logger) {
+	userIDStr, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
 	var request []struct {
 		FileName  string `json:"fileName"`
 		FileSize  int64  `json:"fileSize"`
 		ChunkSize int64  `json:"chunkSize"`
+		SHA256    string `json:"sha256"`   // Optional hex encoded SHA-256 of the whole file
+		FolderID  string `json:"folderId"` // Optional folder receiving the file
 	}
 
 	log.Info("Received request to start multiple upload sessions", zap.String("clientIP", c.ClientIP()))
@@ -214,34 +462,38 @@ func startUpload(c *gin.Context, log *zap.Logger) {
 			return
 		}
 
+		if file.SHA256 != "" && !fileservices.ValidSHA256(file.SHA256) {
+			log.Error("Invalid sha256", zap.String("fileName", file.FileName), zap.String("sha256", file.SHA256))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sha256, must be a hex encoded SHA-256 digest"})
+			return
+		}
+
+		if file.FolderID != "" {
+			if ok := checkTargetFolder(c, folders, userIDStr, file.FolderID, log); !ok {
+				return
+			}
+		}
+
 		// Default chunk size to 5MB if not provided
 		if file.ChunkSize <= 0 {
 			file.ChunkSize = 5 * 1024 * 1024 // 5MB
 			log.Info("Default chunk size applied", zap.Int64("chunkSize", file.ChunkSize))
 		}
 
-		// Generate a unique upload session ID
-		uploadSessionId := generateSessionID()
-		log.Info("Generated unique upload session ID", zap.String("uploadSessionId", uploadSessionId))
-
-		// Create a new upload session
-		uploadSession := &UploadSession{
-			FileName:       file.FileName,
-			FileSize:       file.FileSize,
-			ChunkSize:      file.ChunkSize,
-			UploadedChunks: make(map[int]bool),
-			CreatedAt:      time.Now(),
+		uploadSession, err := newChunkedUploadSession(c.Request.Context(), uploadSessions, userIDStr, file.FileName, file.FileSize, file.ChunkSize, file.SHA256, file.FolderID, tempRoot)
+		if err != nil {
+			log.Error("Failed to start upload session", zap.String("fileName", file.FileName), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start upload session"})
+			return
 		}
-
-		// Store the session in memory
-		uploadSessions.Lock()
-		uploadSessions.Sessions[uploadSessionId] = uploadSession
-		uploadSessions.Unlock()
+		uploadSessionId := uploadSession.ID
 		log.Info("Upload session created successfully",
 			zap.String("uploadSessionId", uploadSessionId),
+			zap.String("userID", userIDStr),
 			zap.String("fileName", file.FileName),
 			zap.Int64("fileSize", file.FileSize),
 			zap.Int64("chunkSize", file.ChunkSize),
+			zap.Int("totalChunks", uploadSession.TotalChunks),
 		)
 
 		// Add the session details to the response
@@ -249,6 +501,7 @@ func startUpload(c *gin.Context, log *zap.Logger) {
 			"uploadSessionId": uploadSessionId,
 			"fileName":        file.FileName,
 			"chunkSize":       file.ChunkSize,
+			"totalChunks":     uploadSession.TotalChunks,
 		})
 	}
 
@@ -266,32 +519,69 @@ func generateSessionID() string {
 	return hex.EncodeToString(bytes)
 }
 
-func singleFileUploadHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, log *zap.Logger) {
-	startTime := time.Now()
-
-	bodyBytes, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		log.Error("Failed to read request body", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-		return
-	}
-
+// currentUserID returns the userID set by the AuthMiddleware, answering 401 when it is missing
+func currentUserID(c *gin.Context) (string, bool) {
 	userID, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "UserID not found in context"})
-		return
+		return "", false
 	}
 
 	userIDStr, ok := userID.(string)
 	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "UserID is not of type string"})
-		return
+		return "", false
 	}
+	return userIDStr, true
+}
+
+var (
+	errFolderAfterFiles = errors.New("folderId sent after the files")
+	errTargetFolder     = errors.New("invalid target folder")
+)
+
+// Codes of the per-file errors of a batch upload
+const (
+	uploadErrorTooLarge    = "file_too_large"
+	uploadErrorType        = "unsupported_type"
+	uploadErrorChecksum    = "checksum_mismatch"
+	uploadErrorStorage     = "storage_error"
+	uploadErrorMetadata    = "metadata_error"
+	uploadErrorUnprocessed = "not_processed"
+)
+
+// uploadError explains why one file of a batch was not stored
+type uploadError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// uploadResult is the outcome of one file of a batch upload, in the order of the form
+type uploadResult struct {
+	FileName    string       `json:"fileName"`
+	FileID      string       `json:"fileId,omitempty"`
+	FileVersion string       `json:"fileVersion,omitempty"`
+	Size        int64        `json:"size"` // Bytes received, measured by the server
+	SHA256      string       `json:"sha256,omitempty"`
+	ContentType string       `json:"contentType,omitempty"`
+	Error       *uploadError `json:"error,omitempty"`
+}
+
+// singleFileUploadHandler streams every file of a multipart request straight
+// to MinIO. The body is read part by part, so memory usage does not depend on
+// the size of the files. Sizes are counted while streaming. A file failing on
+// its own, too large or of a refused type, does not stop the others: every
+// file gets its own result, and the response is 207 when only some were stored.
+// The optional "folderId" field must come before the files.
+func singleFileUploadHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, folders *fileservices.FolderService, policy *fileservices.ContentPolicy, maxFileSize, maxRequestSize int64, log *zap.Logger) {
+	startTime := time.Now()
 
-	// Restore the request body so it can be read again by the Gin context
-	c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+	userIDStr, ok := currentUserID(c)
+	if !ok {
+		return
+	}
 
-	// Log the request headers and body
+	// Log the request headers
 	log.Info("Received upload request",
 		zap.String("user id", userIDStr),
 		zap.String("method", c.Request.Method),
@@ -299,108 +589,245 @@ func singleFileUploadHandler(c *gin.Context, storage *fileservices.StorageServic
 		zap.String("clientIP", c.ClientIP()),
 		zap.String("headers", fmt.Sprintf("%v", c.Request.Header)),
 	)
-	const maxFileSize = 100 * 1024 * 1024 // 10MB in bytes
-	// Parse multipart form data
-	form, err := c.MultipartForm()
+
+	// The whole body, files and fields, is bounded by the request limit
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRequestSize)
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
 		return
 	}
 
-	// Get files from the form data
-	files := form.File["files"] // "files" is the name attribute in the React file input
-	if len(files) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No files uploaded"})
-		return
+	type uploadedFile struct {
+		result     int // Index in results
+		checksum   *fileservices.ChecksumReader
+		encryption models.FileEncryption
+		location   models.ObjectLocation
 	}
+	var results []uploadResult
+	var stored []uploadedFile
 
-	var uploadedFiles []string
+	fail := func(index int, code, message string) {
+		results[index].Error = &uploadError{Code: code, Message: message}
+	}
 
-	for _, file := range files {
-		// Check file size
-		if file.Size > maxFileSize {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": fmt.Sprintf("File %s is too large. Max allowed size is 10MB", file.Filename),
-			})
-			return
+	// discardStored removes the objects already streamed when the request is rejected
+	discardStored := func() {
+		for _, file := range stored {
+			storage.RemoveFileVersion(file.location, results[file.result].FileVersion)
 		}
+	}
 
-		// Open the file
-		fileContent, err := file.Open()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to open file"})
-			return
+	// Optional "folderId" field: the folder receiving the files, the root by
+	// default. Its company decides where the files are stored and which keys
+	// encrypt them, so it must come before the files.
+	var folderID string
+	checkField := func(field, value string) error {
+		if field != "folderId" || value == "" {
+			return nil
 		}
-		defer fileContent.Close()
-
-		fileID := uuid.New().String()
-		fileSizeStr := c.PostForm("fileSize")
-
-		var multiplier int64
-		if strings.HasSuffix(fileSizeStr, "MB") {
-			multiplier = 1 // File size is already in MB
-			fileSizeStr = strings.TrimSuffix(fileSizeStr, "MB")
-		} else if strings.HasSuffix(fileSizeStr, "GB") {
-			multiplier = 1024 // 1 GB = 1024 MB
-			fileSizeStr = strings.TrimSuffix(fileSizeStr, "GB")
-		} else {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Invalid file size. Must end with 'MB' or 'GB'.",
-			})
-			return
+		if len(results) > 0 {
+			return errFolderAfterFiles
 		}
+		if _, err := folders.GetOwnedFolder(userIDStr, value); err != nil {
+			return fmt.Errorf("%w: %w", errTargetFolder, err)
+		}
+		folderID = value
+		return nil
+	}
 
-		// Parse the numeric part of the file size
-		fileSizeNumber, err := strconv.ParseFloat(fileSizeStr, 64)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Invalid file size. Must be a valid number.",
-			})
-			return
+	// "files" is the name attribute in the React file input
+	values, err := fileservices.StreamMultipartForm(reader, maxFileSize, checkField, func(fileName string, content io.Reader) error {
+		index := len(results)
+		results = append(results, uploadResult{FileName: fileName})
+
+		contentType, content, err := policy.Sniff(fileName, content)
+		var checksum *fileservices.ChecksumReader
+		var fileID, fileVersion string
+		var location models.ObjectLocation
+		var encryption models.FileEncryption
+		if err == nil {
+			fileID, location, err = storage.NewFileLocation(userIDStr, folderID)
+		}
+		if err == nil {
+			checksum = fileservices.NewChecksumReader(content)
+			fileVersion, encryption, err = storage.UploadFile(checksum, -1, location, fileName, contentType, userIDStr, folderID)
+			results[index].Size = checksum.Size()
 		}
 
-		// Convert megabytes to bytes
-		fileSizeBytes := int64(fileSizeNumber*1024*1024) * multiplier
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			// The body is cut, the following parts cannot be read
+			return err
+		case errors.Is(err, fileservices.ErrFileTooLarge):
+			fail(index, uploadErrorTooLarge, fmt.Sprintf("File is too large. Max allowed size is %d bytes", maxFileSize))
+			return nil
+		case errors.Is(err, fileservices.ErrContentTypeDenied), errors.Is(err, fileservices.ErrContentTypeMismatch):
+			log.Warn("Upload rejected by the content policy", zap.String("file name", fileName), zap.Error(err))
+			fail(index, uploadErrorType, err.Error())
+			return nil
+		case err != nil:
+			log.Error("Failed to upload file to MinIO", zap.String("file name", fileName), zap.Error(err))
+			fail(index, uploadErrorStorage, "Failed to upload file to storage")
+			return nil
+		}
 
-		// Upload file to MinIO
-		objectName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), file.Filename)
-		fileID, fileVersion, err := storage.UploadFile(fileContent, fileID, file.Filename, "application/octet-stream")
-		if err != nil {
-			log.Error("Failed to upload merged file to MinIO", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file to storage"})
+		log.Info("File streamed to MinIO", zap.String("file name", fileName), zap.String("fileID", fileID), zap.String("file version", fileVersion), zap.String("sha256", checksum.Sum()))
+		results[index].FileID = fileID
+		results[index].FileVersion = fileVersion
+		results[index].ContentType = contentType
+		stored = append(stored, uploadedFile{result: index, checksum: checksum, encryption: encryption, location: location})
+		return nil
+	})
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		discardStored()
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request is too large. Max allowed size is %d bytes", maxRequestSize)})
+		return
+	}
+	if errors.Is(err, errFolderAfterFiles) {
+		discardStored()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The folderId field must come before the files"})
+		return
+	}
+	if errors.Is(err, errTargetFolder) {
+		discardStored()
+		folderError(c, err, log)
+		return
+	}
+	if err != nil {
+		discardStored()
+		log.Error("Failed to read upload request", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload request"})
+		return
+	}
+
+	if len(results) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files uploaded"})
+		return
+	}
+
+	// Optional "checksums" field: a JSON object mapping file names to their hex encoded SHA-256
+	expectedChecksums := map[string]string{}
+	if raw := values["checksums"]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &expectedChecksums); err != nil {
+			discardStored()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid checksums field, must be a JSON object of file names to SHA-256 digests"})
 			return
 		}
+	}
 
-		log.Info("Merged file uploaded successfully", zap.String("fileID", fileID), zap.String("file version", fileVersion))
+	// IDs of the stored files, the details of each file are in results
+	uploadedFiles := []string{}
+	for i, file := range stored {
+		result := &results[file.result]
+		result.SHA256 = file.checksum.Sum()
+
+		if err := file.checksum.Verify(expectedChecksums[result.FileName]); err != nil {
+			log.Warn("Checksum mismatch",
+				zap.String("file name", result.FileName),
+				zap.String("expected", expectedChecksums[result.FileName]),
+				zap.String("computed", result.SHA256),
+			)
+			storage.RemoveFileVersion(file.location, result.FileVersion)
+			fail(file.result, uploadErrorChecksum, "Checksum mismatch, the file was altered in transit")
+			continue
+		}
 
-		// Save metadata
-		err = metadata.SaveFileMetadata(userIDStr, fileID, file.Filename, fileVersion, fileSizeBytes)
+		err = metadata.SaveFileMetadata(userIDStr, result.FileID, result.FileName, result.FileVersion, result.Size, result.SHA256, result.ContentType, file.encryption, file.location, folderID)
+		if errors.Is(err, fileservices.ErrFolderNotFound) {
+			// The folder vanished after being checked, none of the files can be saved
+			for _, left := range stored[i:] {
+				storage.RemoveFileVersion(left.location, results[left.result].FileVersion)
+				fail(left.result, uploadErrorUnprocessed, "The target folder no longer exists")
+			}
+			break
+		}
 		if err != nil {
-			log.Error("Failed to save file metadata", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
-			return
+			log.Error("Failed to save file metadata", zap.String("file name", result.FileName), zap.Error(err))
+			storage.RemoveFileVersion(file.location, result.FileVersion)
+			fail(file.result, uploadErrorMetadata, "Failed to save file metadata")
+			continue
 		}
 
-		uploadedFiles = append(uploadedFiles, objectName)
+		uploadedFiles = append(uploadedFiles, result.FileID)
 
-		// Log and respond
-		duration := time.Since(startTime)
-		log.Info("File upload in MINIO and assembly process completed ",
-			zap.String("file name", file.Filename),
-			zap.String("file ID", fileID),
-			zap.String("file version", fileVersion),
-			zap.Duration("duration", duration),
+		log.Info("File upload in MINIO completed",
+			zap.String("file name", result.FileName),
+			zap.String("file ID", result.FileID),
+			zap.String("file version", result.FileVersion),
+			zap.Int64("size", result.Size),
+			zap.Duration("duration", time.Since(startTime)),
 		)
 	}
 
-	// Return success response
-	c.JSON(http.StatusOK, gin.H{
-		"message":       "Files uploaded successfully",
+	status, message := http.StatusOK, "Files uploaded successfully"
+	switch {
+	case len(uploadedFiles) == 0:
+		status, message = http.StatusUnprocessableEntity, "No file could be uploaded"
+	case len(uploadedFiles) < len(results):
+		status, message = http.StatusMultiStatus, "Some files could not be uploaded"
+	}
+	c.JSON(status, gin.H{
+		"message":       message,
 		"uploadedFiles": uploadedFiles,
+		"files":         results,
 	})
 }
 
-func fileslisterHandler(c *gin.Context, metadata *fileservices.MetadataService, log *zap.Logger) {
+// parseFileListQuery reads the sort, filters and cursor of the file listing:
+// sort=name|size|created|version, order=asc|desc, limit, cursor, contentType,
+// createdAfter and createdBefore (RFC 3339) and namePrefix
+func parseFileListQuery(c *gin.Context) (fileservices.FileListQuery, error) {
+	query := fileservices.FileListQuery{
+		Sort:        c.DefaultQuery("sort", "name"),
+		Cursor:      c.Query("cursor"),
+		ContentType: c.Query("contentType"),
+		NamePrefix:  c.Query("namePrefix"),
+		Limit:       fileservices.DefaultFileListLimit,
+	}
+
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("order must be asc or desc")
+	}
+
+	switch query.Sort {
+	case "name", "size", "created", "version":
+	default:
+		return query, fmt.Errorf("sort must be one of name, size, created or version")
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > fileservices.MaxFileListLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", fileservices.MaxFileListLimit)
+		}
+		query.Limit = n
+	}
+
+	var err error
+	if after := c.Query("createdAfter"); after != "" {
+		if query.CreatedAfter, err = time.Parse(time.RFC3339, after); err != nil {
+			return query, fmt.Errorf("createdAfter must be an RFC 3339 date")
+		}
+	}
+	if before := c.Query("createdBefore"); before != "" {
+		if query.CreatedBefore, err = time.Parse(time.RFC3339, before); err != nil {
+			return query, fmt.Errorf("createdBefore must be an RFC 3339 date")
+		}
+	}
+	return query, nil
+}
+
+// fileslisterHandler lists one folder at a time: its subfolders, one page of
+// its files and the breadcrumbs leading to it. Without ?folderId the caller's
+// root is listed. The next page is requested with the returned nextCursor.
+func fileslisterHandler(c *gin.Context, metadata *fileservices.MetadataService, folders *fileservices.FolderService, access *fileservices.AccessService, log *zap.Logger) {
 	// Step 1: Extract the token from the Authorization header
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
@@ -430,56 +857,133 @@ func fileslisterHandler(c *gin.Context, metadata *fileservices.MetadataService,
 		return
 	}
 
-	// Step 3: Fetch files for the user from the database
-	files, err := metadata.GetFilesByUserID(userIDStr)
+	// Step 3: Parse the sort, filters and cursor of the page
+	query, err := parseFileListQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Step 4: Resolve the folder being browsed
+	var folder *models.Folder
+	breadcrumbs := []models.Breadcrumb{}
+	query.OwnerID = userIDStr
+	if folderID := c.Query("folderId"); folderID != "" {
+		folder, ok = loadBrowsableFolder(c, folders, access, userIDStr, folderID, log)
+		if !ok {
+			return
+		}
+		query.OwnerID = folder.OwnerID
+		query.FolderID = folder.ID
+
+		breadcrumbs, err = folders.Breadcrumbs(folder)
+		if err != nil {
+			log.Error("Failed to resolve breadcrumbs", zap.String("folderID", folderID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve files"})
+			return
+		}
+	}
+
+	// Step 5: Fetch one page of files from the database, the subfolders come with the first one
+	files, nextCursor, err := metadata.ListFiles(query)
+	if errors.Is(err, fileservices.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor, it does not match the requested sort"})
+		return
+	}
 	if err != nil {
 		log.Error("Failed to fetch files", zap.String("userID", userIDStr), zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve files"})
 		return
 	}
 
-	// Step 4: Return the list of files in the response
-	log.Info("Files retrieved successfully", zap.String("userID", userIDStr), zap.Int("fileCount", len(files)))
-	c.JSON(http.StatusOK, gin.H{"files": files})
+	subfolders := []models.Folder{}
+	if query.Cursor == "" {
+		subfolders, err = folders.ListSubfolders(query.OwnerID, folder, query.NamePrefix)
+		if err != nil {
+			log.Error("Failed to fetch folders", zap.String("userID", userIDStr), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve files"})
+			return
+		}
+	}
+
+	// Step 6: Return the page in the response
+	log.Info("Files retrieved successfully", zap.String("userID", userIDStr), zap.Int("folderCount", len(subfolders)), zap.Int("fileCount", len(files)))
+	c.JSON(http.StatusOK, gin.H{
+		"folder":      folder,
+		"breadcrumbs": breadcrumbs,
+		"folders":     subfolders,
+		"files":       files,
+		"nextCursor":  nextCursor,
+	})
 }
 
-func singleFileDeleteHandler(c *gin.Context, metadata *fileservices.MetadataService, log *zap.Logger) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		log.Error("Authorization header is missing")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
+// singleFileDeleteHandler moves a file to the trash, hiding the object behind a
+// MinIO delete marker. With ?version=N only that version is purged instead,
+// which editors of the file may also do.
+func singleFileDeleteHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, access *fileservices.AccessService, log *zap.Logger) {
+	userIDStr, ok := currentUserID(c)
+	if !ok {
 		return
 	}
 
-	// The token is usually in the format "Bearer <token>"
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	if tokenString == authHeader { // "Bearer " was not in the header
-		log.Error("Authorization header format is invalid")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header format is invalid"})
+	fileID := c.Param("fileID") // Get fileID from URL parameter
+
+	// Editors may delete versions, only the owner may trash the whole file
+	versionParam := c.Query("version")
+	minRole := models.FileRoleOwner
+	if versionParam != "" {
+		minRole = models.FileRoleEditor
+	}
+	file, ok := loadFileWithRole(c, metadata, access, userIDStr, minRole, log)
+	if !ok {
 		return
 	}
 
-	// Extract the userID from the token claims
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "UserID not found in context"})
+	if versionParam != "" {
+		number, err := strconv.Atoi(versionParam)
+		if err != nil || number < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version number"})
+			return
+		}
+
+		err = metadata.DeleteFileVersion(file.UserID, fileID, number, func(version *models.FileVersion) error {
+			return storage.RemoveFileVersion(file.Location(), version.VersionID)
+		})
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "File version not found"})
+		case errors.Is(err, fileservices.ErrLastFileVersion):
+			c.JSON(http.StatusConflict, gin.H{"error": "Cannot delete the only version of a file, delete the file instead"})
+		case err != nil:
+			log.Error("Failed to delete file version", zap.String("userID", userIDStr), zap.String("fileID", fileID), zap.Int("version", number), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file version"})
+		default:
+			c.Status(http.StatusNoContent)
+		}
 		return
 	}
 
-	userIDStr, ok := userID.(string)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "UserID is not of type string"})
+	var markerVersionID string
+	err := metadata.TrashFile(userIDStr, fileID, func() (string, error) {
+		var err error
+		markerVersionID, err = storage.DeleteFile(file.Location())
+		return markerVersionID, err
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
-
-	fileID := c.Param("fileID") // Get fileID from URL parameter
-
-	// Step 3: Fetch files for the user from the database
-	err := metadata.DeleteFileMetadata(userIDStr, fileID, "fileVersion")
 	if err != nil {
-		log.Error("Failed to fetch files", zap.String("userID", userIDStr), zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve files"})
+		// The commit failed after the delete marker was written: remove it so
+		// the object is visible again, like its metadata
+		if markerVersionID != "" {
+			storage.RemoveFileVersion(file.Location(), markerVersionID)
+		}
+		log.Error("Failed to delete file", zap.String("userID", userIDStr), zap.String("fileID", fileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
 		return
 	}
 
+	log.Info("File moved to the trash", zap.String("userID", userIDStr), zap.String("fileID", fileID))
+	c.Status(http.StatusNoContent)
 }
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Page sizes of the search results
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchQueryLen  = 256
+)
+
+// searchFilesHandler runs a full-text search over the names and content of the
+// files the caller may read. q uses the web search syntax: quoted phrases,
+// "or" and a leading "-" to exclude a word.
+func searchFilesHandler(c *gin.Context, search *fileservices.SearchService, access *fileservices.AccessService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" || len(q) > maxSearchQueryLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q must be between 1 and 256 characters"})
+		return
+	}
+
+	limit := defaultSearchLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+			return
+		}
+		limit = n
+	}
+
+	offset := 0
+	if raw := c.Query("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a positive number"})
+			return
+		}
+		offset = n
+	}
+
+	results, err := search.Search(q, limit, offset, access.ReadableFiles(userID))
+	if err != nil {
+		log.Error("Failed to search files", zap.String("userID", userID), zap.String("query", q), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search files"})
+		return
+	}
+
+	log.Info("Files searched", zap.String("userID", userID), zap.Int("resultCount", len(results)))
+	c.JSON(http.StatusOK, gin.H{
+		"query":   q,
+		"results": results,
+	})
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// shareFileHandler shares a file of the caller with a user or with every
+// member of a company. Sharing again with the same recipient changes the role.
+func shareFileHandler(c *gin.Context, metadata *fileservices.MetadataService, shares *fileservices.ShareService, access *fileservices.AccessService, users *fileservices.UserDirectory, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadOwnedFile(c, metadata, userID, log)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		RecipientType string `json:"recipientType" binding:"required"`
+		RecipientID   string `json:"recipientId" binding:"required"`
+		Role          string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if !models.ValidShareRole(request.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of viewer, commenter or editor"})
+		return
+	}
+	if _, err := uuid.Parse(request.RecipientID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipientId"})
+		return
+	}
+
+	switch request.RecipientType {
+	case models.ShareRecipientUser:
+		if request.RecipientID == userID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A file cannot be shared with its owner"})
+			return
+		}
+		exists, err := users.UserExists(c.Request.Context(), request.RecipientID)
+		if err != nil {
+			log.Error("Failed to validate share recipient", zap.String("recipientID", request.RecipientID), zap.Error(err))
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to validate the recipient"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Recipient user not found"})
+			return
+		}
+	case models.ShareRecipientCompany:
+		// Files can only be shared with the companies the owner belongs to
+		member, err := access.IsCompanyMember(userID, request.RecipientID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+			return
+		}
+		if !member {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this company"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recipientType must be user or company"})
+		return
+	}
+
+	share, err := shares.ShareFile(file.FileID, request.RecipientType, request.RecipientID, request.Role, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to share file"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, share)
+}
+
+// listFileSharesHandler returns the shares of a file of the caller
+func listFileSharesHandler(c *gin.Context, metadata *fileservices.MetadataService, shares *fileservices.ShareService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadOwnedFile(c, metadata, userID, log)
+	if !ok {
+		return
+	}
+
+	fileShares, err := shares.ListShares(file.FileID)
+	if err != nil {
+		log.Error("Failed to list file shares", zap.String("fileID", file.FileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list file shares"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shares": fileShares})
+}
+
+// revokeFileShareHandler deletes a share of a file of the caller
+func revokeFileShareHandler(c *gin.Context, metadata *fileservices.MetadataService, shares *fileservices.ShareService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadOwnedFile(c, metadata, userID, log)
+	if !ok {
+		return
+	}
+
+	shareID, err := strconv.ParseUint(c.Param("shareID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid share ID"})
+		return
+	}
+
+	err = shares.RevokeShare(file.FileID, uint(shareID))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to revoke file share", zap.String("fileID", file.FileID), zap.Uint64("shareID", shareID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// sharedWithMeHandler lists the files other users shared with the caller,
+// directly or through one of their companies, with the role they grant
+func sharedWithMeHandler(c *gin.Context, shares *fileservices.ShareService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	files, err := shares.SharedWith(userID)
+	if err != nil {
+		log.Error("Failed to list shared files", zap.String("userID", userID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve shared files"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"files": files})
+}
@@ -0,0 +1,283 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// maxLinkPasswordLength is the longest password bcrypt can hash
+const maxLinkPasswordLength = 72
+
+// createShareLinkHandler creates a public download link to a file of the
+// caller. The token is only returned by this call.
+func createShareLinkHandler(c *gin.Context, metadata *fileservices.MetadataService, links *fileservices.ShareLinkService, defaultTTL, maxTTL time.Duration, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadOwnedFile(c, metadata, userID, log)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		ExpiresAt    *time.Time `json:"expiresAt"`    // Defaults to now plus the default link lifetime
+		Password     string     `json:"password"`     // Optional
+		MaxDownloads int        `json:"maxDownloads"` // 0 for unlimited
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(defaultTTL)
+	if request.ExpiresAt != nil {
+		expiresAt = *request.ExpiresAt
+	}
+	if !expiresAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+		return
+	}
+	if expiresAt.After(now.Add(maxTTL)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt is too far in the future", "maxExpiresAt": now.Add(maxTTL)})
+		return
+	}
+	if request.MaxDownloads < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "maxDownloads must be positive, or 0 for unlimited"})
+		return
+	}
+	if len(request.Password) > maxLinkPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password is too long"})
+		return
+	}
+
+	link, token, err := links.CreateLink(file.FileID, userID, expiresAt, request.Password, request.MaxDownloads)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"link":  link,
+		"token": token,
+		"url":   fileservices.PublicPathPrefix + "links/" + token + "/download",
+	})
+}
+
+// listShareLinksHandler returns the links of a file of the caller, revoked and
+// expired ones included
+func listShareLinksHandler(c *gin.Context, metadata *fileservices.MetadataService, links *fileservices.ShareLinkService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadOwnedFile(c, metadata, userID, log)
+	if !ok {
+		return
+	}
+
+	fileLinks, err := links.ListLinks(file.FileID)
+	if err != nil {
+		log.Error("Failed to list share links", zap.String("fileID", file.FileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list share links"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"links": fileLinks})
+}
+
+// revokeShareLinkHandler disables a link of a file of the caller
+func revokeShareLinkHandler(c *gin.Context, metadata *fileservices.MetadataService, links *fileservices.ShareLinkService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadOwnedFile(c, metadata, userID, log)
+	if !ok {
+		return
+	}
+
+	linkID, err := strconv.ParseUint(c.Param("linkID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid link ID"})
+		return
+	}
+
+	err = links.RevokeLink(file.FileID, uint(linkID))
+	if errors.Is(err, fileservices.ErrShareLinkNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found or already revoked"})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to revoke share link", zap.String("fileID", file.FileID), zap.Uint64("linkID", linkID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// listShareLinkAccessesHandler returns the access log of a link of a file of the caller
+func listShareLinkAccessesHandler(c *gin.Context, metadata *fileservices.MetadataService, links *fileservices.ShareLinkService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadOwnedFile(c, metadata, userID, log)
+	if !ok {
+		return
+	}
+
+	linkID, err := strconv.ParseUint(c.Param("linkID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid link ID"})
+		return
+	}
+
+	accesses, err := links.ListAccesses(file.FileID, uint(linkID))
+	if errors.Is(err, fileservices.ErrShareLinkNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to list share link accesses", zap.String("fileID", file.FileID), zap.Uint64("linkID", linkID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list share link accesses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"accesses": accesses})
+}
+
+// resolvePublicLink loads the link of the token in the URL and checks that it
+// is still usable and that the request carries its password. Every refusal is
+// recorded in the access log of the link.
+func resolvePublicLink(c *gin.Context, links *fileservices.ShareLinkService, log *zap.Logger) (*models.ShareLink, *models.FileMetadata, bool) {
+	link, file, err := links.ResolveLink(c.Param("token"))
+	if errors.Is(err, fileservices.ErrShareLinkNotFound) {
+		log.Warn("Unknown share link", zap.String("clientIP", c.ClientIP()))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return nil, nil, false
+	}
+
+	var outcome string
+	switch {
+	case errors.Is(err, fileservices.ErrShareLinkRevoked):
+		outcome = models.LinkAccessRevoked
+	case errors.Is(err, fileservices.ErrShareLinkExpired):
+		outcome = models.LinkAccessExpired
+	case errors.Is(err, fileservices.ErrShareLinkExhausted):
+		outcome = models.LinkAccessExhausted
+	case err != nil:
+		log.Error("Failed to resolve share link", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve share link"})
+		return nil, nil, false
+	}
+	if outcome != "" {
+		links.RecordAccess(link.ID, outcome, c.ClientIP(), c.Request.UserAgent())
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+
+	if link.HasPassword {
+		// The password comes in a header, or in the form of a POST download
+		password := c.GetHeader("X-Share-Password")
+		if password == "" && c.Request.Method == http.MethodPost {
+			password = c.PostForm("password")
+		}
+		if password == "" {
+			links.RecordAccess(link.ID, models.LinkAccessPasswordRequired, c.ClientIP(), c.Request.UserAgent())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "This link requires a password", "passwordRequired": true})
+			return nil, nil, false
+		}
+		if !links.CheckPassword(link, password) {
+			log.Warn("Wrong share link password", zap.Uint("linkID", link.ID), zap.String("clientIP", c.ClientIP()))
+			links.RecordAccess(link.ID, models.LinkAccessWrongPassword, c.ClientIP(), c.Request.UserAgent())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Wrong password", "passwordRequired": true})
+			return nil, nil, false
+		}
+	}
+
+	return link, file, true
+}
+
+// publicShareLinkHandler describes the file behind a share link, so that a
+// landing page can be shown before the download
+func publicShareLinkHandler(c *gin.Context, links *fileservices.ShareLinkService, log *zap.Logger) {
+	link, file, ok := resolvePublicLink(c, links, log)
+	if !ok {
+		return
+	}
+
+	links.RecordAccess(link.ID, models.LinkAccessInspected, c.ClientIP(), c.Request.UserAgent())
+
+	response := gin.H{
+		"fileName":    file.FileName,
+		"size":        file.Size,
+		"contentType": file.ContentType,
+		"expiresAt":   link.ExpiresAt,
+		"hasPassword": link.HasPassword,
+	}
+	if link.MaxDownloads > 0 {
+		response["remainingDownloads"] = link.MaxDownloads - link.DownloadCount
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// publicShareLinkDownloadHandler serves the file behind a share link to anyone
+// holding its token. Every request sending content counts as a download, HEAD
+// requests do not. Links with a download limit ignore ranges and conditional
+// headers, so each counted download is the whole file.
+func publicShareLinkDownloadHandler(c *gin.Context, storageService *fileservices.StorageService, links *fileservices.ShareLinkService, log *zap.Logger) {
+	link, file, ok := resolvePublicLink(c, links, log)
+	if !ok {
+		return
+	}
+
+	// The download is only counted once the content can be served
+	object, info, err := storageService.GetFile(file)
+	if err != nil {
+		log.Error("Failed to get file from storage", zap.String("fileID", file.FileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download file"})
+		return
+	}
+	defer object.Close()
+
+	outcome := models.LinkAccessInspected
+	if c.Request.Method != http.MethodHead {
+		if link.MaxDownloads > 0 {
+			for _, header := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+				c.Request.Header.Del(header)
+			}
+		}
+		err = links.ConsumeDownload(link.ID)
+		if errors.Is(err, fileservices.ErrShareLinkExhausted) {
+			// Another download took the last slot, or the link just expired
+			links.RecordAccess(link.ID, models.LinkAccessExhausted, c.ClientIP(), c.Request.UserAgent())
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Error("Failed to count share link download", zap.Uint("linkID", link.ID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download file"})
+			return
+		}
+		outcome = models.LinkAccessDownloaded
+	}
+
+	links.RecordAccess(link.ID, outcome, c.ClientIP(), c.Request.UserAgent())
+	log.Info("Serving file through share link", zap.Uint("linkID", link.ID), zap.String("fileID", file.FileID), zap.String("outcome", outcome))
+	serveObject(c, object, info, file.FileName, file.ContentType, file.SHA256)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+
+	fileconfig "file-service/internal/config"
+	fileservices "file-service/internal/services"
+
+	"github.com/amine-bouhoula/safedocs-mvp/sdlib/config"
+	"github.com/amine-bouhoula/safedocs-mvp/sdlib/database"
+	"go.uber.org/zap"
+)
+
+// OpenStorageService builds the storage service from the configured driver,
+// key provider and object layout. The encryptor is nil when encryption at
+// rest is disabled. The database must be connected.
+func OpenStorageService(cfg *config.Config, fileCfg *fileconfig.FileServiceConfig, log *zap.Logger) (*fileservices.StorageService, *fileservices.FileEncryptor, error) {
+	log.Info("Initializing storage service", zap.String("driver", fileCfg.StorageDriver), zap.String("layout", fileCfg.StorageLayout))
+	var storageBackend fileservices.Storage
+	var err error
+	switch fileCfg.StorageDriver {
+	case "minio":
+		storageBackend, err = fileservices.ConnectMinio(cfg.MinIOURL, cfg.MinIOUser, cfg.MinIOPass, fileCfg.MinioBucket, fileCfg.MinioSecure, log)
+	case "local":
+		storageBackend, err = fileservices.NewLocalStorage(fileCfg.StorageLocalDir)
+	case "memory":
+		storageBackend = fileservices.NewMemoryStorage()
+	default:
+		return nil, nil, fmt.Errorf("unknown storage driver %q", fileCfg.StorageDriver)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Info("Initializing key provider", zap.String("provider", fileCfg.KeyProvider))
+	var encryptor *fileservices.FileEncryptor
+	switch fileCfg.KeyProvider {
+	case "local":
+		keyProvider, err := fileservices.NewLocalKeyProvider(fileCfg.KeyLocalDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error initializing key provider: %w", err)
+		}
+		encryptor = fileservices.NewFileEncryptor(database.DB, keyProvider, log)
+	case "none":
+		log.Warn("Encryption at rest is disabled, new files are stored in plaintext")
+	default:
+		return nil, nil, fmt.Errorf("unknown key provider %q", fileCfg.KeyProvider)
+	}
+
+	objectLayout, err := fileservices.NewObjectLayout(database.DB, fileCfg.StorageLayout, fileCfg.MinioBucket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return fileservices.NewStorageService(storageBackend, objectLayout, encryptor, log), encryptor, nil
+}
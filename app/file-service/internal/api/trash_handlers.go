@@ -0,0 +1,107 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// maxTrashRetentionDays bounds the retention a company admin can set
+const maxTrashRetentionDays = 3650
+
+// listTrashHandler returns the files the caller moved to the trash
+func listTrashHandler(c *gin.Context, metadata *fileservices.MetadataService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	files, err := metadata.ListTrash(userID)
+	if err != nil {
+		log.Error("Failed to list trashed files", zap.String("userID", userID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve trashed files"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"files": files})
+}
+
+// restoreTrashedFileHandler takes a file out of the trash by removing the
+// delete marker that hides its object
+func restoreTrashedFileHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	fileID := c.Param("fileID")
+
+	file, err := metadata.RestoreFile(userID, fileID, func(location models.ObjectLocation, markerVersionID string) error {
+		return storage.RemoveFileVersion(location, markerVersionID)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in the trash"})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to restore file", zap.String("userID", userID), zap.String("fileID", fileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore file"})
+		return
+	}
+
+	log.Info("File restored from the trash", zap.String("userID", userID), zap.String("fileID", fileID))
+	c.JSON(http.StatusOK, file)
+}
+
+// setTrashRetentionHandler lets a company admin choose how long the trashed
+// files of the company's members are kept
+func setTrashRetentionHandler(c *gin.Context, metadata *fileservices.MetadataService, access *fileservices.AccessService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		CompanyID     string `json:"companyId" binding:"required"`
+		RetentionDays int    `json:"retentionDays" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if _, err := uuid.Parse(request.CompanyID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid companyId"})
+		return
+	}
+	if request.RetentionDays < 1 || request.RetentionDays > maxTrashRetentionDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "retentionDays must be between 1 and 3650"})
+		return
+	}
+
+	isAdmin, err := access.IsCompanyAdmin(userID, request.CompanyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+		return
+	}
+	if !isAdmin {
+		log.Warn("Trash retention change denied", zap.String("userID", userID), zap.String("companyID", request.CompanyID))
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only company admins can change the trash retention"})
+		return
+	}
+
+	policy, err := metadata.SetTrashRetention(request.CompanyID, request.RetentionDays, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save trash retention"})
+		return
+	}
+
+	log.Info("Trash retention updated", zap.String("companyID", policy.CompanyID), zap.Int("retentionDays", policy.RetentionDays), zap.String("userID", userID))
+	c.JSON(http.StatusOK, policy)
+}
@@ -0,0 +1,400 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func chunkPath(tempDir string, index int) string {
+	return filepath.Join(tempDir, fmt.Sprintf("chunk_%06d", index))
+}
+
+// chunkReader streams the chunks of a session in index order, opening one chunk
+// file at a time so large uploads don't exhaust file descriptors.
+type chunkReader struct {
+	tempDir     string
+	totalChunks int
+	next        int
+	current     *os.File
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next >= r.totalChunks {
+				return 0, io.EOF
+			}
+			f, err := os.Open(chunkPath(r.tempDir, r.next))
+			if err != nil {
+				return 0, err
+			}
+			r.current = f
+			r.next++
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// lookupUploadSession loads the session named in the URL and makes sure it
+// belongs to the caller and is a direct upload, or a chunked one when direct
+// is false. Other sessions are reported as not found.
+func lookupUploadSession(c *gin.Context, uploadSessions fileservices.UploadSessionStore, userID string, direct bool, log *zap.Logger) (*fileservices.UploadSession, bool) {
+	sessionID := c.Param("sessionId")
+
+	session, err := uploadSessions.Get(c.Request.Context(), sessionID)
+	if errors.Is(err, fileservices.ErrUploadSessionNotFound) {
+		log.Warn("Upload session not found", zap.String("uploadSessionId", sessionID))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Error("Failed to load upload session", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload session"})
+		return nil, false
+	}
+
+	if session.UserID != userID {
+		log.Warn("Upload session belongs to another user",
+			zap.String("uploadSessionId", sessionID),
+			zap.String("userID", userID),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+		return nil, false
+	}
+
+	if session.Direct != direct {
+		log.Warn("Upload session is of another kind", zap.String("uploadSessionId", sessionID), zap.Bool("direct", session.Direct))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+		return nil, false
+	}
+	return session, true
+}
+
+// uploadChunkHandler stores one chunk of an upload session. Chunks may arrive in
+// any order and may be retried: a chunk is written to a temporary file and then
+// renamed over its final path, so a retry simply replaces the previous copy.
+func uploadChunkHandler(c *gin.Context, uploadSessions fileservices.UploadSessionStore, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	session, ok := lookupUploadSession(c, uploadSessions, userID, false, log)
+	if !ok {
+		return
+	}
+	sessionID := session.ID
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index < 0 || index >= session.TotalChunks {
+		log.Warn("Invalid chunk index",
+			zap.String("uploadSessionId", sessionID),
+			zap.String("index", c.Param("index")),
+			zap.Int("totalChunks", session.TotalChunks),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Chunk index must be between 0 and %d", session.TotalChunks-1)})
+		return
+	}
+
+	if session.Completing {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload session is being completed"})
+		return
+	}
+
+	expectedSize := session.ExpectedChunkSize(index)
+
+	tmpFile, err := os.CreateTemp(session.TempDir, filepath.Base(chunkPath(session.TempDir, index))+".part-")
+	if err != nil {
+		if chunkWriteRefused(c, uploadSessions, sessionID) {
+			return
+		}
+		log.Error("Failed to create chunk file", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+	defer os.Remove(tmpFile.Name()) // No-op once the chunk has been renamed
+
+	// Read one byte more than expected so oversized chunks can be detected
+	checksum := fileservices.NewChecksumReader(io.LimitReader(c.Request.Body, expectedSize+1))
+	written, err := io.Copy(tmpFile, checksum)
+	closeErr := tmpFile.Close()
+	if err != nil || closeErr != nil {
+		log.Error("Failed to write chunk", zap.String("uploadSessionId", sessionID), zap.Int("index", index), zap.Error(err), zap.NamedError("closeError", closeErr))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+
+	if written != expectedSize {
+		log.Warn("Chunk size mismatch",
+			zap.String("uploadSessionId", sessionID),
+			zap.Int("index", index),
+			zap.Int64("expected", expectedSize),
+			zap.Int64("received", written),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Chunk %d must be exactly %d bytes", index, expectedSize)})
+		return
+	}
+
+	// Clients may send the SHA-256 of each chunk to detect corruption early
+	if expected := c.GetHeader("X-Chunk-SHA256"); checksum.Verify(expected) != nil {
+		log.Warn("Chunk checksum mismatch",
+			zap.String("uploadSessionId", sessionID),
+			zap.Int("index", index),
+			zap.String("expected", expected),
+			zap.String("computed", checksum.Sum()),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Checksum mismatch for chunk %d", index)})
+		return
+	}
+
+	if err := os.Rename(tmpFile.Name(), chunkPath(session.TempDir, index)); err != nil {
+		if chunkWriteRefused(c, uploadSessions, sessionID) {
+			return
+		}
+		log.Error("Failed to commit chunk", zap.String("uploadSessionId", sessionID), zap.Int("index", index), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+
+	received, err := uploadSessions.MarkChunkUploaded(c.Request.Context(), sessionID, index)
+	if errors.Is(err, fileservices.ErrUploadSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to record chunk", zap.String("uploadSessionId", sessionID), zap.Int("index", index), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+
+	log.Info("Chunk received",
+		zap.String("uploadSessionId", sessionID),
+		zap.Int("index", index),
+		zap.Int64("size", written),
+		zap.Int("receivedChunks", received),
+		zap.Int("totalChunks", session.TotalChunks),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"uploadSessionId": sessionID,
+		"index":           index,
+		"receivedChunks":  received,
+		"totalChunks":     session.TotalChunks,
+	})
+}
+
+// chunkWriteRefused answers and returns true when a chunk could not be written
+// because the session started being completed, or was completed, meanwhile.
+// The completion moves the chunk directory away, so chunks still being
+// written at that time fail instead of changing what is being assembled.
+func chunkWriteRefused(c *gin.Context, uploadSessions fileservices.UploadSessionStore, sessionID string) bool {
+	session, err := uploadSessions.Get(c.Request.Context(), sessionID)
+	switch {
+	case errors.Is(err, fileservices.ErrUploadSessionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+		return true
+	case err == nil && session.Completing:
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload session is being completed"})
+		return true
+	}
+	return false
+}
+
+// uploadStatusHandler reports the progress of an upload session so clients can
+// resume by sending only the missing chunks
+func uploadStatusHandler(c *gin.Context, uploadSessions fileservices.UploadSessionStore, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	session, ok := lookupUploadSession(c, uploadSessions, userID, false, log)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"uploadSessionId": session.ID,
+		"fileName":        session.FileName,
+		"fileSize":        session.FileSize,
+		"chunkSize":       session.ChunkSize,
+		"totalChunks":     session.TotalChunks,
+		"receivedChunks":  len(session.UploadedChunks),
+		"missingChunks":   session.MissingChunks(),
+		"createdAt":       session.CreatedAt,
+	})
+}
+
+// completeUploadHandler assembles the chunks of a session in order, streams them
+// to the object storage and records the file metadata
+func completeUploadHandler(c *gin.Context, uploadSessions fileservices.UploadSessionStore, storage *fileservices.StorageService, metadata *fileservices.MetadataService, policy *fileservices.ContentPolicy, log *zap.Logger) {
+	startTime := time.Now()
+
+	userIDStr, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	session, ok := lookupUploadSession(c, uploadSessions, userIDStr, false, log)
+	if !ok {
+		return
+	}
+	sessionID := session.ID
+
+	if missing := session.MissingChunks(); len(missing) > 0 {
+		log.Warn("Upload session is incomplete", zap.String("uploadSessionId", sessionID), zap.Ints("missingChunks", missing))
+		c.JSON(http.StatusConflict, gin.H{
+			"error":         "Upload session is missing chunks",
+			"missingChunks": missing,
+		})
+		return
+	}
+
+	acquired, err := uploadSessions.StartCompleting(c.Request.Context(), sessionID)
+	if err != nil {
+		log.Error("Failed to lock upload session", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+	if !acquired {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload session is already being completed"})
+		return
+	}
+
+	// Chunks are assembled from a directory of their own: a chunk still being
+	// written, which passed its completing check before the lock was taken,
+	// can no longer replace one of the files being read
+	assemblyDir := session.TempDir + ".completing"
+	if err := os.Rename(session.TempDir, assemblyDir); err != nil {
+		log.Error("Failed to move chunks for assembly", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		uploadSessions.StopCompleting(c.Request.Context(), sessionID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+	// release gives the chunks back to the session after a failure, so the
+	// client can retry the completion or send chunks again
+	release := func() {
+		if err := os.Rename(assemblyDir, session.TempDir); err != nil {
+			log.Error("Failed to restore chunk directory", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		}
+		uploadSessions.StopCompleting(c.Request.Context(), sessionID)
+	}
+
+	reader := &chunkReader{tempDir: assemblyDir, totalChunks: session.TotalChunks}
+	contentType, content, err := policy.Sniff(session.FileName, reader)
+	if err != nil {
+		reader.Close()
+		release()
+		if !contentTypeRejected(c, err, log) {
+			log.Error("Failed to read assembled file", zap.String("uploadSessionId", sessionID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file to storage"})
+		}
+		return
+	}
+	checksum := fileservices.NewChecksumReader(content)
+	fileID, location, err := storage.NewFileLocation(userIDStr, session.FolderID)
+	var fileVersion string
+	var encryption models.FileEncryption
+	if err == nil {
+		fileVersion, encryption, err = storage.UploadFile(checksum, session.FileSize, location, session.FileName, contentType, userIDStr, session.FolderID)
+	}
+	reader.Close()
+	if err != nil {
+		log.Error("Failed to upload assembled file to MinIO", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		release()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file to storage"})
+		return
+	}
+
+	if err := checksum.Verify(session.SHA256); err != nil {
+		log.Warn("Checksum mismatch on assembled file",
+			zap.String("uploadSessionId", sessionID),
+			zap.String("expected", session.SHA256),
+			zap.String("computed", checksum.Sum()),
+		)
+		storage.RemoveFileVersion(location, fileVersion)
+		release()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Checksum mismatch, the file was altered in transit"})
+		return
+	}
+
+	err = metadata.SaveFileMetadata(userIDStr, fileID, session.FileName, fileVersion, session.FileSize, checksum.Sum(), contentType, encryption, location, session.FolderID)
+	if errors.Is(err, fileservices.ErrFolderNotFound) {
+		storage.RemoveFileVersion(location, fileVersion)
+		release()
+		c.JSON(http.StatusConflict, gin.H{"error": "The target folder no longer exists"})
+		return
+	}
+	if err != nil {
+		log.Error("Failed to save file metadata", zap.String("uploadSessionId", sessionID), zap.Error(err))
+		storage.RemoveFileVersion(location, fileVersion)
+		release()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+		return
+	}
+
+	// The upload is done, drop the session and its chunks
+	if err := uploadSessions.Delete(c.Request.Context(), sessionID); err != nil {
+		log.Warn("Failed to delete upload session", zap.String("uploadSessionId", sessionID), zap.Error(err))
+	}
+	if err := os.RemoveAll(assemblyDir); err != nil {
+		log.Warn("Failed to remove temporary chunk directory", zap.String("tempDir", assemblyDir), zap.Error(err))
+	}
+
+	log.Info("Chunked upload completed",
+		zap.String("uploadSessionId", sessionID),
+		zap.String("file ID", fileID),
+		zap.String("file version", fileVersion),
+		zap.Duration("duration", time.Since(startTime)),
+	)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "File uploaded successfully",
+		"fileID":      fileID,
+		"fileName":    session.FileName,
+		"fileVersion": fileVersion,
+		"size":        session.FileSize,
+		"sha256":      checksum.Sum(),
+		"contentType": contentType,
+	})
+}
+
+// contentTypeRejected answers 415 and returns true when err is a refusal of
+// the content policy
+func contentTypeRejected(c *gin.Context, err error, log *zap.Logger) bool {
+	if !errors.Is(err, fileservices.ErrContentTypeDenied) && !errors.Is(err, fileservices.ErrContentTypeMismatch) {
+		return false
+	}
+	log.Warn("Upload rejected by the content policy", zap.Error(err))
+	c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	return true
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// newChunkRouter serves the chunk endpoints of the sessions in store to userID
+func newChunkRouter(store fileservices.UploadSessionStore, userID string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("userID", userID)
+	})
+	router.PUT("/api/v1/files/upload/:sessionId/chunks/:index", func(c *gin.Context) {
+		uploadChunkHandler(c, store, zap.NewNop())
+	})
+	return router
+}
+
+func putChunk(router http.Handler, sessionID string, index string, body []byte, digest string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/v1/files/upload/%s/chunks/%s", sessionID, index), bytes.NewReader(body))
+	if digest != "" {
+		req.Header.Set("X-Chunk-SHA256", digest)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadChunks(t *testing.T) {
+	ctx := context.Background()
+	store := fileservices.NewMemoryUploadSessionStore(time.Hour)
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD") // 40 bytes, chunks of 16, 16 and 8
+	store.Create(ctx, &fileservices.UploadSession{
+		ID:          "session",
+		UserID:      "owner",
+		FileSize:    int64(len(content)),
+		ChunkSize:   16,
+		TotalChunks: 3,
+		TempDir:     t.TempDir(),
+	})
+	router := newChunkRouter(store, "owner")
+	chunk := func(index int) []byte {
+		return content[index*16 : min((index+1)*16, len(content))]
+	}
+
+	tests := []struct {
+		name     string
+		index    string
+		body     []byte
+		digest   string
+		want     int
+		received int
+	}{
+		{name: "last chunk first", index: "2", body: chunk(2), want: http.StatusOK, received: 1},
+		{name: "with its checksum", index: "0", body: chunk(0), digest: sha256Hex(chunk(0)), want: http.StatusOK, received: 2},
+		{name: "retried chunk", index: "0", body: chunk(0), want: http.StatusOK, received: 2},
+		{name: "checksum mismatch", index: "1", body: chunk(1), digest: sha256Hex(chunk(0)), want: http.StatusBadRequest, received: 2},
+		{name: "short chunk", index: "1", body: chunk(1)[:15], want: http.StatusBadRequest, received: 2},
+		{name: "oversized chunk", index: "1", body: append(bytes.Clone(chunk(1)), 'x'), want: http.StatusBadRequest, received: 2},
+		{name: "oversized last chunk", index: "2", body: chunk(1), want: http.StatusBadRequest, received: 2},
+		{name: "index out of range", index: "3", body: chunk(2), want: http.StatusBadRequest, received: 2},
+		{name: "negative index", index: "-1", body: chunk(0), want: http.StatusBadRequest, received: 2},
+		{name: "unknown session", index: "1", body: chunk(1), want: http.StatusNotFound, received: 2},
+		{name: "missing chunk", index: "1", body: chunk(1), digest: sha256Hex(chunk(1)), want: http.StatusOK, received: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessionID := "session"
+			if tt.name == "unknown session" {
+				sessionID = "unknown"
+			}
+			if rec := putChunk(router, sessionID, tt.index, tt.body, tt.digest); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			session, _ := store.Get(ctx, "session")
+			if len(session.UploadedChunks) != tt.received {
+				t.Errorf("%d chunks received, want %d", len(session.UploadedChunks), tt.received)
+			}
+		})
+	}
+
+	// Rejected chunks leave no partial file behind
+	session, _ := store.Get(ctx, "session")
+	entries, err := os.ReadDir(session.TempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != session.TotalChunks {
+		t.Errorf("chunk directory holds %d files, want %d", len(entries), session.TotalChunks)
+	}
+
+	// The chunks are assembled in index order whatever their arrival order
+	reader := &chunkReader{tempDir: session.TempDir, totalChunks: session.TotalChunks}
+	defer reader.Close()
+	assembled, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembled, content) {
+		t.Errorf("assembled %q, want %q", assembled, content)
+	}
+}
+
+func TestUploadChunkOwnership(t *testing.T) {
+	ctx := context.Background()
+	store := fileservices.NewMemoryUploadSessionStore(time.Hour)
+	store.Create(ctx, &fileservices.UploadSession{ID: "session", UserID: "owner", FileSize: 4, ChunkSize: 4, TotalChunks: 1, TempDir: t.TempDir()})
+	store.Create(ctx, &fileservices.UploadSession{ID: "direct", UserID: "owner", FileSize: 4, ChunkSize: 4, TotalChunks: 1, Direct: true})
+
+	if rec := putChunk(newChunkRouter(store, "intruder"), "session", "0", []byte("data"), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("chunk of another user: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := putChunk(newChunkRouter(store, "owner"), "direct", "0", []byte("data"), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("chunk of a direct upload: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	store.StartCompleting(ctx, "session")
+	if rec := putChunk(newChunkRouter(store, "owner"), "session", "0", []byte("data"), ""); rec.Code != http.StatusConflict {
+		t.Errorf("chunk while completing: status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if session, _ := store.Get(ctx, "session"); len(session.UploadedChunks) != 0 {
+		t.Errorf("chunks %v recorded", session.UploadedChunks)
+	}
+}
+
+// staleSessionStore hands out the state of the session before its completion
+// started on the first Get, as seen by a chunk racing with the completion
+type staleSessionStore struct {
+	*fileservices.MemoryUploadSessionStore
+	reads int
+}
+
+func (s *staleSessionStore) Get(ctx context.Context, sessionID string) (*fileservices.UploadSession, error) {
+	session, err := s.MemoryUploadSessionStore.Get(ctx, sessionID)
+	if s.reads++; s.reads == 1 && err == nil {
+		session.Completing = false
+	}
+	return session, err
+}
+
+func TestUploadChunkRacingCompletion(t *testing.T) {
+	ctx := context.Background()
+	store := &staleSessionStore{MemoryUploadSessionStore: fileservices.NewMemoryUploadSessionStore(time.Hour)}
+	tempDir := filepath.Join(t.TempDir(), "upload-session-1")
+	if err := os.Mkdir(tempDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	store.Create(ctx, &fileservices.UploadSession{ID: "session", UserID: "owner", FileSize: 4, ChunkSize: 4, TotalChunks: 1, TempDir: tempDir})
+	if err := os.WriteFile(chunkPath(tempDir, 0), []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The completion holds the lock and assembles the chunks from elsewhere
+	store.StartCompleting(ctx, "session")
+	if err := os.Rename(tempDir, tempDir+".completing"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := putChunk(newChunkRouter(store, "owner"), "session", "0", []byte("late"), ""); rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+	if assembled, _ := os.ReadFile(chunkPath(tempDir+".completing", 0)); string(assembled) != "data" {
+		t.Errorf("chunk being assembled holds %q, want %q", assembled, "data")
+	}
+	if _, err := os.Stat(tempDir); !os.IsNotExist(err) {
+		t.Errorf("late chunk recreated the chunk directory: %v", err)
+	}
+}
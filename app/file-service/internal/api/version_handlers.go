@@ -0,0 +1,221 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"file-service/internal/models"
+	fileservices "file-service/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var errMultipleFiles = errors.New("more than one file in the request")
+
+// loadFileVersion resolves the version number named in the URL
+func loadFileVersion(c *gin.Context, metadata *fileservices.MetadataService, fileID string, log *zap.Logger) (*models.FileVersion, bool) {
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version number"})
+		return nil, false
+	}
+
+	version, err := metadata.GetFileVersion(fileID, number)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Error("Failed to load file version", zap.String("fileID", fileID), zap.Int("version", number), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file version"})
+		return nil, false
+	}
+	return version, true
+}
+
+// uploadFileVersionHandler stores the single file of a multipart request as a
+// new version of an existing file. Editors may upload versions.
+func uploadFileVersionHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, access *fileservices.AccessService, policy *fileservices.ContentPolicy, maxFileSize int64, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadFileWithRole(c, metadata, access, userID, models.FileRoleEditor, log)
+	if !ok {
+		return
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
+		return
+	}
+
+	var folderID string
+	if file.FolderID != nil {
+		folderID = *file.FolderID
+	}
+
+	var fileVersion, contentType string
+	var checksum *fileservices.ChecksumReader
+	var encryption models.FileEncryption
+	values, err := fileservices.StreamMultipartForm(reader, maxFileSize, nil, func(fileName string, content io.Reader) error {
+		if checksum != nil {
+			return errMultipleFiles
+		}
+		// The new content must still match the name of the file
+		detected, content, err := policy.Sniff(file.FileName, content)
+		if err != nil {
+			return err
+		}
+		contentType = detected
+		checksum = fileservices.NewChecksumReader(content)
+		// Versions are encrypted for the owner and folder, whoever uploads them
+		fileVersion, encryption, err = storage.UploadFile(checksum, -1, file.Location(), file.FileName, contentType, file.UserID, folderID)
+		return err
+	})
+
+	// discardVersion drops the uploaded version when the request is rejected
+	discardVersion := func() {
+		if fileVersion != "" {
+			storage.RemoveFileVersion(file.Location(), fileVersion)
+		}
+	}
+
+	switch {
+	case errors.Is(err, fileservices.ErrFileTooLarge):
+		discardVersion()
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File is too large. Max allowed size is %d bytes", maxFileSize)})
+		return
+	case errors.Is(err, errMultipleFiles):
+		discardVersion()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A new version must be uploaded as a single file"})
+		return
+	case err != nil:
+		discardVersion()
+		if contentTypeRejected(c, err, log) {
+			return
+		}
+		log.Error("Failed to upload file version to MinIO", zap.String("fileID", file.FileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file to storage"})
+		return
+	case checksum == nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files uploaded"})
+		return
+	}
+
+	if err := checksum.Verify(values["sha256"]); err != nil {
+		discardVersion()
+		log.Warn("Checksum mismatch", zap.String("fileID", file.FileID), zap.String("expected", values["sha256"]), zap.String("computed", checksum.Sum()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Checksum mismatch, the file was altered in transit"})
+		return
+	}
+
+	version, err := metadata.AddFileVersion(file.FileID, userID, fileVersion, checksum.Size(), checksum.Sum(), contentType, encryption)
+	if err != nil {
+		discardVersion()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, version)
+}
+
+// listFileVersionsHandler returns the version history of a file, newest first
+func listFileVersionsHandler(c *gin.Context, metadata *fileservices.MetadataService, access *fileservices.AccessService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadFileWithRole(c, metadata, access, userID, models.FileRoleViewer, log)
+	if !ok {
+		return
+	}
+
+	versions, err := metadata.GetFileVersions(file.FileID)
+	if err != nil {
+		log.Error("Failed to list file versions", zap.String("fileID", file.FileID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list file versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"fileID":         file.FileID,
+		"currentVersion": file.Version,
+		"versions":       versions,
+	})
+}
+
+// downloadFileVersionHandler streams one specific version of a file
+func downloadFileVersionHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, access *fileservices.AccessService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadFileWithRole(c, metadata, access, userID, models.FileRoleViewer, log)
+	if !ok {
+		return
+	}
+
+	version, ok := loadFileVersion(c, metadata, file.FileID, log)
+	if !ok {
+		return
+	}
+
+	object, info, err := storage.GetFileVersion(file.Location(), version.VersionID, version.FileEncryption)
+	if err != nil {
+		log.Error("Failed to get file version", zap.String("fileID", file.FileID), zap.Int("version", version.Version), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download file"})
+		return
+	}
+	defer object.Close()
+
+	serveObject(c, object, info, file.FileName, version.ContentType, version.SHA256)
+}
+
+// restoreFileVersionHandler makes an older version the current one. The old
+// content is copied as a new version, so the history is never rewritten.
+func restoreFileVersionHandler(c *gin.Context, storage *fileservices.StorageService, metadata *fileservices.MetadataService, access *fileservices.AccessService, log *zap.Logger) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, ok := loadFileWithRole(c, metadata, access, userID, models.FileRoleEditor, log)
+	if !ok {
+		return
+	}
+
+	version, ok := loadFileVersion(c, metadata, file.FileID, log)
+	if !ok {
+		return
+	}
+
+	restoredVersionID, err := storage.RestoreFileVersion(file.Location(), version.VersionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore file version"})
+		return
+	}
+
+	restored, err := metadata.AddFileVersion(file.FileID, userID, restoredVersionID, version.Size, version.SHA256, version.ContentType, version.FileEncryption)
+	if err != nil {
+		storage.RemoveFileVersion(file.Location(), restoredVersionID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+		return
+	}
+
+	log.Info("File version restored",
+		zap.String("fileID", file.FileID),
+		zap.Int("restoredVersion", version.Version),
+		zap.Int("newVersion", restored.Version),
+	)
+	c.JSON(http.StatusOK, restored)
+}
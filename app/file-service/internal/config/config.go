@@ -0,0 +1,144 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// FileServiceConfig holds the settings specific to file-service. They are read
+// from the same .env file and environment as the shared sdlib configuration.
+type FileServiceConfig struct {
+	UploadSessionStore  string        // "redis" or "memory"
+	UploadSessionTTL    time.Duration // Lifetime of an idle upload session
+	UploadTempDir       string        // Directory holding chunks, must be shared between replicas
+	UploadMaxAge        time.Duration // Uploads older than this are reclaimed by the janitor
+	UploadMaxFileSize   int64         // Largest file, in bytes, of a multipart upload
+	UploadMaxRequest    int64         // Largest multipart upload request, in bytes, all files included
+	JanitorInterval     time.Duration // Delay between two janitor sweeps
+	TrashRetention      time.Duration // How long trashed files are kept when their company has no policy
+	TrashPurgeInterval  time.Duration // Delay between two purges of expired trashed files
+	SearchIndexInterval time.Duration // Delay between two runs of the search indexer
+	SearchMaxFileSize   int64         // Files bigger than this, in bytes, are not indexed
+	ReconcileInterval   time.Duration // Delay between two storage reconciliations, 0 to only reconcile with cmd/reconcile
+	ReconcileMinAge     time.Duration // Younger objects are not reconciled, their upload may still be completing
+	ReconcileRepair     bool          // Quarantine orphan objects and flag broken files instead of only reporting them
+	UserServiceURL      string        // Base URL of user-service, used to validate share recipients
+	ShareLinkDefaultTTL time.Duration // Lifetime of a share link created without an expiry
+	ShareLinkMaxTTL     time.Duration // Share links cannot live longer than this
+	FileRequestTTL      time.Duration // Lifetime of a file request created without an expiry
+	FileRequestMaxTTL   time.Duration // File requests cannot stay open longer than this
+	FileRequestMaxSize  int64         // Largest file, in bytes, accepted through a file request
+	FileRequestMaxBody  int64         // Largest upload request, in bytes, all files included, to a file request
+	ArchiveMaxSize      int64         // Largest total content, in bytes, of a ZIP download
+	ImportMaxSize       int64         // Largest ZIP, in bytes, accepted for expansion
+	ImportMaxEntries    int           // Most entries of an expanded ZIP
+	ImportMaxExpanded   int64         // Largest uncompressed size, in bytes, of an expanded ZIP
+	ImportMaxRatio      int64         // Largest compression ratio of an entry, beyond it the ZIP is a bomb
+	StorageDriver       string        // "minio", "local" or "memory"
+	MinioBucket         string        // Bucket holding the files with the minio driver
+	MinioSecure         bool          // Reach MinIO over HTTPS
+	StorageLocalDir     string        // Directory holding the files with the local driver
+	StorageLayout       string        // Placement of new objects: "flat", "prefix" per company or "bucket" per company
+	AllowedTypes        []string      // MIME types, or families such as "image/*", uploads may have; empty for all
+	DeniedTypes         []string      // MIME types, or families, uploads may never have
+	DirectURLTTL        time.Duration // Lifetime of the presigned URLs of direct uploads and downloads
+	DirectMaxFileSize   int64         // Largest file, in bytes, of a direct upload
+	DirectPartSize      int64         // Size, in bytes, of the parts of a direct upload; smaller files are sent in one part
+	KeyProvider         string        // Holder of the KEKs encrypting documents at rest: "local", or "none" to store plaintext
+	KeyLocalDir         string        // Directory holding the KEKs with the local key provider
+}
+
+// LoadFileServiceConfig reads the file-service settings. It must be called after
+// the sdlib config.LoadConfig so that viper already knows about the .env file.
+func LoadFileServiceConfig() *FileServiceConfig {
+	viper.SetDefault("UPLOAD_SESSION_STORE", "redis")
+	viper.SetDefault("UPLOAD_SESSION_TTL", "24h")
+	viper.SetDefault("UPLOAD_TEMP_DIR", os.TempDir())
+	viper.SetDefault("UPLOAD_MAX_AGE", "48h")
+	viper.SetDefault("UPLOAD_MAX_FILE_SIZE_MB", 100)
+	viper.SetDefault("UPLOAD_MAX_REQUEST_SIZE_MB", 1024)
+	viper.SetDefault("UPLOAD_JANITOR_INTERVAL", "15m")
+	viper.SetDefault("TRASH_RETENTION", "720h")
+	viper.SetDefault("TRASH_PURGE_INTERVAL", "1h")
+	viper.SetDefault("SEARCH_INDEX_INTERVAL", "30s")
+	viper.SetDefault("SEARCH_MAX_FILE_SIZE_MB", 50)
+	viper.SetDefault("RECONCILE_INTERVAL", "24h")
+	viper.SetDefault("RECONCILE_MIN_AGE", "72h")
+	viper.SetDefault("RECONCILE_REPAIR", false)
+	viper.SetDefault("USER_SERVICE_URL", "http://user-service:8003")
+	viper.SetDefault("SHARE_LINK_DEFAULT_TTL", "168h")
+	viper.SetDefault("SHARE_LINK_MAX_TTL", "2160h")
+	viper.SetDefault("FILE_REQUEST_DEFAULT_TTL", "168h")
+	viper.SetDefault("FILE_REQUEST_MAX_TTL", "2160h")
+	viper.SetDefault("FILE_REQUEST_MAX_FILE_SIZE_MB", 100)
+	viper.SetDefault("FILE_REQUEST_MAX_REQUEST_SIZE_MB", 500)
+	viper.SetDefault("ARCHIVE_MAX_SIZE_MB", 2048)
+	viper.SetDefault("ARCHIVE_IMPORT_MAX_SIZE_MB", 1024)
+	viper.SetDefault("ARCHIVE_IMPORT_MAX_ENTRIES", 10000)
+	viper.SetDefault("ARCHIVE_IMPORT_MAX_EXPANDED_MB", 10240)
+	viper.SetDefault("ARCHIVE_IMPORT_MAX_RATIO", 100)
+	viper.SetDefault("STORAGE_DRIVER", "minio")
+	viper.SetDefault("MINIO_BUCKET", "files")
+	viper.SetDefault("MINIO_SECURE", false)
+	viper.SetDefault("STORAGE_LOCAL_DIR", "/var/lib/safedocs/files")
+	viper.SetDefault("STORAGE_LAYOUT", "flat")
+	viper.SetDefault("UPLOAD_ALLOWED_TYPES", "")
+	viper.SetDefault("UPLOAD_DENIED_TYPES", "application/vnd.microsoft.portable-executable,application/x-elf,application/x-executable,application/x-sharedlib,application/x-mach-binary,application/x-msdownload,application/x-ms-installer")
+	viper.SetDefault("DIRECT_URL_TTL", "15m")
+	viper.SetDefault("DIRECT_UPLOAD_MAX_FILE_SIZE_MB", 5120)
+	viper.SetDefault("DIRECT_UPLOAD_PART_SIZE_MB", 64)
+	viper.SetDefault("ENCRYPTION_KEY_PROVIDER", "none")
+	viper.SetDefault("ENCRYPTION_LOCAL_KEY_DIR", "/var/lib/safedocs/keys")
+
+	return &FileServiceConfig{
+		UploadSessionStore:  viper.GetString("UPLOAD_SESSION_STORE"),
+		UploadSessionTTL:    viper.GetDuration("UPLOAD_SESSION_TTL"),
+		UploadTempDir:       viper.GetString("UPLOAD_TEMP_DIR"),
+		UploadMaxAge:        viper.GetDuration("UPLOAD_MAX_AGE"),
+		UploadMaxFileSize:   viper.GetInt64("UPLOAD_MAX_FILE_SIZE_MB") * 1024 * 1024,
+		UploadMaxRequest:    viper.GetInt64("UPLOAD_MAX_REQUEST_SIZE_MB") * 1024 * 1024,
+		JanitorInterval:     viper.GetDuration("UPLOAD_JANITOR_INTERVAL"),
+		TrashRetention:      viper.GetDuration("TRASH_RETENTION"),
+		TrashPurgeInterval:  viper.GetDuration("TRASH_PURGE_INTERVAL"),
+		SearchIndexInterval: viper.GetDuration("SEARCH_INDEX_INTERVAL"),
+		SearchMaxFileSize:   viper.GetInt64("SEARCH_MAX_FILE_SIZE_MB") * 1024 * 1024,
+		ReconcileInterval:   viper.GetDuration("RECONCILE_INTERVAL"),
+		ReconcileMinAge:     viper.GetDuration("RECONCILE_MIN_AGE"),
+		ReconcileRepair:     viper.GetBool("RECONCILE_REPAIR"),
+		UserServiceURL:      viper.GetString("USER_SERVICE_URL"),
+		ShareLinkDefaultTTL: viper.GetDuration("SHARE_LINK_DEFAULT_TTL"),
+		ShareLinkMaxTTL:     viper.GetDuration("SHARE_LINK_MAX_TTL"),
+		FileRequestTTL:      viper.GetDuration("FILE_REQUEST_DEFAULT_TTL"),
+		FileRequestMaxTTL:   viper.GetDuration("FILE_REQUEST_MAX_TTL"),
+		FileRequestMaxSize:  viper.GetInt64("FILE_REQUEST_MAX_FILE_SIZE_MB") * 1024 * 1024,
+		FileRequestMaxBody:  viper.GetInt64("FILE_REQUEST_MAX_REQUEST_SIZE_MB") * 1024 * 1024,
+		ArchiveMaxSize:      viper.GetInt64("ARCHIVE_MAX_SIZE_MB") * 1024 * 1024,
+		ImportMaxSize:       viper.GetInt64("ARCHIVE_IMPORT_MAX_SIZE_MB") * 1024 * 1024,
+		ImportMaxEntries:    viper.GetInt("ARCHIVE_IMPORT_MAX_ENTRIES"),
+		ImportMaxExpanded:   viper.GetInt64("ARCHIVE_IMPORT_MAX_EXPANDED_MB") * 1024 * 1024,
+		ImportMaxRatio:      viper.GetInt64("ARCHIVE_IMPORT_MAX_RATIO"),
+		StorageDriver:       viper.GetString("STORAGE_DRIVER"),
+		MinioBucket:         viper.GetString("MINIO_BUCKET"),
+		MinioSecure:         viper.GetBool("MINIO_SECURE"),
+		StorageLocalDir:     viper.GetString("STORAGE_LOCAL_DIR"),
+		StorageLayout:       viper.GetString("STORAGE_LAYOUT"),
+		AllowedTypes:        splitList(viper.GetString("UPLOAD_ALLOWED_TYPES")),
+		DeniedTypes:         splitList(viper.GetString("UPLOAD_DENIED_TYPES")),
+		DirectURLTTL:        viper.GetDuration("DIRECT_URL_TTL"),
+		DirectMaxFileSize:   viper.GetInt64("DIRECT_UPLOAD_MAX_FILE_SIZE_MB") * 1024 * 1024,
+		DirectPartSize:      viper.GetInt64("DIRECT_UPLOAD_PART_SIZE_MB") * 1024 * 1024,
+		KeyProvider:         viper.GetString("ENCRYPTION_KEY_PROVIDER"),
+		KeyLocalDir:         viper.GetString("ENCRYPTION_LOCAL_KEY_DIR"),
+	}
+}
+
+// splitList splits a comma separated setting, viper would split it on spaces
+func splitList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CompanyUser is the company membership owned by company-service. file-service
+// only reads it to resolve company-wide permissions and never migrates it.
+type CompanyUser struct {
+	ID        uint   `gorm:"primaryKey;autoIncrement"`
+	CompanyID string `gorm:"type:uuid;not null;index"`
+	UserID    string `gorm:"type:uuid;not null;index"`
+	Role      string `gorm:"type:varchar(50);default:'user'"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// Company roles, as assigned by company-service
+const (
+	CompanyRoleAdmin = "admin"
+	CompanyRoleUser  = "user"
+)
@@ -0,0 +1,17 @@
+package models
+
+// FileEncryption is the envelope of an encrypted stored version. Its content
+// is encrypted with a data key of its own, kept wrapped by a key-encryption
+// key (KEK) of the company owning the file. Every field is empty for versions
+// stored in plaintext.
+type FileEncryption struct {
+	WrappedKey []byte `json:"-"`              // Data key encrypted with the KEK
+	KeyCompany string `json:"-" gorm:"index"` // Company of the KEK, empty for users outside any company
+	KeyID      string `json:"-"`              // KEK that wrapped the data key
+	Nonce      []byte `json:"-"`              // Nonce of the first segment of the content
+}
+
+// Encrypted reports whether the version is stored encrypted
+func (e FileEncryption) Encrypted() bool {
+	return len(e.WrappedKey) > 0
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// FileRequest lets anyone holding its token upload files into a folder of its
+// owner, without being able to list or download anything. Only the SHA-256 of
+// the token is stored, the token itself is shown once.
+type FileRequest struct {
+	ID        uint       `gorm:"primaryKey;autoIncrement"`
+	TokenHash string     `gorm:"type:char(64);not null;uniqueIndex" json:"-"`
+	OwnerID   string     `gorm:"not null;index"`           // Uploaded files are attributed to this user
+	FolderID  string     `gorm:"type:uuid;not null;index"` // Folder receiving the uploads
+	Title     string     `gorm:"not null"`                 // Shown to the uploaders
+	Message   string     // Optional instructions for the uploaders
+	ExpiresAt time.Time  `gorm:"not null"`           // Uploads are refused after this date
+	MaxFiles  int        `gorm:"not null;default:0"` // 0 for unlimited
+	FileCount int        `gorm:"not null;default:0"` // Files received so far
+	RevokedAt *time.Time // Set when the owner closed the request
+	CreatedAt time.Time  `gorm:"autoCreateTime"`
+}
+
+// FileRequestUpload tags a file received through a file request with the
+// name and email the anonymous uploader supplied
+type FileRequestUpload struct {
+	ID            uint   `gorm:"primaryKey;autoIncrement"`
+	RequestID     uint   `gorm:"not null;index"`
+	FileID        string `gorm:"not null;uniqueIndex"`
+	UploaderName  string `gorm:"not null"`
+	UploaderEmail string `gorm:"not null"`
+	ClientIP      string
+	UploadedAt    time.Time `gorm:"autoCreateTime"`
+}
@@ -2,19 +2,71 @@ package models
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type FileMetadata struct {
-	FileID        string `gorm:"primaryKey"` // Unique identifier for the file
-	UserID        string `gorm:"not null"`   // User ID
-	ParentFileID  string
-	FileName      string `gorm:"not null"`  // File name
-	Size          int64  `gorm:"not null"`  // File size in bytes
-	ContentType   string `gorm:"not null"`  // MIME type of the file
-	Version       int    `gorm:"default:1"` // Human-readable version number
-	VersionID     string
-	CreatedAt     time.Time `gorm:"autoCreateTime"` // Automatically set when a record is created
-	CreatedBy     string    `gorm:"not null"`       // User who created the file
-	SharedWith    []string  `gorm:"-"`              // List of users the file is shared with (not stored in DB)
-	SharedWithRaw string    `gorm:"type:text"`      // JSON-encoded version of SharedWith (stored in DB)
+	FileID       string `gorm:"primaryKey"` // Unique identifier for the file
+	UserID       string `gorm:"not null"`   // User ID
+	ParentFileID string
+	FileName     string `gorm:"not null"`  // File name
+	Size         int64  `gorm:"not null"`  // File size in bytes
+	ContentType  string `gorm:"not null"`  // MIME type of the file
+	Version      int    `gorm:"default:1"` // Human-readable version number
+	VersionID    string
+	SHA256       string    // Hex encoded SHA-256 of the content, computed while uploading
+	CreatedAt    time.Time `gorm:"autoCreateTime"` // Automatically set when a record is created
+	CreatedBy    string    `gorm:"not null"`       // User who created the file
+
+	FolderID *string `gorm:"type:uuid;index"` // Folder holding the file, nil at the root
+
+	DeletedAt             gorm.DeletedAt `gorm:"index"` // Set while the file sits in the trash
+	DeletedBy             string         // User who moved the file to the trash
+	DeleteMarkerVersionID string         // MinIO delete marker hiding the object while trashed
+
+	StorageMissingAt *time.Time // Set by the reconciler while versions of the file are missing from the storage
+
+	FileEncryption // Envelope of the current version
+	ObjectLocation // Where the versions are stored, shared by all of them
+}
+
+// FileVersion records one stored version of a file. All the versions of a file
+// share the object of their FileMetadata and are told apart by the MinIO
+// VersionID.
+type FileVersion struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement"`
+	FileID    string    `gorm:"not null;uniqueIndex:idx_file_version"` // FileMetadata the version belongs to
+	Version   int       `gorm:"not null;uniqueIndex:idx_file_version"` // Human-readable version number
+	VersionID string    `gorm:"not null"`                              // MinIO version ID
+	Size      int64     `gorm:"not null"`                              // Size of this version in bytes
+	SHA256    string    // Hex encoded SHA-256 of this version
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	CreatedBy string    `gorm:"not null"` // User who uploaded or restored this version
+
+	ContentType string // MIME type sniffed from the content, empty for versions uploaded before sniffing
+
+	FileEncryption // Envelope of this version
+}
+
+// fileListIndexes back the paginated file listing: one index per sort key,
+// leading with the folder being listed and ending with the file_id tie-breaker
+// of the cursor. Trashed files are never listed and are left out.
+var fileListIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS idx_file_list_name ON file_metadata (user_id, folder_id, file_name, file_id) WHERE deleted_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_file_list_size ON file_metadata (user_id, folder_id, size, file_id) WHERE deleted_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_file_list_created ON file_metadata (user_id, folder_id, created_at, file_id) WHERE deleted_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_file_list_version ON file_metadata (user_id, folder_id, version, file_id) WHERE deleted_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_file_list_content_type ON file_metadata (user_id, folder_id, content_type) WHERE deleted_at IS NULL`,
+}
+
+// MigrateFileListIndexes creates the composite indexes GORM tags cannot
+// express. It must run after AutoMigrate created the file_metadata table.
+func MigrateFileListIndexes(db *gorm.DB) error {
+	for _, statement := range fileListIndexes {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
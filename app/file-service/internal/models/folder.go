@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// Folder groups files into a tree. Path is the materialized list of the IDs
+// from the root down to the folder itself, e.g. "/<rootID>/<parentID>/<ID>/",
+// so a whole subtree is selected with a single prefix match.
+type Folder struct {
+	ID        string    `gorm:"type:uuid;primaryKey"`
+	Name      string    `gorm:"not null"`
+	ParentID  *string   `gorm:"type:uuid;index"` // Nil for top-level folders
+	Path      string    `gorm:"not null;index:idx_folders_path,expression:path text_pattern_ops"`
+	OwnerID   string    `gorm:"type:uuid;not null;index"`
+	CompanyID *string   `gorm:"type:uuid;index"` // Company the folder belongs to, if any
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+// Breadcrumb is one step of the path leading to a folder
+type Breadcrumb struct {
+	ID   string
+	Name string
+}
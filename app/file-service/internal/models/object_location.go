@@ -0,0 +1,18 @@
+package models
+
+// ObjectLocation tells where the versions of a file are stored. Files stored
+// before objects were placed per company have an empty location: their object
+// is named after their fileID in the default bucket.
+type ObjectLocation struct {
+	StorageBucket string `json:"-"` // Bucket of the object, empty for the default bucket
+	ObjectKey     string `json:"-"` // Key of the object, empty for the fileID
+}
+
+// Location returns where the versions of the file are stored
+func (f *FileMetadata) Location() ObjectLocation {
+	location := f.ObjectLocation
+	if location.ObjectKey == "" {
+		location.ObjectKey = f.FileID
+	}
+	return location
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Indexing states of a FileSearchDocument
+const (
+	SearchStatusIndexed     = "indexed"
+	SearchStatusUnsupported = "unsupported" // No text can be extracted from this format
+	SearchStatusTooLarge    = "too_large"   // Bigger than the configured extraction limit
+	SearchStatusFailed      = "failed"      // Extraction failed, retried with the next version
+)
+
+// FileSearchDocument holds the text extracted from the current version of a
+// file and its full-text search vector. There is at most one per file.
+type FileSearchDocument struct {
+	FileID    string    `gorm:"primaryKey"`
+	VersionID string    // Version the text was extracted from
+	Status    string    `gorm:"type:varchar(20);not null"`
+	Content   string    `gorm:"type:text"`                                                               // Extracted text, used for highlighting
+	Document  string    `gorm:"type:tsvector;index:idx_file_search_document,type:gin;->:false;<-:false"` // Weighted file name and content, maintained with SQL
+	IndexedAt time.Time `gorm:"autoUpdateTime"`
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Recipients of a file share
+const (
+	ShareRecipientUser    = "user"
+	ShareRecipientCompany = "company"
+)
+
+// Access levels on a file, from the lowest to the highest. Shares grant one of
+// viewer, commenter or editor; owner is only held by the owner of the file.
+const (
+	FileRoleViewer    = "viewer"
+	FileRoleCommenter = "commenter"
+	FileRoleEditor    = "editor"
+	FileRoleOwner     = "owner"
+)
+
+// fileRoleRanks orders the access levels, unknown roles rank below viewer
+var fileRoleRanks = map[string]int{
+	FileRoleViewer:    1,
+	FileRoleCommenter: 2,
+	FileRoleEditor:    3,
+	FileRoleOwner:     4,
+}
+
+// FileRoleRank returns the rank of role, 0 when it grants nothing
+func FileRoleRank(role string) int {
+	return fileRoleRanks[role]
+}
+
+// ValidShareRole reports whether role can be granted by a share
+func ValidShareRole(role string) bool {
+	return role == FileRoleViewer || role == FileRoleCommenter || role == FileRoleEditor
+}
+
+// FileShare grants a user, or every member of a company, a role on a file
+type FileShare struct {
+	ID            uint      `gorm:"primaryKey;autoIncrement"`
+	FileID        string    `gorm:"not null;uniqueIndex:idx_file_share_recipient"`
+	RecipientType string    `gorm:"type:varchar(20);not null;uniqueIndex:idx_file_share_recipient;index:idx_share_recipient"`
+	RecipientID   string    `gorm:"type:uuid;not null;uniqueIndex:idx_file_share_recipient;index:idx_share_recipient"`
+	Role          string    `gorm:"type:varchar(20);not null"`
+	CreatedAt     time.Time `gorm:"autoCreateTime"`
+	CreatedBy     string    `gorm:"not null"` // Owner who shared the file
+}
+
+// DropLegacySharedWith removes the shared_with_raw column of file_metadata. It
+// was never filled, FileShare rows record who a file is shared with.
+func DropLegacySharedWith(db *gorm.DB) error {
+	return db.Exec(`ALTER TABLE file_metadata DROP COLUMN IF EXISTS shared_with_raw`).Error
+}
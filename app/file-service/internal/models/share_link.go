@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// ShareLink lets anyone holding its token download a file without an account.
+// Only the SHA-256 of the token is stored, the token itself is shown once.
+type ShareLink struct {
+	ID            uint       `gorm:"primaryKey;autoIncrement"`
+	FileID        string     `gorm:"not null;index"`
+	TokenHash     string     `gorm:"type:char(64);not null;uniqueIndex" json:"-"`
+	PasswordHash  string     `json:"-"`                  // bcrypt hash, empty when no password is required
+	HasPassword   bool       `gorm:"-"`                  // Set when the link is returned to its owner
+	ExpiresAt     time.Time  `gorm:"not null"`           // The link stops working after this date
+	MaxDownloads  int        `gorm:"not null;default:0"` // 0 for unlimited
+	DownloadCount int        `gorm:"not null;default:0"` // Downloads served so far
+	RevokedAt     *time.Time // Set when the owner revoked the link
+	CreatedAt     time.Time  `gorm:"autoCreateTime"`
+	CreatedBy     string     `gorm:"not null"` // Owner who created the link
+}
+
+// Outcomes of a share link access
+const (
+	LinkAccessDownloaded       = "downloaded"
+	LinkAccessInspected        = "inspected" // Link details or HEAD request, no download counted
+	LinkAccessPasswordRequired = "password_required"
+	LinkAccessWrongPassword    = "wrong_password"
+	LinkAccessExpired          = "expired"
+	LinkAccessRevoked          = "revoked"
+	LinkAccessExhausted        = "exhausted"
+)
+
+// ShareLinkAccess records one use of a share link, successful or not
+type ShareLinkAccess struct {
+	ID         uint   `gorm:"primaryKey;autoIncrement"`
+	LinkID     uint   `gorm:"not null;index"`
+	Outcome    string `gorm:"type:varchar(20);not null"`
+	ClientIP   string
+	UserAgent  string
+	AccessedAt time.Time `gorm:"autoCreateTime"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// TrashRetentionPolicy sets how long trashed files of a company's members are
+// kept before being purged. Companies without a policy use the configured default.
+type TrashRetentionPolicy struct {
+	CompanyID     string    `gorm:"type:uuid;primaryKey"`
+	RetentionDays int       `gorm:"not null"`
+	UpdatedAt     time.Time `gorm:"autoUpdateTime"`
+	UpdatedBy     string    `gorm:"not null"` // Company admin who set the policy
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"file-service/internal/models"
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// AccessService decides what a user may do with a file: its owner may do
+// anything, share recipients get the role of their share, and the admins of a
+// company the owner belongs to may read it.
+type AccessService struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+func NewAccessService(db *gorm.DB, log *zap.Logger) *AccessService {
+	return &AccessService{db: db, logger: log}
+}
+
+// sharedWithUser selects the shares granted to userID, directly or through one
+// of their companies
+const sharedWithUser = `(file_shares.recipient_type = @userRecipient AND file_shares.recipient_id = @user)
+	OR (file_shares.recipient_type = @companyRecipient AND file_shares.recipient_id IN (
+		SELECT company_id FROM company_users WHERE user_id = @user AND deleted_at IS NULL))`
+
+func sharedWithUserArgs(userID string) []interface{} {
+	return []interface{}{
+		sql.Named("user", userID),
+		sql.Named("userRecipient", models.ShareRecipientUser),
+		sql.Named("companyRecipient", models.ShareRecipientCompany),
+	}
+}
+
+// FileRole returns the highest role userID holds on file, or an empty string
+// when they may not access it at all
+func (a *AccessService) FileRole(file *models.FileMetadata, userID string) (string, error) {
+	if file.UserID == userID {
+		return models.FileRoleOwner, nil
+	}
+
+	var shares []models.FileShare
+	err := a.db.Where("file_id = ?", file.FileID).
+		Where(sharedWithUser, sharedWithUserArgs(userID)...).
+		Find(&shares).Error
+	if err != nil {
+		a.logger.Error("Failed to resolve file shares", zap.String("fileID", file.FileID), zap.String("userID", userID), zap.Error(err))
+		return "", err
+	}
+
+	role := ""
+	for _, share := range shares {
+		if models.FileRoleRank(share.Role) > models.FileRoleRank(role) {
+			role = share.Role
+		}
+	}
+	if role != "" {
+		return role, nil
+	}
+
+	isAdmin, err := a.IsCompanyAdminOf(userID, file.UserID)
+	if err != nil || !isAdmin {
+		return "", err
+	}
+	return models.FileRoleViewer, nil
+}
+
+// CanReadFile reports whether userID may read the content of file
+func (a *AccessService) CanReadFile(file *models.FileMetadata, userID string) (bool, error) {
+	role, err := a.FileRole(file, userID)
+	return role != "", err
+}
+
+// IsCompanyAdminOf reports whether adminID is an admin of a company memberID belongs to
+func (a *AccessService) IsCompanyAdminOf(adminID, memberID string) (bool, error) {
+	var count int64
+	err := a.db.Model(&models.CompanyUser{}).
+		Joins("JOIN company_users AS members ON members.company_id = company_users.company_id AND members.deleted_at IS NULL").
+		Where("company_users.user_id = ? AND company_users.role = ? AND members.user_id = ?", adminID, models.CompanyRoleAdmin, memberID).
+		Count(&count).Error
+	if err != nil {
+		a.logger.Error("Failed to resolve company admin", zap.String("adminID", adminID), zap.String("memberID", memberID), zap.Error(err))
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// IsCompanyAdmin reports whether userID is an admin of companyID
+func (a *AccessService) IsCompanyAdmin(userID, companyID string) (bool, error) {
+	var count int64
+	err := a.db.Model(&models.CompanyUser{}).
+		Where("user_id = ? AND company_id = ? AND role = ?", userID, companyID, models.CompanyRoleAdmin).
+		Count(&count).Error
+	if err != nil {
+		a.logger.Error("Failed to resolve company admin", zap.String("userID", userID), zap.String("companyID", companyID), zap.Error(err))
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// IsCompanyMember reports whether userID belongs to companyID
+func (a *AccessService) IsCompanyMember(userID, companyID string) (bool, error) {
+	var count int64
+	err := a.db.Model(&models.CompanyUser{}).
+		Where("user_id = ? AND company_id = ?", userID, companyID).
+		Count(&count).Error
+	if err != nil {
+		a.logger.Error("Failed to resolve company membership", zap.String("userID", userID), zap.String("companyID", companyID), zap.Error(err))
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// ownerCompany returns the company the files of userID belong to for storage
+// purposes, its oldest membership, or "" for users outside any company
+func ownerCompany(db *gorm.DB, userID string) (string, error) {
+	var companyIDs []string
+	err := db.Model(&models.CompanyUser{}).
+		Where("user_id = ?", userID).
+		Order("created_at, id").
+		Limit(1).
+		Pluck("company_id", &companyIDs).Error
+	if err != nil {
+		return "", fmt.Errorf("error resolving the company of user %s: %w", userID, err)
+	}
+	if len(companyIDs) == 0 {
+		return "", nil
+	}
+	return companyIDs[0], nil
+}
+
+// storageCompany returns the company whose storage and keys hold the files of
+// ownerID in folderID: the company of the folder, or the company of the owner
+// for files at the root or in folders outside any company
+func storageCompany(db *gorm.DB, ownerID, folderID string) (string, error) {
+	if _, err := uuid.Parse(folderID); err == nil {
+		var folder models.Folder
+		err := db.Select("company_id").Where("id = ?", folderID).Take(&folder).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", fmt.Errorf("error resolving the company of folder %s: %w", folderID, err)
+		}
+		if folder.CompanyID != nil {
+			return *folder.CompanyID, nil
+		}
+	}
+	return ownerCompany(db, ownerID)
+}
+
+// CanBrowseFolder reports whether userID may list the content of folder: its
+// owner, or an admin of the company it belongs to
+func (a *AccessService) CanBrowseFolder(folder *models.Folder, userID string) (bool, error) {
+	if folder.OwnerID == userID {
+		return true, nil
+	}
+	if folder.CompanyID == nil {
+		return false, nil
+	}
+	return a.IsCompanyAdmin(userID, *folder.CompanyID)
+}
+
+// ReadableFiles is a query scope restricting file_metadata rows to the files
+// userID may read, following the same rules as FileRole
+func (a *AccessService) ReadableFiles(userID string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		args := append(sharedWithUserArgs(userID), sql.Named("admin", models.CompanyRoleAdmin))
+		return db.Where(`(file_metadata.user_id = @user
+			OR EXISTS (SELECT 1 FROM file_shares WHERE file_shares.file_id = file_metadata.file_id AND (`+sharedWithUser+`))
+			OR file_metadata.user_id IN (
+				SELECT members.user_id FROM company_users AS admins
+				JOIN company_users AS members ON members.company_id = admins.company_id AND members.deleted_at IS NULL
+				WHERE admins.user_id = @user AND admins.role = @admin AND admins.deleted_at IS NULL))`,
+			args...)
+	}
+}
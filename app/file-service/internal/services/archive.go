@@ -0,0 +1,173 @@
+package services
+
+import (
+	"archive/zip"
+	"errors"
+	"file-service/internal/models"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrArchiveTooLarge = errors.New("archive exceeds the maximum allowed size")
+
+// ArchiveEntry is one file of an archive, stored under Name
+type ArchiveEntry struct {
+	Name string
+	File models.FileMetadata
+}
+
+// FolderFile is a file found in a folder tree. Dir is the path of its folder
+// relative to the parent of the tree root, e.g. "Reports/2024".
+type FolderFile struct {
+	Dir  string
+	File models.FileMetadata
+}
+
+// FolderTreeContents returns the folders and the files of the tree rooted at
+// folder. Folders are returned as paths relative to the parent of folder,
+// parents first; files are restricted by scope.
+func (f *FolderService) FolderTreeContents(folder *models.Folder, scope func(db *gorm.DB) *gorm.DB) ([]string, []FolderFile, error) {
+	var tree []models.Folder
+	if err := f.db.Where("path LIKE ?", escapeLike(folder.Path)+"%").Order("path").Find(&tree).Error; err != nil {
+		return nil, nil, err
+	}
+
+	names := make(map[string]string, len(tree))
+	for _, sub := range tree {
+		names[sub.ID] = sub.Name
+	}
+
+	// The IDs of the path of folder itself are dropped, except its own
+	depth := strings.Count(strings.Trim(folder.Path, "/"), "/")
+	dirs := make(map[string]string, len(tree))
+	paths := make([]string, 0, len(tree))
+	for _, sub := range tree {
+		ids := strings.Split(strings.Trim(sub.Path, "/"), "/")[depth:]
+		segments := make([]string, len(ids))
+		for i, id := range ids {
+			segments[i] = names[id]
+		}
+		dirs[sub.ID] = strings.Join(segments, "/")
+		paths = append(paths, dirs[sub.ID])
+	}
+
+	var files []models.FileMetadata
+	err := f.db.Model(&models.FileMetadata{}).
+		Scopes(scope).
+		Where("file_metadata.folder_id IN (?)", f.db.Model(&models.Folder{}).Select("id").Where("path LIKE ?", escapeLike(folder.Path)+"%")).
+		Order("file_metadata.file_name, file_metadata.file_id").
+		Find(&files).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contents := make([]FolderFile, len(files))
+	for i, file := range files {
+		contents[i] = FolderFile{Dir: dirs[*file.FolderID], File: file}
+	}
+	return paths, contents, nil
+}
+
+// ArchiveNames hands out unique entry names inside an archive. Names are
+// compared without case, so the archive extracts cleanly on every platform.
+type ArchiveNames struct {
+	used map[string]bool
+}
+
+func NewArchiveNames() *ArchiveNames {
+	return &ArchiveNames{used: make(map[string]bool)}
+}
+
+// sanitizeEntryName makes a file name safe to use as one path segment
+func sanitizeEntryName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// Unique returns dir/name, or dir/"name (n).ext" when it is already taken
+func (a *ArchiveNames) Unique(dir, name string) string {
+	name = sanitizeEntryName(name)
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := path.Join(dir, name)
+	for n := 1; a.used[strings.ToLower(candidate)]; n++ {
+		candidate = path.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+	}
+	a.used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// UniqueDirs reserves the directories of a folder tree, given parents first as
+// FolderTreeContents returns them, and returns the path each one gets in the
+// archive by its path in the tree. Files must be named after the directories,
+// under their new path, so that none of them takes the name of a folder.
+func (a *ArchiveNames) UniqueDirs(dirs []string) map[string]string {
+	renamed := make(map[string]string, len(dirs))
+	for _, dir := range dirs {
+		parent, name := "", dir
+		if i := strings.LastIndex(dir, "/"); i >= 0 {
+			parent, name = renamed[dir[:i]], dir[i+1:]
+		}
+		renamed[dir] = a.Unique(parent, name)
+	}
+	return renamed
+}
+
+// WriteArchive streams a ZIP of dirs and entries to w. The content of every
+// entry is read from open as it is written, nothing is staged. archive/zip
+// switches to ZIP64 records by itself once an entry or the archive outgrows
+// the 4 GB and 65535 entries limits of the classic format. Writing stops with
+// ErrArchiveTooLarge once more than maxSize bytes of content were read.
+func WriteArchive(w io.Writer, dirs []string, entries []ArchiveEntry, maxSize int64, open func(file *models.FileMetadata) (io.ReadCloser, error)) error {
+	archive := zip.NewWriter(w)
+	remaining := maxSize
+
+	for _, dir := range dirs {
+		if _, err := archive.Create(dir + "/"); err != nil {
+			return fmt.Errorf("error adding directory %s: %w", dir, err)
+		}
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		header := &zip.FileHeader{
+			Name:     entry.Name,
+			Method:   zip.Deflate,
+			Modified: entry.File.CreatedAt,
+		}
+		writer, err := archive.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("error adding %s: %w", entry.Name, err)
+		}
+
+		content, err := open(&entry.File)
+		if err != nil {
+			return fmt.Errorf("error opening %s: %w", entry.File.FileID, err)
+		}
+		limited := &limitedReader{r: content, remaining: remaining}
+		_, err = io.Copy(writer, limited)
+		content.Close()
+		if errors.Is(err, ErrFileTooLarge) {
+			return ErrArchiveTooLarge
+		}
+		if err != nil {
+			return fmt.Errorf("error writing %s: %w", entry.File.FileID, err)
+		}
+		remaining = limited.remaining
+	}
+
+	return archive.Close()
+}
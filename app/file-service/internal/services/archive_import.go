@@ -0,0 +1,409 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidArchive        = errors.New("file is not a valid ZIP archive")
+	ErrArchiveTooManyEntries = errors.New("archive has too many entries")
+	ErrArchiveUnsafePath     = errors.New("archive contains an unsafe path")
+	ErrArchiveBomb           = errors.New("archive expands beyond the allowed size or compression ratio")
+)
+
+var archiveImportsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "file_service_archive_imports_total",
+	Help: "Number of ZIP archives expanded into folders, by outcome",
+}, []string{"status"})
+
+// Statuses of an archive import, as reported over the WebSocket
+const (
+	ArchiveImportRunning   = "running"
+	ArchiveImportCompleted = "completed"
+	ArchiveImportFailed    = "failed"
+)
+
+// archiveImportProgressInterval throttles the progress messages of an import
+const archiveImportProgressInterval = 500 * time.Millisecond
+
+// ArchiveImportLimits protect the expansion against hostile archives
+type ArchiveImportLimits struct {
+	MaxEntries      int   // Files and directories of one archive
+	MaxExpandedSize int64 // Total uncompressed size, in bytes
+	MaxRatio        int64 // Largest uncompressed to compressed ratio of an entry
+}
+
+// ArchiveImportProgress is pushed to the WebSocket of the importing user
+type ArchiveImportProgress struct {
+	Type         string `json:"type"` // Always "archive_import"
+	ImportID     string `json:"importId"`
+	Status       string `json:"status"`
+	RootFolderID string `json:"rootFolderId,omitempty"`
+	Processed    int    `json:"processed"`
+	Total        int    `json:"total"`
+	Current      string `json:"current,omitempty"`
+	Error        string `json:"error,omitempty"`
+
+	Skipped []string `json:"skipped,omitempty"` // Entries refused by the content policy
+}
+
+// importFile is one file of a checked archive
+type importFile struct {
+	entry *zip.File
+	dir   string
+	name  string
+}
+
+// ArchiveImport is a checked archive waiting to be expanded
+type ArchiveImport struct {
+	ID      string
+	archive *zip.ReadCloser
+	path    string
+	dirs    []string
+	files   []importFile
+}
+
+// Folders returns the number of folders the import creates below its root
+func (a *ArchiveImport) Folders() int {
+	return len(a.dirs)
+}
+
+// Files returns the number of files the import creates
+func (a *ArchiveImport) Files() int {
+	return len(a.files)
+}
+
+// Discard closes and deletes an archive that will not be imported
+func (a *ArchiveImport) Discard() {
+	a.archive.Close()
+	os.Remove(a.path)
+}
+
+// archiveEntryPath splits the name of an entry into safe path segments. Both
+// separators are accepted, absolute paths and ".." are refused.
+func archiveEntryPath(name string) ([]string, error) {
+	name = strings.ReplaceAll(strings.ToValidUTF8(name, "_"), "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return nil, ErrArchiveUnsafePath
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		// Folder names are trimmed when created, entries must match them
+		segment = strings.TrimSpace(segment)
+		switch {
+		case segment == "" || segment == ".":
+			continue
+		case segment == ".." || !validFolderName(segment):
+			return nil, ErrArchiveUnsafePath
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// ArchiveImporter expands uploaded ZIP archives into folders and files in the
+// background, reporting its progress over the WebSocket of the uploader
+type ArchiveImporter struct {
+	storage  *StorageService
+	metadata *MetadataService
+	folders  *FolderService
+	ws       *WebSocketServer
+	policy   *ContentPolicy
+	limits   ArchiveImportLimits
+	logger   *zap.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewArchiveImporter(storage *StorageService, metadata *MetadataService, folders *FolderService, ws *WebSocketServer, policy *ContentPolicy, limits ArchiveImportLimits, log *zap.Logger) *ArchiveImporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ArchiveImporter{
+		storage:  storage,
+		metadata: metadata,
+		folders:  folders,
+		ws:       ws,
+		policy:   policy,
+		limits:   limits,
+		logger:   log,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Prepare opens the archive stored at archivePath and checks every entry
+// before anything is created: entry count, paths, declared sizes and
+// compression ratios. The archive file is deleted when the check fails.
+func (i *ArchiveImporter) Prepare(archivePath string) (*ArchiveImport, error) {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		os.Remove(archivePath)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	imp := &ArchiveImport{ID: uuid.New().String(), archive: archive, path: archivePath}
+	if err := i.plan(imp); err != nil {
+		imp.Discard()
+		return nil, err
+	}
+	return imp, nil
+}
+
+// plan fills the folders and files of an import
+func (i *ArchiveImporter) plan(imp *ArchiveImport) error {
+	entries := imp.archive.File
+	if len(entries) > i.limits.MaxEntries {
+		return ErrArchiveTooManyEntries
+	}
+
+	dirs := make(map[string]bool)
+	var expanded uint64
+	for _, entry := range entries {
+		segments, err := archiveEntryPath(entry.Name)
+		if err != nil {
+			i.logger.Warn("Unsafe archive entry", zap.String("importID", imp.ID), zap.String("entry", entry.Name))
+			return err
+		}
+		// Resource forks of macOS archives are not user files
+		if len(segments) == 0 || segments[0] == "__MACOSX" {
+			continue
+		}
+
+		mode := entry.Mode()
+		if mode.IsDir() {
+			for n := 1; n <= len(segments); n++ {
+				dirs[strings.Join(segments[:n], "/")] = true
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			// Symbolic links and devices are skipped, they could point anywhere
+			continue
+		}
+
+		expanded += entry.UncompressedSize64
+		if expanded > uint64(i.limits.MaxExpandedSize) {
+			return ErrArchiveBomb
+		}
+		if entry.UncompressedSize64 > 0 && (entry.CompressedSize64 == 0 || entry.UncompressedSize64/entry.CompressedSize64 > uint64(i.limits.MaxRatio)) {
+			i.logger.Warn("Suspicious compression ratio", zap.String("importID", imp.ID), zap.String("entry", entry.Name),
+				zap.Uint64("compressed", entry.CompressedSize64), zap.Uint64("uncompressed", entry.UncompressedSize64))
+			return ErrArchiveBomb
+		}
+
+		dir := strings.Join(segments[:len(segments)-1], "/")
+		for n := 1; n < len(segments); n++ {
+			dirs[strings.Join(segments[:n], "/")] = true
+		}
+		imp.files = append(imp.files, importFile{entry: entry, dir: dir, name: segments[len(segments)-1]})
+	}
+
+	// A parent sorts before its children, its path being their prefix
+	for dir := range dirs {
+		imp.dirs = append(imp.dirs, dir)
+	}
+	sort.Strings(imp.dirs)
+	return nil
+}
+
+// archiveRootName names the folder receiving an archive after the archive
+func archiveRootName(archiveName string) string {
+	name := path.Base(strings.ReplaceAll(archiveName, "\\", "/"))
+	name = strings.TrimSpace(strings.TrimSuffix(name, path.Ext(name)))
+	if !validFolderName(name) {
+		return "Imported archive"
+	}
+	return name
+}
+
+// Start expands a prepared archive in the background into a new folder named
+// after archiveName, created under parentID or at the root of userID. It
+// returns at once; the progress is pushed to the WebSocket of userID.
+func (i *ArchiveImporter) Start(imp *ArchiveImport, userID, parentID, archiveName string) {
+	rootName := archiveRootName(archiveName)
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		defer imp.Discard()
+
+		err := i.expand(i.ctx, imp, userID, parentID, rootName)
+		if err != nil {
+			i.logger.Error("Archive import failed", zap.String("importID", imp.ID), zap.String("userID", userID), zap.Error(err))
+			archiveImportsTotal.WithLabelValues(ArchiveImportFailed).Inc()
+			return
+		}
+		i.logger.Info("Archive imported", zap.String("importID", imp.ID), zap.String("userID", userID), zap.Int("files", len(imp.files)), zap.Int("folders", len(imp.dirs)))
+		archiveImportsTotal.WithLabelValues(ArchiveImportCompleted).Inc()
+	}()
+}
+
+// Stop interrupts the running imports and waits for them to exit. Files
+// already expanded are kept.
+func (i *ArchiveImporter) Stop() {
+	i.cancel()
+	i.wg.Wait()
+}
+
+// expand creates the folders and files of an import, stopping at the first
+// error. Files refused by the content policy are skipped and reported.
+func (i *ArchiveImporter) expand(ctx context.Context, imp *ArchiveImport, userID, parentID, rootName string) error {
+	progress := ArchiveImportProgress{
+		Type:     "archive_import",
+		ImportID: imp.ID,
+		Status:   ArchiveImportRunning,
+		Total:    len(imp.files),
+	}
+	lastSent := time.Time{}
+	report := func(force bool) {
+		if force || time.Since(lastSent) >= archiveImportProgressInterval {
+			i.ws.SendJSON(userID, progress)
+			lastSent = time.Now()
+		}
+	}
+	fail := func(err error) error {
+		progress.Status = ArchiveImportFailed
+		progress.Error = err.Error()
+		report(true)
+		return err
+	}
+
+	root, err := i.createRootFolder(userID, parentID, rootName)
+	if err != nil {
+		return fail(fmt.Errorf("error creating the root folder: %w", err))
+	}
+	progress.RootFolderID = root
+	report(true)
+
+	folderIDs := map[string]string{"": root}
+	for _, dir := range imp.dirs {
+		parent, name := "", dir
+		if n := strings.LastIndex(dir, "/"); n >= 0 {
+			parent, name = dir[:n], dir[n+1:]
+		}
+		folder, err := i.folders.CreateFolder(userID, name, folderIDs[parent], "")
+		if err != nil {
+			return fail(fmt.Errorf("error creating folder %s: %w", dir, err))
+		}
+		folderIDs[dir] = folder.ID
+	}
+
+	for _, file := range imp.files {
+		if ctx.Err() != nil {
+			return fail(errors.New("import interrupted by a server shutdown"))
+		}
+
+		progress.Current = path.Join(file.dir, file.name)
+		report(false)
+		err := i.importFile(userID, folderIDs[file.dir], file)
+		if errors.Is(err, ErrContentTypeDenied) || errors.Is(err, ErrContentTypeMismatch) {
+			i.logger.Warn("Archive entry rejected", zap.String("importID", imp.ID), zap.String("entry", progress.Current), zap.Error(err))
+			progress.Skipped = append(progress.Skipped, progress.Current)
+			progress.Processed++
+			continue
+		}
+		if err != nil {
+			return fail(fmt.Errorf("error importing %s: %w", progress.Current, err))
+		}
+		progress.Processed++
+	}
+
+	progress.Status = ArchiveImportCompleted
+	progress.Current = ""
+	report(true)
+	return nil
+}
+
+// createRootFolder creates the folder receiving the archive, adding a " (n)"
+// suffix to its name when it is already taken
+func (i *ArchiveImporter) createRootFolder(userID, parentID, name string) (string, error) {
+	const maxAttempts = 100
+
+	candidate := name
+	for n := 1; n <= maxAttempts; n++ {
+		folder, err := i.folders.CreateFolder(userID, candidate, parentID, "")
+		if err == nil {
+			return folder.ID, nil
+		}
+		if !errors.Is(err, ErrFolderNameTaken) {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s (%d)", name, n)
+	}
+	return "", ErrFolderNameTaken
+}
+
+// importFile streams one entry to storage and records it in folderID
+func (i *ArchiveImporter) importFile(userID, folderID string, file importFile) error {
+	content, err := file.entry.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	// The declared size was checked, the actual content must not exceed it
+	limited := &limitedReader{r: content, remaining: int64(file.entry.UncompressedSize64)}
+	contentType, sniffed, err := i.policy.Sniff(file.name, limited)
+	if err != nil {
+		return err
+	}
+	checksum := NewChecksumReader(sniffed)
+	fileID, location, err := i.storage.NewFileLocation(userID, folderID)
+	if err != nil {
+		return err
+	}
+	fileVersion, encryption, err := i.storage.UploadFile(checksum, int64(file.entry.UncompressedSize64), location, file.name, contentType, userID, folderID)
+	if errors.Is(err, ErrFileTooLarge) {
+		return ErrArchiveBomb
+	}
+	if err != nil {
+		return err
+	}
+
+	err = i.metadata.SaveFileMetadata(userID, fileID, file.name, fileVersion, checksum.Size(), checksum.Sum(), contentType, encryption, location, folderID)
+	if err != nil {
+		i.storage.RemoveFileVersion(location, fileVersion)
+		return err
+	}
+	return nil
+}
+
+// SaveArchiveUpload copies an uploaded archive to a temporary file below
+// tempRoot, where it can be read randomly, and returns its path. Archives left
+// behind are removed by the upload janitor.
+func SaveArchiveUpload(tempRoot string, content io.Reader) (string, error) {
+	root, err := chunkRoot(tempRoot)
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary archive: %w", err)
+	}
+	file, err := os.CreateTemp(root, "import-*.zip")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary archive: %w", err)
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("error writing temporary archive: %w", err)
+	}
+	return file.Name(), nil
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArchiveEntryPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "file at the root", entry: "report.pdf", want: []string{"report.pdf"}},
+		{name: "nested file", entry: "2024/q1/report.pdf", want: []string{"2024", "q1", "report.pdf"}},
+		{name: "directory entry", entry: "2024/q1/", want: []string{"2024", "q1"}},
+		{name: "backslashes", entry: `2024\q1\report.pdf`, want: []string{"2024", "q1", "report.pdf"}},
+		{name: "current directory segments", entry: "./2024/./report.pdf", want: []string{"2024", "report.pdf"}},
+		{name: "repeated separators", entry: "2024//report.pdf", want: []string{"2024", "report.pdf"}},
+		{name: "padded segments", entry: " 2024 / report.pdf", want: []string{"2024", "report.pdf"}},
+		{name: "invalid UTF-8", entry: "r\xffport.pdf", want: []string{"r_port.pdf"}},
+		{name: "dots inside a name", entry: "a..b/..c", want: []string{"a..b", "..c"}},
+		{name: "only current directory", entry: "./", want: nil},
+
+		{name: "parent directory", entry: "../etc/passwd", wantErr: true},
+		{name: "nested parent directory", entry: "2024/../../etc/passwd", wantErr: true},
+		{name: "backslash parent directory", entry: `2024\..\..\secret`, wantErr: true},
+		{name: "padded parent directory", entry: "2024/ .. /secret", wantErr: true},
+		{name: "absolute path", entry: "/etc/passwd", wantErr: true},
+		{name: "absolute backslash path", entry: `\Windows\system32`, wantErr: true},
+		{name: "drive letter", entry: `C:\Windows\system32`, wantErr: true},
+		{name: "relative drive letter", entry: "C:report.pdf", wantErr: true},
+		{name: "NUL byte", entry: "report\x00.pdf", wantErr: true},
+		{name: "name too long", entry: "2024/" + strings.Repeat("a", maxFolderNameLength+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := archiveEntryPath(tt.entry)
+			if tt.wantErr {
+				if !errors.Is(err, ErrArchiveUnsafePath) {
+					t.Errorf("archiveEntryPath(%q) = %q, %v, want ErrArchiveUnsafePath", tt.entry, got, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("archiveEntryPath(%q) = %q, %v, want %q", tt.entry, got, err, tt.want)
+			}
+		})
+	}
+}
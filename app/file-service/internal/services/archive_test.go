@@ -0,0 +1,71 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestArchiveNamesUniqueDirs(t *testing.T) {
+	type file struct{ dir, name string }
+	tests := []struct {
+		name      string
+		taken     []string // Names handed out before the tree, at the root
+		dirs      []string
+		files     []file
+		wantDirs  []string
+		wantFiles []string
+	}{
+		{
+			name:      "plain tree",
+			dirs:      []string{"Reports", "Reports/2024"},
+			files:     []file{{"Reports", "a.pdf"}, {"Reports/2024", "b.pdf"}},
+			wantDirs:  []string{"Reports", "Reports/2024"},
+			wantFiles: []string{"Reports/a.pdf", "Reports/2024/b.pdf"},
+		},
+		{
+			name:      "file named like a subfolder",
+			dirs:      []string{"Reports", "Reports/2024"},
+			files:     []file{{"Reports", "2024"}},
+			wantDirs:  []string{"Reports", "Reports/2024"},
+			wantFiles: []string{"Reports/2024 (1)"},
+		},
+		{
+			name:      "subfolders differing by case",
+			dirs:      []string{"Reports", "Reports/Q1", "Reports/q1"},
+			files:     []file{{"Reports/Q1", "a.pdf"}, {"Reports/q1", "a.pdf"}},
+			wantDirs:  []string{"Reports", "Reports/Q1", "Reports/q1 (1)"},
+			wantFiles: []string{"Reports/Q1/a.pdf", "Reports/q1 (1)/a.pdf"},
+		},
+		{
+			name:      "root taken by a selected file",
+			taken:     []string{"reports"},
+			dirs:      []string{"Reports", "Reports/2024"},
+			files:     []file{{"Reports/2024", "b.pdf"}},
+			wantDirs:  []string{"Reports (1)", "Reports (1)/2024"},
+			wantFiles: []string{"Reports (1)/2024/b.pdf"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := NewArchiveNames()
+			for _, name := range tt.taken {
+				names.Unique("", name)
+			}
+
+			renamed := names.UniqueDirs(tt.dirs)
+			var dirs, files []string
+			for _, dir := range tt.dirs {
+				dirs = append(dirs, renamed[dir])
+			}
+			for _, f := range tt.files {
+				files = append(files, names.Unique(renamed[f.dir], f.name))
+			}
+			if !reflect.DeepEqual(dirs, tt.wantDirs) {
+				t.Errorf("dirs = %q, want %q", dirs, tt.wantDirs)
+			}
+			if !reflect.DeepEqual(files, tt.wantFiles) {
+				t.Errorf("files = %q, want %q", files, tt.wantFiles)
+			}
+		})
+	}
+}
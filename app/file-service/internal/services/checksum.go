@@ -0,0 +1,69 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumReader computes the SHA-256 digest of everything read through it,
+// so the digest of an upload is known as soon as it has been streamed.
+type ChecksumReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func NewChecksumReader(r io.Reader) *ChecksumReader {
+	return &ChecksumReader{r: r, hash: sha256.New()}
+}
+
+func (c *ChecksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.size += int64(n)
+	return n, err
+}
+
+// Sum returns the hex encoded SHA-256 of the bytes read so far
+func (c *ChecksumReader) Sum() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// Size returns the number of bytes read so far
+func (c *ChecksumReader) Size() int64 {
+	return c.size
+}
+
+// Verify compares the digest of the bytes read so far with the hex encoded
+// SHA-256 sent by the client. An empty expected digest always matches.
+func (c *ChecksumReader) Verify(expected string) error {
+	if expected == "" {
+		return nil
+	}
+	if !strings.EqualFold(expected, c.Sum()) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// ValidSHA256 reports whether digest looks like a hex encoded SHA-256
+func ValidSHA256(digest string) bool {
+	decoded, err := hex.DecodeString(digest)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// DigestHeader formats a hex encoded SHA-256 as an RFC 3230 Digest header value
+func DigestHeader(sha256Hex string) string {
+	decoded, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return ""
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(decoded)
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChecksumReader(t *testing.T) {
+	const (
+		helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	)
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+		wantErr  error
+	}{
+		{"matching digest", "hello", helloSHA256, nil},
+		{"uppercase digest", "hello", strings.ToUpper(helloSHA256), nil},
+		{"no digest sent", "hello", "", nil},
+		{"empty content", "", emptySHA256, nil},
+		{"altered content", "hellO", helloSHA256, ErrChecksumMismatch},
+		{"truncated content", "hell", helloSHA256, ErrChecksumMismatch},
+		{"digest of another file", "hello", emptySHA256, ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checksum := NewChecksumReader(strings.NewReader(tt.content))
+			read, err := io.ReadAll(checksum)
+			if err != nil || string(read) != tt.content {
+				t.Fatalf("read %q, %v through the checksum", read, err)
+			}
+			if checksum.Size() != int64(len(tt.content)) {
+				t.Errorf("Size() = %d, want %d", checksum.Size(), len(tt.content))
+			}
+			if err := checksum.Verify(tt.expected); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify(%q) = %v, want %v", tt.expected, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidSHA256(t *testing.T) {
+	tests := []struct {
+		digest string
+		want   bool
+	}{
+		{"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", true},
+		{"2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824", true},
+		{"", false},
+		{"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b98", false},
+		{"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b982400", false},
+		{"zcf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", false},
+	}
+	for _, tt := range tests {
+		if got := ValidSHA256(tt.digest); got != tt.want {
+			t.Errorf("ValidSHA256(%q) = %v, want %v", tt.digest, got, tt.want)
+		}
+	}
+}
+
+func TestDigestHeader(t *testing.T) {
+	if got := DigestHeader("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"); got != "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=" {
+		t.Errorf("DigestHeader = %q", got)
+	}
+	if got := DigestHeader("not hex"); got != "" {
+		t.Errorf("DigestHeader(not hex) = %q, want empty", got)
+	}
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+var (
+	ErrContentTypeDenied   = errors.New("file type is not allowed")
+	ErrContentTypeMismatch = errors.New("file content does not match its extension")
+)
+
+// sniffLength is how many leading bytes are inspected to detect a file type,
+// the default of mimetype, which recognizes office documents from their headers
+const sniffLength = 3072
+
+// extensionTypes completes the MIME types the standard library and the host
+// know for an extension, so mismatches on common documents never depend on
+// the /etc/mime.types of the machine
+var extensionTypes = map[string]string{
+	".7z":   "application/x-7z-compressed",
+	".bmp":  "image/bmp",
+	".csv":  "text/csv",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".exe":  "application/vnd.microsoft.portable-executable",
+	".gz":   "application/gzip",
+	".heic": "image/heic",
+	".md":   "text/markdown",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".msi":  "application/x-ms-installer",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".rar":  "application/x-rar-compressed",
+	".rtf":  "text/rtf",
+	".tar":  "application/x-tar",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".txt":  "text/plain",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".zip":  "application/zip",
+}
+
+// ContentPolicy detects the type of uploaded files from their content and
+// decides whether they may be stored. Patterns are MIME types, or families
+// such as "image/*".
+type ContentPolicy struct {
+	allowed []string // Empty to allow every type that is not denied
+	denied  []string
+}
+
+func NewContentPolicy(allowed, denied []string) *ContentPolicy {
+	return &ContentPolicy{allowed: normalizePatterns(allowed), denied: normalizePatterns(denied)}
+}
+
+// normalizePatterns lowercases patterns and drops the empty ones
+func normalizePatterns(patterns []string) []string {
+	var normalized []string
+	for _, pattern := range patterns {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			normalized = append(normalized, pattern)
+		}
+	}
+	return normalized
+}
+
+// matchesPattern reports whether mediaType, without parameters, matches one of patterns
+func matchesPattern(mediaType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if family, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, family+"/") {
+				return true
+			}
+		} else if pattern == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Sniff detects the type of content from its first bytes and checks it
+// against the policy and the extension of fileName. It returns the detected
+// type, with its parameters such as the charset of texts, and a reader
+// yielding the whole content again. Nothing but the first bytes is buffered.
+func (p *ContentPolicy) Sniff(fileName string, content io.Reader) (string, io.Reader, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	replay := io.MultiReader(bytes.NewReader(head), content)
+
+	detected := mimetype.Detect(head)
+	mediaType, _, _ := mime.ParseMediaType(detected.String())
+
+	if matchesPattern(mediaType, p.denied) || (len(p.allowed) > 0 && !matchesPattern(mediaType, p.allowed)) {
+		return "", nil, fmt.Errorf("%w: %s", ErrContentTypeDenied, mediaType)
+	}
+	// Empty files have no content to contradict their extension
+	if n > 0 && !extensionMatches(path.Ext(fileName), detected) {
+		return "", nil, fmt.Errorf("%w: %s detected for %s", ErrContentTypeMismatch, mediaType, fileName)
+	}
+	return detected.String(), replay, nil
+}
+
+// extensionMatches reports whether content detected as detected may carry the
+// extension ext. Unknown extensions and unrecognized content are accepted;
+// otherwise the type the extension stands for must be the detected type, one
+// of its parents (".zip" for a docx) or a more precise type of it (".docx"
+// for a zip the detector could not look into). Texts may carry any text
+// extension, plain text detection cannot tell a CSV from Markdown.
+func extensionMatches(ext string, detected *mimetype.MIME) bool {
+	ext = strings.ToLower(ext)
+	expected := extensionTypes[ext]
+	if expected == "" && ext != "" {
+		expected, _, _ = mime.ParseMediaType(mime.TypeByExtension(ext))
+	}
+	if expected == "" || detected.Is("application/octet-stream") {
+		return true
+	}
+
+	for m := detected; m != nil; m = m.Parent() {
+		if m.Is(expected) {
+			return true
+		}
+		if m.Is("text/plain") && isTextType(expected) {
+			return true
+		}
+	}
+	if node := mimetype.Lookup(expected); node != nil {
+		for m := node.Parent(); m != nil; m = m.Parent() {
+			if m.Is(detected.String()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTextType reports whether mediaType holds human readable text
+func isTextType(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-yaml", "application/yaml", "application/toml", "application/sql", "image/svg+xml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// zipContent returns a ZIP holding an empty file for each of names
+func zipContent(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range names {
+		if _, err := archive.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// peContent returns the headers of a Windows executable
+func peContent() []byte {
+	content := make([]byte, 512)
+	copy(content, "MZ")
+	binary.LittleEndian.PutUint32(content[0x3c:], 0x80)
+	copy(content[0x80:], "PE\x00\x00")
+	return content
+}
+
+func TestContentPolicySniff(t *testing.T) {
+	docx := zipContent(t, "[Content_Types].xml", "_rels/.rels", "word/document.xml")
+	plainZip := zipContent(t, "notes.txt")
+	pdf := []byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\n")
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+
+	open := NewContentPolicy(nil, nil)
+	denying := NewContentPolicy(nil, []string{"application/vnd.microsoft.portable-executable"})
+	images := NewContentPolicy([]string{" Image/* "}, nil)
+
+	tests := []struct {
+		name     string
+		policy   *ContentPolicy
+		fileName string
+		content  []byte
+		want     string // Detected type, without parameters
+		wantErr  error
+	}{
+		{name: "docx", policy: open, fileName: "report.docx", content: docx, want: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{name: "docx named zip", policy: open, fileName: "report.zip", content: docx, want: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{name: "zip", policy: open, fileName: "notes.zip", content: plainZip, want: "application/zip"},
+		{name: "zip named docx", policy: open, fileName: "notes.docx", content: plainZip, want: "application/zip"},
+		{name: "csv", policy: open, fileName: "figures.csv", content: []byte("name,amount\nrent,1200\n"), want: "text/csv"},
+		{name: "csv detected as plain text", policy: open, fileName: "amounts.csv", content: []byte("1200\n350\n"), want: "text/plain"},
+		{name: "markdown", policy: open, fileName: "README.md", content: []byte("# Title\n\nSome *text*.\n"), want: "text/plain"},
+		{name: "uppercase extension", policy: open, fileName: "SCAN.PDF", content: pdf, want: "application/pdf"},
+		{name: "text named pdf", policy: open, fileName: "notes.pdf", content: []byte("just some words\n"), wantErr: ErrContentTypeMismatch},
+		{name: "executable named pdf", policy: open, fileName: "invoice.pdf", content: peContent(), wantErr: ErrContentTypeMismatch},
+		{name: "denied executable named pdf", policy: denying, fileName: "invoice.pdf", content: peContent(), wantErr: ErrContentTypeDenied},
+		{name: "empty file", policy: open, fileName: "empty.pdf", content: nil, want: "text/plain"},
+		{name: "unknown extension", policy: open, fileName: "data.xyz123", content: pdf, want: "application/pdf"},
+		{name: "no extension", policy: open, fileName: "Makefile", content: []byte("all:\n\tgo build\n"), want: "text/plain"},
+		{name: "allowed family", policy: images, fileName: "pixel.png", content: png, want: "image/png"},
+		{name: "outside the allowed family", policy: images, fileName: "scan.pdf", content: pdf, wantErr: ErrContentTypeDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detected, replay, err := tt.policy.Sniff(tt.fileName, bytes.NewReader(tt.content))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Sniff = %q, %v, want %v", detected, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Sniff: %v", err)
+			}
+			if mediaType, _, _ := strings.Cut(detected, ";"); mediaType != tt.want {
+				t.Errorf("detected %q, want %q", detected, tt.want)
+			}
+			// The content read to detect the type is handed back
+			replayed, err := io.ReadAll(replay)
+			if err != nil || !bytes.Equal(replayed, tt.content) {
+				t.Errorf("replayed %d bytes, %v, want the %d bytes of the content", len(replayed), err, len(tt.content))
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"file-service/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var ErrDecryptionFailed = errors.New("stored content cannot be decrypted")
+
+// Content is encrypted in segments of encryptionSegmentSize bytes, each sealed
+// on its own with AES-256-GCM, so any range can be decrypted without reading
+// the content before it. The nonce of a segment is the nonce of the version
+// with its index mixed into the last four bytes, and the last segment is
+// authenticated as such so a truncated object does not decrypt.
+const (
+	encryptionSegmentSize = 64 * 1024
+	encryptionTagSize     = 16
+	encryptedSegmentSize  = encryptionSegmentSize + encryptionTagSize
+	dataKeySize           = 32
+	rewrapBatchSize       = 500
+)
+
+var rewrappedKeysCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "file_service_rewrapped_keys_total",
+	Help: "Data keys re-wrapped after a KEK rotation, by outcome",
+}, []string{"status"})
+
+// KeyProvider holds the key-encryption keys of the companies. Files of users
+// outside any company use the KEKs of the empty company.
+type KeyProvider interface {
+	// WrapKey encrypts a data key with the current KEK of company and returns
+	// the ID of that KEK
+	WrapKey(ctx context.Context, company string, dataKey []byte) ([]byte, string, error)
+	// UnwrapKey decrypts a data key wrapped by the KEK keyID of company
+	UnwrapKey(ctx context.Context, company, keyID string, wrapped []byte) ([]byte, error)
+	// RotateKey makes a new KEK current for company and returns its ID. The
+	// previous KEKs are kept to unwrap the keys they wrapped.
+	RotateKey(ctx context.Context, company string) (string, error)
+}
+
+// FileEncryptor encrypts stored content with a data key per stored version,
+// wrapped by a KEK of the company of the folder holding the file, or of the
+// company of its owner for files outside company folders
+type FileEncryptor struct {
+	db       *gorm.DB
+	provider KeyProvider
+	logger   *zap.Logger
+}
+
+func NewFileEncryptor(db *gorm.DB, provider KeyProvider, log *zap.Logger) *FileEncryptor {
+	return &FileEncryptor{db: db, provider: provider, logger: log}
+}
+
+// newEnvelope generates the data key and nonce of a version owned by ownerID
+// in folderID, empty at the root
+func (e *FileEncryptor) newEnvelope(ownerID, folderID string) (cipher.AEAD, models.FileEncryption, error) {
+	company, err := storageCompany(e.db, ownerID, folderID)
+	if err != nil {
+		return nil, models.FileEncryption{}, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, models.FileEncryption{}, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, models.FileEncryption{}, err
+	}
+
+	wrapped, keyID, err := e.provider.WrapKey(context.Background(), company, dataKey)
+	if err != nil {
+		return nil, models.FileEncryption{}, fmt.Errorf("error wrapping data key: %w", err)
+	}
+	aead, err := newSegmentCipher(dataKey)
+	if err != nil {
+		return nil, models.FileEncryption{}, err
+	}
+	return aead, models.FileEncryption{WrappedKey: wrapped, KeyCompany: company, KeyID: keyID, Nonce: nonce}, nil
+}
+
+// openEnvelope unwraps the data key of an encrypted version
+func (e *FileEncryptor) openEnvelope(encryption models.FileEncryption) (cipher.AEAD, error) {
+	dataKey, err := e.provider.UnwrapKey(context.Background(), encryption.KeyCompany, encryption.KeyID, encryption.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+	return newSegmentCipher(dataKey)
+}
+
+func newSegmentCipher(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce derives the nonce of segment index from the nonce of the version
+func segmentNonce(nonce []byte, index int64) []byte {
+	derived := make([]byte, len(nonce))
+	copy(derived, nonce)
+	counter := binary.BigEndian.Uint32(derived[len(derived)-4:]) ^ uint32(index)
+	binary.BigEndian.PutUint32(derived[len(derived)-4:], counter)
+	return derived
+}
+
+// segmentAAD authenticates whether a segment is the last one
+func segmentAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// EncryptedSize returns the stored size of size bytes of plaintext, -1 when
+// size is not known. Empty content is one empty segment.
+func EncryptedSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	segments := (size + encryptionSegmentSize - 1) / encryptionSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return size + segments*encryptionTagSize
+}
+
+// plaintextSize returns the plaintext size of size stored bytes and the
+// number of segments they hold
+func plaintextSize(size int64) (int64, int64, error) {
+	segments := (size + encryptedSegmentSize - 1) / encryptedSegmentSize
+	if segments == 0 || size-segments*encryptionTagSize < 0 || size%encryptedSegmentSize != 0 && size%encryptedSegmentSize < encryptionTagSize {
+		return 0, 0, fmt.Errorf("%w: invalid size %d", ErrDecryptionFailed, size)
+	}
+	return size - segments*encryptionTagSize, segments, nil
+}
+
+// encryptingReader seals the content of src segment by segment as it is read
+type encryptingReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	nonce  []byte
+	index  int64
+	plain  []byte // Next segment, plus one byte telling whether more follows
+	out    []byte // Last sealed segment
+	sealed []byte // Part of out not read yet
+	done   bool
+}
+
+func newEncryptingReader(src io.Reader, aead cipher.AEAD, nonce []byte) *encryptingReader {
+	return &encryptingReader{
+		src:   src,
+		aead:  aead,
+		nonce: nonce,
+		plain: make([]byte, 0, encryptionSegmentSize+1),
+	}
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.sealed) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.sealed)
+	r.sealed = r.sealed[n:]
+	return n, nil
+}
+
+// sealNext reads one segment ahead of the next one, to know whether it is the last
+func (r *encryptingReader) sealNext() error {
+	n, err := io.ReadFull(r.src, r.plain[len(r.plain):cap(r.plain)])
+	r.plain = r.plain[:len(r.plain)+n]
+	last := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	segment := r.plain
+	if !last {
+		segment = r.plain[:encryptionSegmentSize]
+	}
+	r.out = r.aead.Seal(r.out[:0], segmentNonce(r.nonce, r.index), segment, segmentAAD(last))
+	r.sealed = r.out
+	r.index++
+
+	if last {
+		r.done = true
+		r.plain = r.plain[:0]
+	} else {
+		// Keep the byte read ahead as the start of the next segment
+		r.plain = append(r.plain[:0], r.plain[encryptionSegmentSize])
+	}
+	return nil
+}
+
+// decryptingObject serves the plaintext of an encrypted object. Reads at any
+// offset decrypt only the segments they cover; the last decrypted segment is
+// kept for sequential reads.
+type decryptingObject struct {
+	src       Object
+	aead      cipher.AEAD
+	nonce     []byte
+	size      int64 // Plaintext size
+	storeSize int64
+	segments  int64
+
+	mu       sync.Mutex
+	offset   int64
+	cached   int64 // Index of the segment in plain, -1 when none
+	plain    []byte
+	readBuff []byte
+}
+
+func newDecryptingObject(src Object, storeSize int64, aead cipher.AEAD, nonce []byte) (*decryptingObject, error) {
+	size, segments, err := plaintextSize(storeSize)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingObject{
+		src:       src,
+		aead:      aead,
+		nonce:     nonce,
+		size:      size,
+		storeSize: storeSize,
+		segments:  segments,
+		cached:    -1,
+		readBuff:  make([]byte, encryptedSegmentSize),
+	}, nil
+}
+
+// segment decrypts segment index. The caller must hold the mutex.
+func (d *decryptingObject) segment(index int64) ([]byte, error) {
+	if index == d.cached {
+		return d.plain, nil
+	}
+
+	start := index * encryptedSegmentSize
+	length := min(int64(encryptedSegmentSize), d.storeSize-start)
+	sealed := d.readBuff[:length]
+	if _, err := d.src.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	plain, err := d.aead.Open(d.plain[:0], segmentNonce(d.nonce, index), sealed, segmentAAD(index == d.segments-1))
+	if err != nil {
+		d.cached = -1
+		return nil, fmt.Errorf("%w: segment %d: %v", ErrDecryptionFailed, index, err)
+	}
+	d.plain, d.cached = plain, index
+	return plain, nil
+}
+
+func (d *decryptingObject) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readAt(p, off)
+}
+
+// readAt fills p from off. The caller must hold the mutex.
+func (d *decryptingObject) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off >= d.size {
+			return n, io.EOF
+		}
+		plain, err := d.segment(off / encryptionSegmentSize)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], plain[off%encryptionSegmentSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+func (d *decryptingObject) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+	n, err := d.readAt(p, d.offset)
+	d.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (d *decryptingObject) Seek(offset int64, whence int) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decryptingObject) Close() error {
+	return d.src.Close()
+}
+
+// RotateCompanyKey makes a new KEK current for company and re-wraps with it
+// the data keys of every version wrapped by an older KEK of company. The
+// content is not touched. It returns the new KEK ID and how many keys were
+// re-wrapped; keys failing to re-wrap are logged and left as they are.
+func (e *FileEncryptor) RotateCompanyKey(ctx context.Context, company string) (string, int, error) {
+	keyID, err := e.provider.RotateKey(ctx, company)
+	if err != nil {
+		return "", 0, fmt.Errorf("error rotating KEK: %w", err)
+	}
+	e.logger.Info("KEK rotated", zap.String("company", company), zap.String("keyID", keyID))
+
+	rewrapped := 0
+	stale := e.db.Where("key_company = ? AND key_id <> ? AND key_id <> ''", company, keyID)
+
+	// Trashed files keep their envelope until they are purged. Rows are walked
+	// by primary key so the ones failing to re-wrap are not read again.
+	lastFileID := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return keyID, rewrapped, err
+		}
+		var files []models.FileMetadata
+		err := e.db.Unscoped().Select("file_id", "wrapped_key", "key_company", "key_id").
+			Where(stale).Where("file_id > ?", lastFileID).
+			Order("file_id").Limit(rewrapBatchSize).Find(&files).Error
+		if err != nil {
+			return keyID, rewrapped, fmt.Errorf("error listing file keys to re-wrap: %w", err)
+		}
+		if len(files) == 0 {
+			break
+		}
+		for _, file := range files {
+			lastFileID = file.FileID
+			err := e.rewrap(file.FileEncryption, e.db.Unscoped().Model(&models.FileMetadata{}).Where("file_id = ?", file.FileID))
+			if e.countRewrap(err, zap.String("fileID", file.FileID)) {
+				rewrapped++
+			}
+		}
+	}
+
+	var lastVersionID uint
+	for {
+		if err := ctx.Err(); err != nil {
+			return keyID, rewrapped, err
+		}
+		var versions []models.FileVersion
+		err := e.db.Select("id", "file_id", "wrapped_key", "key_company", "key_id").
+			Where(stale).Where("id > ?", lastVersionID).
+			Order("id").Limit(rewrapBatchSize).Find(&versions).Error
+		if err != nil {
+			return keyID, rewrapped, fmt.Errorf("error listing version keys to re-wrap: %w", err)
+		}
+		if len(versions) == 0 {
+			break
+		}
+		for _, version := range versions {
+			lastVersionID = version.ID
+			err := e.rewrap(version.FileEncryption, e.db.Model(&models.FileVersion{}).Where("id = ?", version.ID))
+			if e.countRewrap(err, zap.String("fileID", version.FileID), zap.Uint("versionRowID", version.ID)) {
+				rewrapped++
+			}
+		}
+	}
+
+	e.logger.Info("Data keys re-wrapped", zap.String("company", company), zap.String("keyID", keyID), zap.Int("rewrapped", rewrapped))
+	return keyID, rewrapped, nil
+}
+
+// rewrap wraps the data key of encryption with the current KEK and saves it
+// in the row selected by row, unless the envelope changed since it was read
+func (e *FileEncryptor) rewrap(encryption models.FileEncryption, row *gorm.DB) error {
+	ctx := context.Background()
+	dataKey, err := e.provider.UnwrapKey(ctx, encryption.KeyCompany, encryption.KeyID, encryption.WrappedKey)
+	if err != nil {
+		return err
+	}
+	wrapped, keyID, err := e.provider.WrapKey(ctx, encryption.KeyCompany, dataKey)
+	if err != nil {
+		return err
+	}
+	return row.Where("key_id = ?", encryption.KeyID).
+		Updates(map[string]interface{}{"wrapped_key": wrapped, "key_id": keyID}).Error
+}
+
+// countRewrap records the outcome of a re-wrap and reports whether it succeeded
+func (e *FileEncryptor) countRewrap(err error, fields ...zap.Field) bool {
+	if err != nil {
+		rewrappedKeysCounter.WithLabelValues("failed").Inc()
+		e.logger.Error("Failed to re-wrap data key", append(fields, zap.Error(err))...)
+		return false
+	}
+	rewrappedKeysCounter.WithLabelValues("rewrapped").Inc()
+	return true
+}
@@ -0,0 +1,254 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"testing"
+
+	"file-service/internal/models"
+
+	"go.uber.org/zap"
+)
+
+// newTestEncryption returns a storage service on the memory driver encrypting
+// with KEKs of a temporary directory
+func newTestEncryption(t *testing.T) (*StorageService, *LocalKeyProvider) {
+	t.Helper()
+	provider, err := NewLocalKeyProvider(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := NewObjectLayout(nil, ObjectLayoutFlat, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := NewFileEncryptor(nil, provider, zap.NewNop())
+	return NewStorageService(NewMemoryStorage(), layout, encryptor, zap.NewNop()), provider
+}
+
+// testEnvelope builds an envelope like FileEncryptor.newEnvelope for a user
+// outside any company, which needs no database
+func testEnvelope(t *testing.T, provider KeyProvider) (cipher.AEAD, models.FileEncryption) {
+	t.Helper()
+	dataKey := make([]byte, dataKeySize)
+	nonce := make([]byte, 12)
+	rand.Read(dataKey)
+	rand.Read(nonce)
+
+	wrapped, keyID, err := provider.WrapKey(context.Background(), "", dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newSegmentCipher(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead, models.FileEncryption{WrappedKey: wrapped, KeyID: keyID, Nonce: nonce}
+}
+
+// sealContent encrypts plaintext like UploadFile and returns the bytes it
+// stores
+func sealContent(t *testing.T, plaintext []byte, aead cipher.AEAD, nonce []byte) []byte {
+	t.Helper()
+	sealed, err := io.ReadAll(newEncryptingReader(bytes.NewReader(plaintext), aead, nonce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(sealed)) != EncryptedSize(int64(len(plaintext))) {
+		t.Fatalf("sealed %d bytes into %d, EncryptedSize says %d", len(plaintext), len(sealed), EncryptedSize(int64(len(plaintext))))
+	}
+	return sealed
+}
+
+func putObject(t *testing.T, storage *StorageService, key string, content []byte) string {
+	t.Helper()
+	info, err := storage.backend.Put(context.Background(), key, bytes.NewReader(content), int64(len(content)), "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.VersionID
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	storage, provider := newTestEncryption(t)
+	random := mathrand.New(mathrand.NewSource(1))
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"segment minus one", encryptionSegmentSize - 1},
+		{"one segment", encryptionSegmentSize},
+		{"segment plus one", encryptionSegmentSize + 1},
+		{"several segments", 3*encryptionSegmentSize + 17},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := make([]byte, tt.size)
+			random.Read(plaintext)
+			aead, envelope := testEnvelope(t, provider)
+			sealed := sealContent(t, plaintext, aead, envelope.Nonce)
+			if tt.size > 0 && bytes.Contains(sealed, plaintext) {
+				t.Fatal("stored content holds the plaintext")
+			}
+			versionID := putObject(t, storage, tt.name, sealed)
+
+			object, info, err := storage.GetFileVersion(models.ObjectLocation{ObjectKey: tt.name}, versionID, envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer object.Close()
+			if info.Size != int64(tt.size) {
+				t.Errorf("size = %d, want %d", info.Size, tt.size)
+			}
+
+			got, err := io.ReadAll(object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatal("decrypted content differs from the plaintext")
+			}
+
+			// Ranges crossing segment boundaries decrypt only what they cover
+			for _, r := range [][2]int{{0, 1}, {tt.size / 2, tt.size}, {encryptionSegmentSize - 3, encryptionSegmentSize + 3}, {tt.size - 1, tt.size}} {
+				start, end := max(r[0], 0), min(r[1], tt.size)
+				if start >= end {
+					continue
+				}
+				buf := make([]byte, end-start)
+				if _, err := object.ReadAt(buf, int64(start)); err != nil && err != io.EOF {
+					t.Fatalf("ReadAt(%d, %d): %v", start, end, err)
+				}
+				if !bytes.Equal(buf, plaintext[start:end]) {
+					t.Errorf("ReadAt(%d, %d) differs from the plaintext", start, end)
+				}
+			}
+
+			if tt.size > 0 {
+				if _, err := object.Seek(-1, io.SeekEnd); err != nil {
+					t.Fatal(err)
+				}
+				last, err := io.ReadAll(object)
+				if err != nil || !bytes.Equal(last, plaintext[tt.size-1:]) {
+					t.Errorf("reading after Seek(-1, end) = %v, %v", last, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptionDetectsTampering(t *testing.T) {
+	storage, provider := newTestEncryption(t)
+	plaintext := make([]byte, 3*encryptionSegmentSize+100)
+	mathrand.New(mathrand.NewSource(2)).Read(plaintext)
+	aead, envelope := testEnvelope(t, provider)
+	sealed := sealContent(t, plaintext, aead, envelope.Nonce)
+
+	flipped := bytes.Clone(sealed)
+	flipped[encryptedSegmentSize+10] ^= 1
+	swapped := bytes.Clone(sealed)
+	copy(swapped[:encryptedSegmentSize], sealed[encryptedSegmentSize:2*encryptedSegmentSize])
+	copy(swapped[encryptedSegmentSize:2*encryptedSegmentSize], sealed[:encryptedSegmentSize])
+	_, other := testEnvelope(t, provider)
+
+	tests := []struct {
+		name     string
+		stored   []byte
+		envelope models.FileEncryption
+	}{
+		{"flipped bit", flipped, envelope},
+		{"swapped segments", swapped, envelope},
+		{"truncated at a segment boundary", sealed[:2*encryptedSegmentSize], envelope},
+		{"truncated inside a tag", sealed[:encryptedSegmentSize+5], envelope},
+		{"data key of another version", sealed, other},
+		{"nonce of another version", sealed, models.FileEncryption{WrappedKey: envelope.WrappedKey, KeyID: envelope.KeyID, Nonce: other.Nonce}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versionID := putObject(t, storage, "tampered", tt.stored)
+			object, _, err := storage.GetFileVersion(models.ObjectLocation{ObjectKey: "tampered"}, versionID, tt.envelope)
+			if err == nil {
+				defer object.Close()
+				_, err = io.ReadAll(object)
+			}
+			if !errors.Is(err, ErrDecryptionFailed) {
+				t.Errorf("reading = %v, want ErrDecryptionFailed", err)
+			}
+		})
+	}
+}
+
+func TestEncryptedVersionWithoutEncryptor(t *testing.T) {
+	_, provider := newTestEncryption(t)
+	aead, envelope := testEnvelope(t, provider)
+	sealed := sealContent(t, []byte("secret"), aead, envelope.Nonce)
+
+	plain := newMemoryStorageService(t)
+	versionID := putObject(t, plain, "file", sealed)
+	if _, _, err := plain.GetFileVersion(models.ObjectLocation{ObjectKey: "file"}, versionID, envelope); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("GetFileVersion = %v, want ErrDecryptionFailed", err)
+	}
+}
+
+func TestLocalKeyProviderRotation(t *testing.T) {
+	ctx := context.Background()
+	provider, err := NewLocalKeyProvider(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	company := "5b0d6a52-4c1e-4a57-9a43-0c5e3f9d2f10"
+	dataKey := bytes.Repeat([]byte{7}, dataKeySize)
+
+	wrapped, keyID, err := provider.WrapKey(ctx, company, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := provider.RotateKey(ctx, company)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated == keyID {
+		t.Fatalf("rotation kept KEK %s current", keyID)
+	}
+	rewrapped, newKeyID, err := provider.WrapKey(ctx, company, dataKey)
+	if err != nil || newKeyID != rotated {
+		t.Fatalf("WrapKey after rotation = %s, %v, want KEK %s", newKeyID, err, rotated)
+	}
+
+	tests := []struct {
+		name    string
+		company string
+		keyID   string
+		wrapped []byte
+		wantErr bool
+	}{
+		{"previous KEK", company, keyID, wrapped, false},
+		{"current KEK", company, rotated, rewrapped, false},
+		{"wrong KEK", company, rotated, wrapped, true},
+		{"other company", "", keyID, wrapped, true},
+		{"unknown KEK", company, "99", wrapped, true},
+		{"invalid company", "../keys", keyID, wrapped, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := provider.UnwrapKey(ctx, tt.company, tt.keyID, tt.wrapped)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("UnwrapKey succeeded")
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, dataKey) {
+				t.Errorf("UnwrapKey = %x, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"file-service/internal/models"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort key")
+)
+
+// Page sizes of the file listing
+const (
+	DefaultFileListLimit = 50
+	MaxFileListLimit     = 200
+)
+
+// fileSortColumns maps the sort keys accepted by the listing to their column
+var fileSortColumns = map[string]string{
+	"name":    "file_name",
+	"size":    "size",
+	"created": "created_at",
+	"version": "version",
+}
+
+// FileListQuery selects one page of the files of a folder
+type FileListQuery struct {
+	OwnerID       string    // Owner of the files
+	FolderID      string    // Folder being listed, empty for the root
+	Sort          string    // One of name, size, created or version
+	Descending    bool      // Sort order
+	ContentType   string    // Exact MIME type, or a "type/*" family
+	CreatedAfter  time.Time // Inclusive lower bound, ignored when zero
+	CreatedBefore time.Time // Exclusive upper bound, ignored when zero
+	NamePrefix    string    // Case sensitive prefix of the file name
+	Cursor        string    // Opaque cursor returned with the previous page
+	Limit         int       // Page size
+}
+
+// fileCursor is the position after the last file of a page. The sort it was
+// issued for is kept so that it cannot be replayed against another order.
+type fileCursor struct {
+	Sort   string `json:"s"`
+	Desc   bool   `json:"d"`
+	Value  string `json:"v"`
+	FileID string `json:"id"`
+}
+
+func encodeFileCursor(cursor fileCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeFileCursor(encoded string) (*fileCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor fileCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil || cursor.FileID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// sortValue returns the value of the sort key of file, as stored in a cursor
+func sortValue(file *models.FileMetadata, sort string) string {
+	switch sort {
+	case "size":
+		return strconv.FormatInt(file.Size, 10)
+	case "created":
+		return file.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "version":
+		return strconv.Itoa(file.Version)
+	default:
+		return file.FileName
+	}
+}
+
+// parseSortValue converts a cursor value back to the type of its column
+func parseSortValue(sort, value string) (interface{}, error) {
+	switch sort {
+	case "size":
+		return strconv.ParseInt(value, 10, 64)
+	case "created":
+		return time.Parse(time.RFC3339Nano, value)
+	case "version":
+		return strconv.Atoi(value)
+	default:
+		return value, nil
+	}
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ListFiles returns one page of files matching query, and the cursor of the
+// next page, empty on the last one. Pages are read with keyset pagination on
+// the sort column and the file ID, so their cost does not grow with the offset.
+func (m *MetadataService) ListFiles(query FileListQuery) ([]models.FileMetadata, string, error) {
+	if query.Sort == "" {
+		query.Sort = "name"
+	}
+	column, ok := fileSortColumns[query.Sort]
+	if !ok {
+		return nil, "", ErrInvalidSort
+	}
+	if query.Limit <= 0 || query.Limit > MaxFileListLimit {
+		query.Limit = DefaultFileListLimit
+	}
+
+	db := m.db.Where("user_id = ?", query.OwnerID)
+	if query.FolderID == "" {
+		db = db.Where("folder_id IS NULL")
+	} else {
+		db = db.Where("folder_id = ?", query.FolderID)
+	}
+
+	if family, ok := strings.CutSuffix(query.ContentType, "/*"); ok {
+		db = db.Where("content_type LIKE ?", escapeLike(family)+"/%")
+	} else if query.ContentType != "" {
+		db = db.Where("content_type = ?", query.ContentType)
+	}
+	if !query.CreatedAfter.IsZero() {
+		db = db.Where("created_at >= ?", query.CreatedAfter)
+	}
+	if !query.CreatedBefore.IsZero() {
+		db = db.Where("created_at < ?", query.CreatedBefore)
+	}
+	if query.NamePrefix != "" {
+		db = db.Where("file_name LIKE ?", escapeLike(query.NamePrefix)+"%")
+	}
+
+	direction, comparison := "ASC", ">"
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if query.Cursor != "" {
+		cursor, err := decodeFileCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if cursor.Sort != query.Sort || cursor.Desc != query.Descending {
+			return nil, "", ErrInvalidCursor
+		}
+		value, err := parseSortValue(cursor.Sort, cursor.Value)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		db = db.Where(fmt.Sprintf("(%s, file_id) %s (?, ?)", column, comparison), value, cursor.FileID)
+	}
+
+	var files []models.FileMetadata
+	err := db.Order(fmt.Sprintf("%s %s, file_id %s", column, direction, direction)).
+		Limit(query.Limit + 1).
+		Find(&files).Error
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing files: %w", err)
+	}
+
+	if len(files) <= query.Limit {
+		return files, "", nil
+	}
+	files = files[:query.Limit]
+	last := &files[len(files)-1]
+	return files, encodeFileCursor(fileCursor{
+		Sort:   query.Sort,
+		Desc:   query.Descending,
+		Value:  sortValue(last, query.Sort),
+		FileID: last.FileID,
+	}), nil
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"file-service/internal/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileCursorRoundTrip(t *testing.T) {
+	created := time.Date(2024, 3, 9, 17, 4, 5, 123456789, time.FixedZone("CET", 3600))
+	file := &models.FileMetadata{
+		FileID:   "4b7c1d0e-2f5a-4c9b-8e3d-1a2b3c4d5e6f",
+		FileName: "report 2024_%.pdf",
+		Size:     1<<40 + 7,
+		Version:  12,
+	}
+	file.CreatedAt = created
+
+	tests := []struct {
+		sort string
+		want interface{}
+	}{
+		{"name", file.FileName},
+		{"size", file.Size},
+		{"created", created.UTC()},
+		{"version", file.Version},
+	}
+	for _, tt := range tests {
+		for _, desc := range []bool{false, true} {
+			cursor := fileCursor{Sort: tt.sort, Desc: desc, Value: sortValue(file, tt.sort), FileID: file.FileID}
+			decoded, err := decodeFileCursor(encodeFileCursor(cursor))
+			if err != nil {
+				t.Fatalf("decoding the %s cursor: %v", tt.sort, err)
+			}
+			if *decoded != cursor {
+				t.Errorf("%s cursor decoded to %+v, want %+v", tt.sort, *decoded, cursor)
+			}
+
+			value, err := parseSortValue(decoded.Sort, decoded.Value)
+			if err != nil {
+				t.Fatalf("parsing the %s value %q: %v", tt.sort, decoded.Value, err)
+			}
+			if got, ok := value.(time.Time); ok {
+				if !got.Equal(tt.want.(time.Time)) {
+					t.Errorf("created value = %v, want %v", got, tt.want)
+				}
+			} else if !reflect.DeepEqual(value, tt.want) {
+				t.Errorf("%s value = %#v, want %#v", tt.sort, value, tt.want)
+			}
+		}
+	}
+}
+
+func TestDecodeFileCursorInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"not base64", "not a cursor!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"s":"name","v":"a","id":"x"}`))},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("name:a:x"))},
+		{"no file ID", base64.RawURLEncoding.EncodeToString([]byte(`{"s":"name","v":"a"}`))},
+		{"wrong types", base64.RawURLEncoding.EncodeToString([]byte(`{"s":1,"d":"yes","v":"a","id":"x"}`))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeFileCursor(tt.encoded); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("decodeFileCursor(%q) = %v, want ErrInvalidCursor", tt.encoded, err)
+			}
+		})
+	}
+}
+
+func TestParseSortValueInvalid(t *testing.T) {
+	tests := []struct {
+		sort  string
+		value string
+	}{
+		{"size", "ten"},
+		{"size", "1.5"},
+		{"created", "2024-03-09"},
+		{"version", "v2"},
+	}
+	for _, tt := range tests {
+		if _, err := parseSortValue(tt.sort, tt.value); err == nil {
+			t.Errorf("parseSortValue(%q, %q) succeeded", tt.sort, tt.value)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"report", "report"},
+		{"100%", `100\%`},
+		{"a_b", `a\_b`},
+		{`c:\tmp`, `c:\\tmp`},
+		{`%_\`, `\%\_\\`},
+	}
+	for _, tt := range tests {
+		if got := escapeLike(tt.in); got != tt.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
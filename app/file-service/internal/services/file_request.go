@@ -0,0 +1,160 @@
+package services
+
+import (
+	"errors"
+	"file-service/internal/models"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrFileRequestNotFound = errors.New("file request not found")
+	ErrFileRequestExpired  = errors.New("file request expired")
+	ErrFileRequestRevoked  = errors.New("file request closed by its owner")
+	ErrFileRequestFull     = errors.New("file request reached its file limit")
+)
+
+// FileRequestService manages the upload-only links that collect files from
+// people without an account
+type FileRequestService struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+func NewFileRequestService(db *gorm.DB, log *zap.Logger) *FileRequestService {
+	return &FileRequestService{db: db, logger: log}
+}
+
+// CreateRequest creates a request collecting files into folderID, which must
+// belong to ownerID, and returns it with its token. maxFiles 0 means unlimited.
+func (s *FileRequestService) CreateRequest(ownerID, folderID, title, message string, expiresAt time.Time, maxFiles int) (*models.FileRequest, string, error) {
+	if _, err := findOwnedFolder(s.db, ownerID, folderID); err != nil {
+		return nil, "", err
+	}
+
+	token, tokenHash, err := newLinkToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	request := models.FileRequest{
+		TokenHash: tokenHash,
+		OwnerID:   ownerID,
+		FolderID:  folderID,
+		Title:     title,
+		Message:   message,
+		ExpiresAt: expiresAt,
+		MaxFiles:  maxFiles,
+	}
+	if err := s.db.Create(&request).Error; err != nil {
+		s.logger.Error("Failed to create file request", zap.String("FolderID", folderID), zap.Error(err))
+		return nil, "", err
+	}
+
+	s.logger.Info("File request created",
+		zap.Uint("RequestID", request.ID),
+		zap.String("OwnerID", ownerID),
+		zap.String("FolderID", folderID),
+		zap.Time("ExpiresAt", expiresAt),
+		zap.Int("MaxFiles", maxFiles),
+	)
+	return &request, token, nil
+}
+
+// ListRequests returns the file requests of ownerID, newest first
+func (s *FileRequestService) ListRequests(ownerID string) ([]models.FileRequest, error) {
+	var requests []models.FileRequest
+	err := s.db.Where("owner_id = ?", ownerID).Order("created_at DESC, id DESC").Find(&requests).Error
+	return requests, err
+}
+
+// RevokeRequest closes a file request of ownerID for good. It returns
+// ErrFileRequestNotFound when the owner has no such open request.
+func (s *FileRequestService) RevokeRequest(ownerID string, requestID uint) error {
+	result := s.db.Model(&models.FileRequest{}).
+		Where("id = ? AND owner_id = ? AND revoked_at IS NULL", requestID, ownerID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrFileRequestNotFound
+	}
+
+	s.logger.Info("File request revoked", zap.String("OwnerID", ownerID), zap.Uint("RequestID", requestID))
+	return nil
+}
+
+// ListUploads returns the files received through a file request of ownerID,
+// newest first
+func (s *FileRequestService) ListUploads(ownerID string, requestID uint) ([]models.FileRequestUpload, error) {
+	var count int64
+	if err := s.db.Model(&models.FileRequest{}).Where("id = ? AND owner_id = ?", requestID, ownerID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrFileRequestNotFound
+	}
+
+	var uploads []models.FileRequestUpload
+	err := s.db.Where("request_id = ?", requestID).Order("uploaded_at DESC, id DESC").Find(&uploads).Error
+	return uploads, err
+}
+
+// ResolveRequest returns the file request of token. Unknown tokens give
+// ErrFileRequestNotFound; the request is also returned with
+// ErrFileRequestRevoked, ErrFileRequestExpired or ErrFileRequestFull.
+func (s *FileRequestService) ResolveRequest(token string) (*models.FileRequest, error) {
+	var request models.FileRequest
+	err := s.db.Where("token_hash = ?", hashLinkToken(token)).First(&request).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrFileRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case request.RevokedAt != nil:
+		return &request, ErrFileRequestRevoked
+	case !time.Now().Before(request.ExpiresAt):
+		return &request, ErrFileRequestExpired
+	case request.MaxFiles > 0 && request.FileCount >= request.MaxFiles:
+		return &request, ErrFileRequestFull
+	}
+	return &request, nil
+}
+
+// ReserveUploads takes count slots of a file request. The check and the
+// increment are a single statement, so concurrent uploads cannot exceed the
+// limit. It returns ErrFileRequestFull when the slots are not available anymore.
+func (s *FileRequestService) ReserveUploads(requestID uint, count int) error {
+	result := s.db.Model(&models.FileRequest{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ? AND (max_files = 0 OR file_count + ? <= max_files)", requestID, time.Now(), count).
+		Update("file_count", gorm.Expr("file_count + ?", count))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrFileRequestFull
+	}
+	return nil
+}
+
+// ReleaseUploads gives back slots reserved for files that could not be saved
+func (s *FileRequestService) ReleaseUploads(requestID uint, count int) error {
+	return s.db.Model(&models.FileRequest{}).
+		Where("id = ?", requestID).
+		Update("file_count", gorm.Expr("GREATEST(file_count - ?, 0)", count)).Error
+}
+
+// RecordUpload tags a file received through a file request with its uploader
+func (s *FileRequestService) RecordUpload(upload *models.FileRequestUpload) error {
+	if err := s.db.Create(upload).Error; err != nil {
+		s.logger.Error("Failed to record file request upload", zap.Uint("RequestID", upload.RequestID), zap.String("FileID", upload.FileID), zap.Error(err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,411 @@
+package services
+
+import (
+	"errors"
+	"file-service/internal/models"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrFolderNotFound        = errors.New("folder not found")
+	ErrFolderNameTaken       = errors.New("a folder with this name already exists here")
+	ErrInvalidFolderName     = errors.New("invalid folder name")
+	ErrFolderCycle           = errors.New("a folder cannot be moved into itself or one of its subfolders")
+	ErrFolderNotEmpty        = errors.New("folder is not empty")
+	ErrFolderCompanyMismatch = errors.New("folder belongs to another company")
+)
+
+// maxFolderNameLength bounds the length of a folder name, in bytes
+const maxFolderNameLength = 255
+
+// FolderService manages the folder tree of every user. Mutations of a tree are
+// serialized per owner, so cycle and name checks cannot race with each other.
+type FolderService struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+func NewFolderService(db *gorm.DB, log *zap.Logger) *FolderService {
+	return &FolderService{db: db, logger: log}
+}
+
+// lockFolderTree takes a transaction scoped lock on the folder tree of ownerID
+func lockFolderTree(tx *gorm.DB, ownerID string) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "folders:"+ownerID).Error
+}
+
+// validFolderName reports whether name can be used as a folder name
+func validFolderName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		len(name) <= maxFolderNameLength &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+// findOwnedFolder loads a folder of ownerID, or returns ErrFolderNotFound
+func findOwnedFolder(tx *gorm.DB, ownerID, folderID string) (*models.Folder, error) {
+	if _, err := uuid.Parse(folderID); err != nil {
+		return nil, ErrFolderNotFound
+	}
+
+	var folder models.Folder
+	err := tx.Where("id = ? AND owner_id = ?", folderID, ownerID).First(&folder).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrFolderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+// checkSiblingName returns ErrFolderNameTaken when parentID already holds a
+// folder named name, other than the folder exceptID
+func checkSiblingName(tx *gorm.DB, ownerID string, parentID *string, name, exceptID string) error {
+	query := tx.Model(&models.Folder{}).Where("owner_id = ? AND name = ? AND id <> ?", ownerID, name, exceptID)
+	if parentID == nil {
+		query = query.Where("parent_id IS NULL")
+	} else {
+		query = query.Where("parent_id = ?", *parentID)
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrFolderNameTaken
+	}
+	return nil
+}
+
+// GetFolder returns a folder, or ErrFolderNotFound
+func (f *FolderService) GetFolder(folderID string) (*models.Folder, error) {
+	if _, err := uuid.Parse(folderID); err != nil {
+		return nil, ErrFolderNotFound
+	}
+
+	var folder models.Folder
+	err := f.db.Where("id = ?", folderID).First(&folder).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrFolderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+// GetOwnedFolder returns a folder of ownerID, or ErrFolderNotFound
+func (f *FolderService) GetOwnedFolder(ownerID, folderID string) (*models.Folder, error) {
+	return findOwnedFolder(f.db, ownerID, folderID)
+}
+
+// CreateFolder creates a folder named name under parentID, or at the root when
+// parentID is empty. Subfolders inherit the company of their parent, companyID
+// only scopes top-level folders.
+func (f *FolderService) CreateFolder(ownerID, name, parentID, companyID string) (*models.Folder, error) {
+	name = strings.TrimSpace(name)
+	if !validFolderName(name) {
+		return nil, ErrInvalidFolderName
+	}
+
+	folder := models.Folder{
+		ID:      uuid.New().String(),
+		Name:    name,
+		OwnerID: ownerID,
+	}
+	if companyID != "" {
+		folder.CompanyID = &companyID
+	}
+
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockFolderTree(tx, ownerID); err != nil {
+			return err
+		}
+
+		folder.Path = "/" + folder.ID + "/"
+		if parentID != "" {
+			parent, err := findOwnedFolder(tx, ownerID, parentID)
+			if err != nil {
+				return err
+			}
+			if companyID != "" && (parent.CompanyID == nil || *parent.CompanyID != companyID) {
+				return ErrFolderCompanyMismatch
+			}
+			folder.ParentID = &parent.ID
+			folder.CompanyID = parent.CompanyID
+			folder.Path = parent.Path + folder.ID + "/"
+		}
+
+		if err := checkSiblingName(tx, ownerID, folder.ParentID, name, folder.ID); err != nil {
+			return err
+		}
+		return tx.Create(&folder).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f.logger.Info("Folder created", zap.String("FolderID", folder.ID), zap.String("OwnerID", ownerID), zap.String("Path", folder.Path))
+	return &folder, nil
+}
+
+// RenameFolder changes the name of a folder. Paths are made of IDs, so the
+// descendants are left untouched.
+func (f *FolderService) RenameFolder(ownerID, folderID, name string) (*models.Folder, error) {
+	name = strings.TrimSpace(name)
+	if !validFolderName(name) {
+		return nil, ErrInvalidFolderName
+	}
+
+	var folder *models.Folder
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockFolderTree(tx, ownerID); err != nil {
+			return err
+		}
+
+		var err error
+		folder, err = findOwnedFolder(tx, ownerID, folderID)
+		if err != nil {
+			return err
+		}
+		if err := checkSiblingName(tx, ownerID, folder.ParentID, name, folder.ID); err != nil {
+			return err
+		}
+		if err := tx.Model(folder).Update("name", name).Error; err != nil {
+			return err
+		}
+		folder.Name = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+// MoveFolder moves a folder with its whole subtree under parentID, or to the
+// root when parentID is empty. Every descendant path is rewritten in the same
+// transaction; moving a folder below itself is refused with ErrFolderCycle.
+func (f *FolderService) MoveFolder(ownerID, folderID, parentID string) (*models.Folder, error) {
+	var folder *models.Folder
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockFolderTree(tx, ownerID); err != nil {
+			return err
+		}
+
+		var err error
+		folder, err = findOwnedFolder(tx, ownerID, folderID)
+		if err != nil {
+			return err
+		}
+
+		var newParentID *string
+		newPath := "/" + folder.ID + "/"
+		if parentID != "" {
+			parent, err := findOwnedFolder(tx, ownerID, parentID)
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(parent.Path, folder.Path) {
+				return ErrFolderCycle
+			}
+			if !sameCompany(parent.CompanyID, folder.CompanyID) {
+				return ErrFolderCompanyMismatch
+			}
+			newParentID = &parent.ID
+			newPath = parent.Path + folder.ID + "/"
+		}
+
+		if err := checkSiblingName(tx, ownerID, newParentID, folder.Name, folder.ID); err != nil {
+			return err
+		}
+
+		// Rewrite the path prefix of the folder and all of its descendants
+		err = tx.Model(&models.Folder{}).
+			Where("owner_id = ? AND path LIKE ?", ownerID, folder.Path+"%").
+			Update("path", gorm.Expr("? || substr(path, ?)", newPath, len(folder.Path)+1)).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(folder).Update("parent_id", newParentID).Error; err != nil {
+			return err
+		}
+
+		f.logger.Info("Folder moved",
+			zap.String("FolderID", folder.ID),
+			zap.String("OldPath", folder.Path),
+			zap.String("NewPath", newPath),
+		)
+		folder.ParentID = newParentID
+		folder.Path = newPath
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+func sameCompany(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// DeleteFolder deletes a folder. An empty folder is simply removed; otherwise
+// ErrFolderNotEmpty is returned unless recursive is set, in which case the
+// whole subtree is removed and its files are moved to the trash. trashFile runs
+// inside the transaction for every file, hides its object and returns the
+// delete marker version ID. It returns the number of trashed files.
+func (f *FolderService) DeleteFolder(ownerID, folderID string, recursive bool, trashFile func(file *models.FileMetadata) (string, error)) (int, error) {
+	var trashed int
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockFolderTree(tx, ownerID); err != nil {
+			return err
+		}
+
+		folder, err := findOwnedFolder(tx, ownerID, folderID)
+		if err != nil {
+			return err
+		}
+
+		// Lock the subtree so that no file can be added to it concurrently
+		var subtree []models.Folder
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("owner_id = ? AND path LIKE ?", ownerID, folder.Path+"%").
+			Find(&subtree).Error
+		if err != nil {
+			return err
+		}
+		folderIDs := make([]string, len(subtree))
+		for i, sub := range subtree {
+			folderIDs[i] = sub.ID
+		}
+
+		var files []models.FileMetadata
+		if err := tx.Where("folder_id IN ?", folderIDs).Find(&files).Error; err != nil {
+			return err
+		}
+		if !recursive && (len(subtree) > 1 || len(files) > 0) {
+			return ErrFolderNotEmpty
+		}
+
+		for _, file := range files {
+			markerVersionID, err := trashFile(&file)
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&file).Updates(map[string]interface{}{
+				"deleted_by":               ownerID,
+				"delete_marker_version_id": markerVersionID,
+			}).Error
+			if err != nil {
+				return err
+			}
+			if err := tx.Delete(&file).Error; err != nil {
+				return err
+			}
+			trashed++
+		}
+
+		// Trashed files are restored at the root once their folder is gone
+		err = tx.Unscoped().Model(&models.FileMetadata{}).
+			Where("folder_id IN ?", folderIDs).
+			Update("folder_id", nil).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("id IN ?", folderIDs).Delete(&models.Folder{}).Error; err != nil {
+			return err
+		}
+
+		f.logger.Info("Folder deleted",
+			zap.String("FolderID", folder.ID),
+			zap.String("OwnerID", ownerID),
+			zap.Int("FolderCount", len(subtree)),
+			zap.Int("TrashedFiles", trashed),
+		)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return trashed, nil
+}
+
+// MoveFile moves a file of userID into folderID, or to the root when folderID
+// is empty. It returns gorm.ErrRecordNotFound when the user has no such file.
+func (f *FolderService) MoveFile(userID, fileID, folderID string) (*models.FileMetadata, error) {
+	var file models.FileMetadata
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND file_id = ?", userID, fileID).
+			First(&file).Error
+		if err != nil {
+			return err
+		}
+
+		var target *string
+		if folderID != "" {
+			// Keep the folder from being deleted until the file is moved in
+			folder, err := findOwnedFolder(tx.Clauses(clause.Locking{Strength: "SHARE"}), userID, folderID)
+			if err != nil {
+				return err
+			}
+			target = &folder.ID
+		}
+
+		file.FolderID = target
+		return tx.Model(&file).Update("folder_id", target).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// ListSubfolders returns the subfolders of a folder whose name starts with
+// namePrefix, sorted by name. A nil folder lists the root of ownerID.
+func (f *FolderService) ListSubfolders(ownerID string, folder *models.Folder, namePrefix string) ([]models.Folder, error) {
+	query := f.db.Order("name")
+	if folder == nil {
+		query = query.Where("owner_id = ? AND parent_id IS NULL", ownerID)
+	} else {
+		query = query.Where("parent_id = ?", folder.ID)
+	}
+	if namePrefix != "" {
+		query = query.Where("name LIKE ?", escapeLike(namePrefix)+"%")
+	}
+
+	var subfolders []models.Folder
+	err := query.Find(&subfolders).Error
+	return subfolders, err
+}
+
+// Breadcrumbs returns the folders leading from the root down to folder
+func (f *FolderService) Breadcrumbs(folder *models.Folder) ([]models.Breadcrumb, error) {
+	ids := strings.Split(strings.Trim(folder.Path, "/"), "/")
+
+	var ancestors []models.Folder
+	if err := f.db.Where("id IN ?", ids).Find(&ancestors).Error; err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(ancestors))
+	for _, ancestor := range ancestors {
+		names[ancestor.ID] = ancestor.Name
+	}
+
+	breadcrumbs := make([]models.Breadcrumb, 0, len(ids))
+	for _, id := range ids {
+		breadcrumbs = append(breadcrumbs, models.Breadcrumb{ID: id, Name: names[id]})
+	}
+	return breadcrumbs, nil
+}
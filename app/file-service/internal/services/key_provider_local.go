@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var ErrUnknownKEK = errors.New("unknown key-encryption key")
+
+// defaultKeyCompany names the KEK directory of the users outside any company
+const defaultKeyCompany = "default"
+
+// LocalKeyProvider keeps the KEKs in files, one directory per company holding
+// "<n>.key" files of base64 encoded 32 bytes keys, the highest n being the
+// current KEK. A company gets its first KEK when it first needs one. It is
+// meant for development: the KEKs sit unprotected next to the data.
+type LocalKeyProvider struct {
+	dir  string
+	mu   sync.Mutex
+	keys map[string][]byte // KEKs already read, by "<company>/<keyID>"
+}
+
+func NewLocalKeyProvider(dir string) (*LocalKeyProvider, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating KEK directory: %w", err)
+	}
+	return &LocalKeyProvider{dir: dir, keys: make(map[string][]byte)}, nil
+}
+
+// companyDir returns the KEK directory of company, which must be a UUID
+func (p *LocalKeyProvider) companyDir(company string) (string, error) {
+	if company == "" {
+		return filepath.Join(p.dir, defaultKeyCompany), nil
+	}
+	if _, err := uuid.Parse(company); err != nil {
+		return "", fmt.Errorf("invalid company ID %q", company)
+	}
+	return filepath.Join(p.dir, company), nil
+}
+
+// currentKeyID returns the highest KEK number of company, 0 when it has none.
+// The caller must hold the mutex.
+func (p *LocalKeyProvider) currentKeyID(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for _, entry := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".key"))
+		if err == nil && strings.HasSuffix(entry.Name(), ".key") && n > current {
+			current = n
+		}
+	}
+	return current, nil
+}
+
+// createKey writes KEK number n of the company in dir. The caller must hold the mutex.
+func (p *LocalKeyProvider) createKey(dir string, n int) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	kek := make([]byte, dataKeySize)
+	if _, err := rand.Read(kek); err != nil {
+		return err
+	}
+	// O_EXCL: an existing KEK is never overwritten
+	file, err := os.OpenFile(filepath.Join(dir, strconv.Itoa(n)+".key"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(base64.StdEncoding.EncodeToString(kek)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// key returns a KEK of company. The caller must hold the mutex.
+func (p *LocalKeyProvider) key(company, dir, keyID string) (cipher.AEAD, error) {
+	cacheKey := company + "/" + keyID
+	kek, ok := p.keys[cacheKey]
+	if !ok {
+		if _, err := strconv.Atoi(keyID); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKEK, cacheKey)
+		}
+		encoded, err := os.ReadFile(filepath.Join(dir, keyID+".key"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKEK, cacheKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		kek, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || len(kek) != dataKeySize {
+			return nil, fmt.Errorf("invalid KEK %s", cacheKey)
+		}
+		p.keys[cacheKey] = kek
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapAAD binds a wrapped key to the KEK that wrapped it
+func wrapAAD(company, keyID string) []byte {
+	return []byte(company + "/" + keyID)
+}
+
+// WrapKey seals dataKey with the current KEK of company, creating the first
+// one if needed. The wrapped key is the nonce followed by the sealed key.
+func (p *LocalKeyProvider) WrapKey(ctx context.Context, company string, dataKey []byte) ([]byte, string, error) {
+	dir, err := p.companyDir(company)
+	if err != nil {
+		return nil, "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current, err := p.currentKeyID(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if current == 0 {
+		current = 1
+		if err := p.createKey(dir, current); err != nil {
+			return nil, "", fmt.Errorf("error creating the first KEK: %w", err)
+		}
+	}
+	keyID := strconv.Itoa(current)
+
+	aead, err := p.key(company, dir, keyID)
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, dataKey, wrapAAD(company, keyID)), keyID, nil
+}
+
+func (p *LocalKeyProvider) UnwrapKey(ctx context.Context, company, keyID string, wrapped []byte) ([]byte, error) {
+	dir, err := p.companyDir(company)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	aead, err := p.key(company, dir, keyID)
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, wrapAAD(company, keyID))
+}
+
+func (p *LocalKeyProvider) RotateKey(ctx context.Context, company string) (string, error) {
+	dir, err := p.companyDir(company)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current, err := p.currentKeyID(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := p.createKey(dir, current+1); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(current + 1), nil
+}
@@ -1,13 +1,16 @@
 package services
 
 import (
+	"errors"
 	"file-service/internal/models"
 
-	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var ErrLastFileVersion = errors.New("cannot delete the only version of a file")
+
 type MetadataService struct {
 	db     *gorm.DB
 	logger *zap.Logger
@@ -17,16 +20,23 @@ func NewMetadataService(db *gorm.DB, log *zap.Logger) *MetadataService {
 	return &MetadataService{db: db, logger: log}
 }
 
-// SaveFileMetadata saves the file metadata using GORM
-func (m *MetadataService) SaveFileMetadata(userID string, fileID string, fileName string, fileVersion string, size int64) error {
+// SaveFileMetadata saves the metadata of a new file along with its first version,
+// whose object was stored at location. The file is stored in folderID, which must belong to userID, or at the root
+// when folderID is empty. It returns ErrFolderNotFound for an unknown folder.
+func (m *MetadataService) SaveFileMetadata(userID string, fileID string, fileName string, fileVersion string, size int64, checksum string, contentType string, encryption models.FileEncryption, location models.ObjectLocation, folderID string) error {
 	metadata := models.FileMetadata{
-		UserID:       userID,
-		FileID:       fileID,
-		ParentFileID: uuid.NewString(),
-		VersionID:    fileVersion,
-		FileName:     fileName,
-		Size:         size,
-		ContentType:  "application/octet-stream",
+		UserID:      userID,
+		FileID:      fileID,
+		Version:     1,
+		VersionID:   fileVersion,
+		CreatedBy:   userID,
+		FileName:    fileName,
+		Size:        size,
+		ContentType: contentType,
+		SHA256:      checksum,
+
+		FileEncryption: encryption,
+		ObjectLocation: location,
 	}
 
 	m.logger.Info("File metadata logged",
@@ -37,53 +47,239 @@ func (m *MetadataService) SaveFileMetadata(userID string, fileID string, fileNam
 		zap.String("FileName", metadata.FileName),
 		zap.Int64("Size", metadata.Size),
 		zap.String("ContentType", metadata.ContentType),
+		zap.String("SHA256", metadata.SHA256),
 	)
 
-	if err := m.db.Create(&metadata).Error; err != nil {
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if folderID != "" {
+			// Keep the folder from being deleted until the file is created in it
+			folder, err := findOwnedFolder(tx.Clauses(clause.Locking{Strength: "SHARE"}), userID, folderID)
+			if err != nil {
+				return err
+			}
+			metadata.FolderID = &folder.ID
+		}
+
+		if err := tx.Create(&metadata).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.FileVersion{
+			FileID:    fileID,
+			Version:   1,
+			VersionID: fileVersion,
+			Size:      size,
+			SHA256:    checksum,
+			CreatedBy: userID,
+
+			ContentType:    contentType,
+			FileEncryption: encryption,
+		}).Error
+	})
+	if err != nil {
 		m.logger.Error("Failed to save metadata", zap.Error(err))
 		return err
 	}
 	return nil
 }
 
+// AddFileVersion records a new version of an existing file and makes it the
+// current one. The file row is locked so concurrent uploads get distinct numbers.
+// An empty contentType keeps the content type of the file.
+func (m *MetadataService) AddFileVersion(fileID string, userID string, fileVersion string, size int64, checksum string, contentType string, encryption models.FileEncryption) (*models.FileVersion, error) {
+	var version models.FileVersion
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		var metadata models.FileMetadata
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("file_id = ?", fileID).First(&metadata).Error; err != nil {
+			return err
+		}
+
+		version = models.FileVersion{
+			FileID:    fileID,
+			Version:   metadata.Version + 1,
+			VersionID: fileVersion,
+			Size:      size,
+			SHA256:    checksum,
+			CreatedBy: userID,
+
+			ContentType:    contentType,
+			FileEncryption: encryption,
+		}
+		if err := tx.Create(&version).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{
+			"version":    version.Version,
+			"version_id": version.VersionID,
+			"size":       version.Size,
+			"sha256":     version.SHA256,
+			// The file row carries the envelope of its current version
+			"wrapped_key": encryption.WrappedKey,
+			"key_company": encryption.KeyCompany,
+			"key_id":      encryption.KeyID,
+			"nonce":       encryption.Nonce,
+		}
+		if contentType != "" {
+			updates["content_type"] = contentType
+		}
+		return tx.Model(&metadata).Updates(updates).Error
+	})
+	if err != nil {
+		m.logger.Error("Failed to save file version", zap.String("FileID", fileID), zap.Error(err))
+		return nil, err
+	}
+
+	m.logger.Info("File version saved",
+		zap.String("FileID", fileID),
+		zap.Int("Version", version.Version),
+		zap.String("VersionID", version.VersionID),
+		zap.String("CreatedBy", userID),
+	)
+	return &version, nil
+}
+
+// GetFileVersions returns the versions of a file, newest first
+func (m *MetadataService) GetFileVersions(fileID string) ([]models.FileVersion, error) {
+	var versions []models.FileVersion
+	err := m.db.Where("file_id = ?", fileID).Order("version DESC").Find(&versions).Error
+	return versions, err
+}
+
+// GetFileVersion returns one version of a file, or gorm.ErrRecordNotFound
+func (m *MetadataService) GetFileVersion(fileID string, version int) (*models.FileVersion, error) {
+	var fileVersion models.FileVersion
+	if err := m.db.Where("file_id = ? AND version = ?", fileID, version).First(&fileVersion).Error; err != nil {
+		return nil, err
+	}
+	return &fileVersion, nil
+}
+
+// GetFileByID returns the metadata of a file, or gorm.ErrRecordNotFound
+func (ms *MetadataService) GetFileByID(fileID string) (*models.FileMetadata, error) {
+	var file models.FileMetadata
+	if err := ms.db.Where("file_id = ?", fileID).First(&file).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
 func (ms *MetadataService) GetFilesByUserID(userID string) ([]models.FileMetadata, error) {
 	var files []models.FileMetadata
 	err := ms.db.Where("user_id = ?", userID).Find(&files).Error
 	return files, err
 }
 
-func (m *MetadataService) DeleteFileMetadata(userID string, fileID string, fileVersion string) error {
-	// Query the existing file metadata from the database
-	var metadata models.FileMetadata
-	//if err := m.db.Where("user_id = ? AND file_id = ? AND version_id = ?", userID, fileID, fileVersion).First(&metadata).Error; err != nil {
-	if err := m.db.Where("user_id = ? AND file_id = ?", userID, fileID).First(&metadata).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			m.logger.Warn("Metadata not found for file",
-				zap.String("FileID", fileID),
-				zap.String("UserID", userID),
-				zap.String("VersionID", fileVersion),
-			)
-			return nil // Return nil if the record doesn't exist
-		}
-		m.logger.Error("Failed to retrieve metadata", zap.Error(err))
-		return err
-	}
+// TrashFile soft deletes a file, moving it to the trash with its version
+// history. storageOp hides the object and returns the delete marker version ID
+// needed to restore it. It runs inside the transaction: when it fails nothing
+// is deleted, so metadata and storage stay consistent. It returns
+// gorm.ErrRecordNotFound when the user has no such file.
+func (m *MetadataService) TrashFile(userID string, fileID string, storageOp func() (string, error)) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		// Query the existing file metadata from the database
+		var metadata models.FileMetadata
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ? AND file_id = ?", userID, fileID).First(&metadata).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				m.logger.Warn("Metadata not found for file",
+					zap.String("FileID", fileID),
+					zap.String("UserID", userID),
+				)
+				return err
+			}
+			m.logger.Error("Failed to retrieve metadata", zap.Error(err))
+			return err
+		}
 
-	// Log the metadata before deleting
-	m.logger.Info("Deleting file metadata",
-		zap.String("FileID", metadata.FileID),
-		zap.String("UserID", metadata.UserID),
-		zap.String("ParentFileID", metadata.ParentFileID),
-		zap.String("VersionID", metadata.VersionID),
-		zap.String("FileName", metadata.FileName),
-		zap.Int64("Size", metadata.Size),
-		zap.String("ContentType", metadata.ContentType),
-	)
+		// Log the metadata before deleting
+		m.logger.Info("Moving file to the trash",
+			zap.String("FileID", metadata.FileID),
+			zap.String("UserID", metadata.UserID),
+			zap.String("VersionID", metadata.VersionID),
+			zap.String("FileName", metadata.FileName),
+			zap.Int64("Size", metadata.Size),
+			zap.String("ContentType", metadata.ContentType),
+		)
 
-	// Delete the file metadata
-	if err := m.db.Delete(&metadata).Error; err != nil {
-		m.logger.Error("Failed to delete metadata", zap.Error(err))
-		return err
-	}
-	return nil
+		markerVersionID, err := storageOp()
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&metadata).Updates(map[string]interface{}{
+			"deleted_by":               userID,
+			"delete_marker_version_id": markerVersionID,
+		}).Error
+		if err != nil {
+			m.logger.Error("Failed to update metadata", zap.Error(err))
+			return err
+		}
+
+		// Soft delete the file metadata, its versions are kept for a restore
+		if err := tx.Delete(&metadata).Error; err != nil {
+			m.logger.Error("Failed to delete metadata", zap.Error(err))
+			return err
+		}
+		return nil
+	})
+}
+
+// DeleteFileVersion deletes one version of a file. When it was the current
+// version, the newest remaining one becomes current. Deleting the only version
+// is refused with ErrLastFileVersion, the whole file must be deleted instead.
+// storageOp runs inside the transaction, as for TrashFile.
+func (m *MetadataService) DeleteFileVersion(userID string, fileID string, number int, storageOp func(version *models.FileVersion) error) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		var metadata models.FileMetadata
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ? AND file_id = ?", userID, fileID).First(&metadata).Error; err != nil {
+			return err
+		}
+
+		var version models.FileVersion
+		if err := tx.Where("file_id = ? AND version = ?", fileID, number).First(&version).Error; err != nil {
+			return err
+		}
+
+		var remaining []models.FileVersion
+		if err := tx.Where("file_id = ? AND version <> ?", fileID, number).Order("version DESC").Limit(1).Find(&remaining).Error; err != nil {
+			return err
+		}
+		if len(remaining) == 0 {
+			return ErrLastFileVersion
+		}
+
+		if err := tx.Delete(&version).Error; err != nil {
+			m.logger.Error("Failed to delete file version", zap.Error(err))
+			return err
+		}
+
+		if metadata.VersionID == version.VersionID {
+			latest := remaining[0]
+			updates := map[string]interface{}{
+				"version":    latest.Version,
+				"version_id": latest.VersionID,
+				"size":       latest.Size,
+				"sha256":     latest.SHA256,
+				// The file row carries the envelope of its current version
+				"wrapped_key": latest.WrappedKey,
+				"key_company": latest.KeyCompany,
+				"key_id":      latest.KeyID,
+				"nonce":       latest.Nonce,
+			}
+			// Versions uploaded before sniffing have no type, the file keeps its own
+			if latest.ContentType != "" {
+				updates["content_type"] = latest.ContentType
+			}
+			if err := tx.Model(&metadata).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		m.logger.Info("Deleting file version",
+			zap.String("FileID", fileID),
+			zap.Int("Version", version.Version),
+			zap.String("VersionID", version.VersionID),
+		)
+		return storageOp(&version)
+	})
 }
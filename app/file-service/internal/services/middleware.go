@@ -10,6 +10,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// PublicPathPrefix is the path prefix of the endpoints reachable without a token
+const PublicPathPrefix = "/api/v1/public/"
+
 // Middleware to validate token and process requests
 // AuthMiddleware to validate token and process requests
 func AuthMiddleware(publicKey *rsa.PublicKey, logger *zap.Logger) gin.HandlerFunc {
@@ -20,6 +23,12 @@ func AuthMiddleware(publicKey *rsa.PublicKey, logger *zap.Logger) gin.HandlerFun
 			return
 		}
 
+		// Public endpoints, such as share link downloads, check their own credentials
+		if strings.HasPrefix(c.Request.URL.Path, PublicPathPrefix) {
+			c.Next()
+			return
+		}
+
 		// Extract basic request info for logging
 		requestID := c.GetHeader("uploadSessionId") // Assume clients send a unique request ID
 		logger = logger.With(zap.String("request_id", requestID), zap.String("path", c.Request.URL.Path))
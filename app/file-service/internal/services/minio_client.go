@@ -4,15 +4,22 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"net/http"
+	"net/url"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"go.uber.org/zap"
 )
 
-type StorageService struct {
+// uploadPartSize is the size of the parts sent to MinIO when streaming an object
+// of unknown length. It bounds the memory used by each upload.
+const uploadPartSize = 16 * 1024 * 1024
+
+// MinioStorage is the Storage driver for MinIO and other S3 compatible
+// stores. Versioning is enabled on its bucket.
+type MinioStorage struct {
 	client *minio.Client
 	logger *zap.Logger
 	bucket string
@@ -23,7 +30,7 @@ func EnableVersioning(client *minio.Client, bucketName string) error {
 	return client.EnableVersioning(ctx, bucketName)
 }
 
-func InitBucketHandler(client *minio.Client, bucketName string) error {
+func InitBucketHandler(client *minio.Client, bucketName string, log *zap.Logger) error {
 
 	ctx := context.Background()
 
@@ -39,113 +46,292 @@ func InitBucketHandler(client *minio.Client, bucketName string) error {
 		if err != nil {
 			return fmt.Errorf("error creating bucket: %w", err)
 		}
-		log.Printf("Bucket %s created successfully", bucketName)
+		log.Info("Bucket created successfully", zap.String("bucket", bucketName))
 	} else {
-		log.Printf("Bucket %s already exists", bucketName)
+		log.Info("Bucket already exists", zap.String("bucket", bucketName))
 	}
 
 	return nil
 }
 
-func ConnectMinio(endpoint, accessKey, secretKey string, log *zap.Logger) (*StorageService, error) {
+// ConnectMinio connects to the MinIO server at endpoint, over HTTPS when
+// secure is set, and makes sure bucket exists with versioning enabled
+func ConnectMinio(endpoint, accessKey, secretKey, bucket string, secure bool, log *zap.Logger) (*MinioStorage, error) {
 
 	// Initialize MinIO client
 	client, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
-		Secure: false, // Use true if using HTTPS
+		Secure: secure,
 	})
 	if err != nil {
-		log.Fatal("Failed to initialize MinIO client", zap.Error(err))
-		return nil, err
+		return nil, fmt.Errorf("error initializing MinIO client: %w", err)
 	}
 
-	log.Info("MinIO client initialized", zap.String("endpoint", endpoint))
+	log.Info("MinIO client initialized", zap.String("endpoint", endpoint), zap.Bool("secure", secure))
 
-	err = InitBucketHandler(client, "files")
-	if err != nil {
-		log.Fatal("Failed to create/access bucket name", zap.Error(err))
+	if err := InitBucketHandler(client, bucket, log); err != nil {
 		return nil, err
 	}
 
-	err = EnableVersioning(client, "files")
-	if err != nil {
-		log.Fatal("Failed to enable versioning in Minio")
-		return nil, err
+	if err := EnableVersioning(client, bucket); err != nil {
+		return nil, fmt.Errorf("error enabling versioning on bucket %s: %w", bucket, err)
 	}
 
-	return &StorageService{client: client, logger: log, bucket: "files"}, nil
+	return &MinioStorage{client: client, logger: log, bucket: bucket}, nil
 }
 
-func (s *StorageService) UploadFile(file io.Reader, fileID, fileName, contentType string) (string, string, error) {
+// Bucket returns a driver bound to another bucket of the same server,
+// created with versioning enabled if it does not exist
+func (m *MinioStorage) Bucket(ctx context.Context, name string) (Storage, error) {
+	if err := InitBucketHandler(m.client, name, m.logger); err != nil {
+		return nil, err
+	}
+	if err := EnableVersioning(m.client, name); err != nil {
+		return nil, fmt.Errorf("error enabling versioning on bucket %s: %w", name, err)
+	}
+	return &MinioStorage{client: m.client, logger: m.logger, bucket: name}, nil
+}
 
-	parentFileID := ""
-	if fileID != "" {
-		parentFileID = uuid.New().String()
+// objectInfo converts the description of a MinIO object
+func objectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:            info.Key,
+		VersionID:      info.VersionID,
+		Size:           info.Size,
+		ContentType:    info.ContentType,
+		ETag:           info.ETag,
+		LastModified:   info.LastModified,
+		IsLatest:       info.IsLatest,
+		IsDeleteMarker: info.IsDeleteMarker,
 	}
+}
 
-	fileID = uuid.New().String()
+// minioError reports missing objects, versions, multipart uploads and hidden
+// objects as ErrObjectNotFound
+func minioError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchVersion", "NoSuchUpload", "MethodNotAllowed":
+		return fmt.Errorf("%w: %v", ErrObjectNotFound, err)
+	}
+	return err
+}
 
-	// Upload the file using the provided or generated fileID
-	info, err := s.client.PutObject(context.Background(), s.bucket, fileID, file, -1, minio.PutObjectOptions{
+func (m *MinioStorage) Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	info, err := m.client.PutObject(ctx, m.bucket, key, content, size, minio.PutObjectOptions{
 		ContentType: contentType,
+		PartSize:    uploadPartSize,
 	})
 	if err != nil {
-		s.logger.Error("Failed to upload file", zap.String("fileID", fileID), zap.Error(err))
-		return "", "", err
+		return ObjectInfo{}, err
 	}
-
-	// Log success with the version ID
-	s.logger.Info("File uploaded successfully",
-		zap.String("fileID", fileID),
-		zap.String("parentFileID", parentFileID),
-		zap.String("versionID", info.VersionID),
-		zap.String("contentType", contentType),
-	)
-
-	return fileID, info.VersionID, nil
+	return ObjectInfo{
+		Key:          key,
+		VersionID:    info.VersionID,
+		Size:         info.Size,
+		ContentType:  contentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		IsLatest:     true,
+	}, nil
 }
 
-func (s *StorageService) GetFile(bucketName, objectName string) (*minio.Object, string, error) {
-	ctx := context.Background()
+// Get opens a MinIO object, reads are served with ranged requests to MinIO
+func (m *MinioStorage) Get(ctx context.Context, key, versionID string) (Object, ObjectInfo, error) {
+	object, err := m.client.GetObject(ctx, m.bucket, key, minio.GetObjectOptions{VersionID: versionID})
+	if err != nil {
+		return nil, ObjectInfo{}, minioError(err)
+	}
 
-	// Retrieve the object
-	object, err := s.client.GetObject(ctx, bucketName, objectName, minio.GetObjectOptions{})
+	// Retrieve metadata for content type, ETag and modification time
+	info, err := object.Stat()
 	if err != nil {
-		return nil, "", err
+		object.Close()
+		return nil, ObjectInfo{}, minioError(err)
 	}
+	return object, objectInfo(info), nil
+}
 
-	// Retrieve metadata for content type
-	statInfo, err := s.client.StatObject(ctx, bucketName, objectName, minio.StatObjectOptions{})
+func (m *MinioStorage) Stat(ctx context.Context, key, versionID string) (ObjectInfo, error) {
+	info, err := m.client.StatObject(ctx, m.bucket, key, minio.StatObjectOptions{VersionID: versionID})
 	if err != nil {
-		return nil, "", err
+		return ObjectInfo{}, minioError(err)
 	}
+	return objectInfo(info), nil
+}
 
-	// Return the object and its content type
-	return object, statInfo.ContentType, nil
+func (m *MinioStorage) Copy(ctx context.Context, key, versionID string) (ObjectInfo, error) {
+	info, err := m.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: m.bucket, Object: key},
+		minio.CopySrcOptions{Bucket: m.bucket, Object: key, VersionID: versionID},
+	)
+	if err != nil {
+		return ObjectInfo{}, minioError(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		VersionID:    info.VersionID,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		IsLatest:     true,
+	}, nil
 }
 
-func (s *StorageService) GetFileVersion(bucketName, objectName, versionID string) (*minio.Object, error) {
-	opts := minio.GetObjectOptions{}
-	opts.VersionID = versionID
+func (m *MinioStorage) Delete(ctx context.Context, key string) (string, error) {
+	objects := make(chan minio.ObjectInfo, 1)
+	objects <- minio.ObjectInfo{Key: key}
+	close(objects)
 
-	return s.client.GetObject(context.Background(), bucketName, objectName, opts)
+	// RemoveObject does not report the version ID of the delete marker it writes
+	var markerVersionID string
+	for result := range m.client.RemoveObjectsWithResult(ctx, m.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil {
+			return "", result.Err
+		}
+		markerVersionID = result.DeleteMarkerVersionID
+	}
+	return markerVersionID, nil
 }
 
-func (s *StorageService) ListFileVersions(bucketName, objectName string) ([]minio.ObjectInfo, error) {
-	var versions []minio.ObjectInfo
-	ctx := context.Background()
+func (m *MinioStorage) RemoveVersion(ctx context.Context, key, versionID string) error {
+	return m.client.RemoveObject(ctx, m.bucket, key, minio.RemoveObjectOptions{VersionID: versionID})
+}
+
+func (m *MinioStorage) ListVersions(ctx context.Context, key string) ([]ObjectInfo, error) {
+	var versions []ObjectInfo
 
-	// List all versions of the object
 	opts := minio.ListObjectsOptions{
-		Prefix:       objectName,
+		Prefix:       key,
 		Recursive:    true,
 		WithVersions: true,
 	}
-	for object := range s.client.ListObjects(ctx, bucketName, opts) {
+	for object := range m.client.ListObjects(ctx, m.bucket, opts) {
 		if object.Err != nil {
 			return nil, object.Err
 		}
-		versions = append(versions, object)
+		// The prefix also matches longer object names
+		if object.Key != key {
+			continue
+		}
+		versions = append(versions, objectInfo(object))
 	}
 	return versions, nil
 }
+
+func (m *MinioStorage) ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	// Cancelling stops the listing goroutine when fn stops early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts := minio.ListObjectsOptions{
+		Prefix:       prefix,
+		Recursive:    true,
+		WithVersions: true,
+	}
+	for object := range m.client.ListObjects(ctx, m.bucket, opts) {
+		if object.Err != nil {
+			return object.Err
+		}
+		if !object.IsLatest {
+			continue
+		}
+		if err := fn(objectInfo(object)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MinioStorage) Presign(ctx context.Context, method, key string, params url.Values, expiry time.Duration) (*url.URL, error) {
+	switch method {
+	case http.MethodGet, http.MethodPut:
+		return m.client.Presign(ctx, method, m.bucket, key, expiry, params)
+	}
+	return nil, fmt.Errorf("cannot presign %s requests", method)
+}
+
+func (m *MinioStorage) NewMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	core := minio.Core{Client: m.client}
+	return core.NewMultipartUpload(ctx, m.bucket, key, minio.PutObjectOptions{ContentType: contentType})
+}
+
+func (m *MinioStorage) ListUploadedParts(ctx context.Context, key, uploadID string) ([]UploadedPart, error) {
+	core := minio.Core{Client: m.client}
+
+	var parts []UploadedPart
+	marker := 0
+	for {
+		result, err := core.ListObjectParts(ctx, m.bucket, key, uploadID, marker, 1000)
+		if err != nil {
+			return nil, minioError(err)
+		}
+		for _, part := range result.ObjectParts {
+			parts = append(parts, UploadedPart{Number: part.PartNumber, ETag: part.ETag, Size: part.Size})
+		}
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+func (m *MinioStorage) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) (ObjectInfo, error) {
+	core := minio.Core{Client: m.client}
+
+	completed := make([]minio.CompletePart, len(parts))
+	for i, part := range parts {
+		completed[i] = minio.CompletePart{PartNumber: part.Number, ETag: part.ETag}
+	}
+	info, err := core.CompleteMultipartUpload(ctx, m.bucket, key, uploadID, completed, minio.PutObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, minioError(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		VersionID:    info.VersionID,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		IsLatest:     true,
+	}, nil
+}
+
+func (m *MinioStorage) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	core := minio.Core{Client: m.client}
+	if err := core.AbortMultipartUpload(ctx, m.bucket, key, uploadID); err != nil {
+		return minioError(err)
+	}
+	return nil
+}
+
+// AbortIncompleteUploads removes the parts of multipart uploads started before
+// olderThan that were never completed. It returns how many uploads were aborted
+// and how many bytes their parts held.
+func (m *MinioStorage) AbortIncompleteUploads(ctx context.Context, olderThan time.Time) (int, int64, error) {
+	var aborted int
+	var reclaimed int64
+
+	for upload := range m.client.ListIncompleteUploads(ctx, m.bucket, "", true) {
+		if upload.Err != nil {
+			return aborted, reclaimed, upload.Err
+		}
+		if upload.Initiated.After(olderThan) {
+			continue
+		}
+
+		if err := m.client.RemoveIncompleteUpload(ctx, m.bucket, upload.Key); err != nil {
+			m.logger.Error("Failed to abort incomplete upload", zap.String("object", upload.Key), zap.String("uploadID", upload.UploadID), zap.Error(err))
+			continue
+		}
+
+		m.logger.Info("Aborted incomplete upload",
+			zap.String("object", upload.Key),
+			zap.String("uploadID", upload.UploadID),
+			zap.Time("initiated", upload.Initiated),
+			zap.Int64("size", upload.Size),
+		)
+		aborted++
+		reclaimed += upload.Size
+	}
+	return aborted, reclaimed, nil
+}
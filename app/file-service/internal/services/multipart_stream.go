@@ -0,0 +1,86 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+)
+
+var ErrFileTooLarge = errors.New("file exceeds the maximum allowed size")
+
+// maxFormValueSize bounds the size of the non-file fields of an upload form
+const maxFormValueSize = 64 * 1024
+
+// FilePartHandler consumes the content of one uploaded file. content must be
+// read to the end or until an error, it is only valid during the call.
+type FilePartHandler func(fileName string, content io.Reader) error
+
+// FieldPartHandler checks a non-file field as soon as it has been read, so a
+// request can be refused before the files following it are streamed.
+type FieldPartHandler func(name, value string) error
+
+// StreamMultipartForm walks a multipart body part by part without buffering it.
+// Every file of the "files" field is handed to onFile as it arrives, limited to
+// maxFileSize bytes, while the other fields are collected and returned. Each
+// field is also handed to onField, when not nil, as it arrives.
+func StreamMultipartForm(reader *multipart.Reader, maxFileSize int64, onField FieldPartHandler, onFile FilePartHandler) (map[string]string, error) {
+	values := make(map[string]string)
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return values, fmt.Errorf("error reading multipart body: %w", err)
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize))
+			part.Close()
+			if err != nil {
+				return values, fmt.Errorf("error reading form field %s: %w", part.FormName(), err)
+			}
+			values[part.FormName()] = string(value)
+			if onField != nil {
+				if err := onField(part.FormName(), string(value)); err != nil {
+					return values, err
+				}
+			}
+			continue
+		}
+
+		if part.FormName() != "files" {
+			part.Close()
+			continue
+		}
+
+		err = onFile(part.FileName(), &limitedReader{r: part, remaining: maxFileSize})
+		part.Close()
+		if err != nil {
+			return values, err
+		}
+	}
+}
+
+// limitedReader fails with ErrFileTooLarge, rather than silently truncating
+// like io.LimitReader, once more than remaining bytes have been read
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, ErrFileTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"runtime"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// maxUploadOverhead is the memory an upload may allocate besides the stored
+// content, whatever the size of the file
+const maxUploadOverhead = 2 << 20
+
+// zeroReader produces an endless stream of zero bytes without allocating
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// multipartBody streams a multipart form holding a single file of size bytes
+func multipartBody(size int64) (io.Reader, string) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		part, err := writer.CreateFormFile("files", "document.bin")
+		if err == nil {
+			_, err = io.CopyN(part, zeroReader{}, size)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, writer.Boundary()
+}
+
+func TestStreamMultipartFormChecksFieldsFirst(t *testing.T) {
+	errRefused := errors.New("refused")
+
+	tests := []struct {
+		name      string
+		fields    []string // Field names, in form order, around a single file
+		wantErr   error
+		wantFiles int
+	}{
+		{"fields before the file", []string{"name", "email", "files"}, nil, 1},
+		{"refused field before the file", []string{"refused", "files"}, errRefused, 0},
+		{"refused field after the file", []string{"files", "refused"}, errRefused, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			for _, field := range tt.fields {
+				if field == "files" {
+					part, _ := writer.CreateFormFile("files", "document.txt")
+					part.Write([]byte("content"))
+				} else {
+					writer.WriteField(field, "value of "+field)
+				}
+			}
+			writer.Close()
+
+			files := 0
+			values, err := StreamMultipartForm(multipart.NewReader(&body, writer.Boundary()), 1024, func(name, value string) error {
+				if value != "value of "+name {
+					t.Errorf("field %s = %q", name, value)
+				}
+				if name == "refused" {
+					return errRefused
+				}
+				return nil
+			}, func(fileName string, content io.Reader) error {
+				files++
+				_, err := io.Copy(io.Discard, content)
+				return err
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("StreamMultipartForm = %v, want %v", err, tt.wantErr)
+			}
+			if files != tt.wantFiles {
+				t.Errorf("%d files streamed, want %d", files, tt.wantFiles)
+			}
+			if tt.wantErr == nil && (values["name"] != "value of name" || values["email"] != "value of email") {
+				t.Errorf("values = %v", values)
+			}
+		})
+	}
+}
+
+func newMemoryStorageService(tb testing.TB) *StorageService {
+	tb.Helper()
+	layout, err := NewObjectLayout(nil, ObjectLayoutFlat, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewStorageService(NewMemoryStorage(), layout, nil, zap.NewNop())
+}
+
+// uploadStream streams a multipart body holding a file of size bytes to the
+// storage, like the multipart upload handler, then purges the stored object
+func uploadStream(tb testing.TB, storage *StorageService, size int64) {
+	body, boundary := multipartBody(size)
+	reader := multipart.NewReader(body, boundary)
+
+	_, err := StreamMultipartForm(reader, size, nil, func(fileName string, content io.Reader) error {
+		_, location, err := storage.NewFileLocation("owner", "")
+		if err != nil {
+			return err
+		}
+		checksum := NewChecksumReader(content)
+		if _, _, err := storage.UploadFile(checksum, -1, location, fileName, "application/octet-stream", "owner", ""); err != nil {
+			return err
+		}
+		if checksum.Size() != size {
+			tb.Errorf("stored %d bytes, want %d", checksum.Size(), size)
+		}
+		return storage.PurgeFile(location)
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// uploadOverhead returns the bytes allocated per upload of size bytes beyond
+// the stored content, which the memory driver keeps
+func uploadOverhead(tb testing.TB, storage *StorageService, size int64, runs int) int64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < runs; i++ {
+		uploadStream(tb, storage, size)
+	}
+	runtime.ReadMemStats(&after)
+	return int64(after.TotalAlloc-before.TotalAlloc)/int64(runs) - size
+}
+
+func TestUploadMemoryBounded(t *testing.T) {
+	storage := newMemoryStorageService(t)
+	for _, size := range []int64{0, 1, 1 << 20, 32 << 20} {
+		if overhead := uploadOverhead(t, storage, size, 3); overhead > maxUploadOverhead {
+			t.Errorf("upload of %d bytes allocated %d bytes besides its content, want at most %d", size, overhead, maxUploadOverhead)
+		}
+	}
+}
+
+func BenchmarkUpload(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		size int64
+	}{
+		{"1MB", 1 << 20},
+		{"16MB", 16 << 20},
+		{"128MB", 128 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			storage := newMemoryStorageService(b)
+			b.ReportAllocs()
+			b.SetBytes(bench.size)
+			b.ResetTimer()
+
+			overhead := uploadOverhead(b, storage, bench.size, b.N)
+			b.ReportMetric(float64(overhead), "overhead-B/op")
+			if overhead > maxUploadOverhead {
+				b.Errorf("upload allocated %d bytes besides its content, want at most %d", overhead, maxUploadOverhead)
+			}
+		})
+	}
+}
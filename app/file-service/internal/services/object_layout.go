@@ -0,0 +1,58 @@
+package services
+
+import (
+	"fmt"
+
+	"file-service/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// Strategies placing the objects of new files
+const (
+	ObjectLayoutFlat   = "flat"   // Every object in the default bucket, named after its fileID
+	ObjectLayoutPrefix = "prefix" // Objects under a "companies/<companyID>/" prefix of the default bucket
+	ObjectLayoutBucket = "bucket" // Objects in a bucket of their own per company
+)
+
+// ObjectLayout decides where the objects of new files are stored, from the
+// company of the folder holding them, or of their owner for files outside
+// company folders. Files of owners outside any company get a "users/<userID>/"
+// prefix of the default bucket with the prefix and bucket strategies. Files
+// keep the location they were created with, moving them to the current
+// layout is the job of StorageMigrator.
+type ObjectLayout struct {
+	db           *gorm.DB
+	strategy     string
+	bucketPrefix string // Company buckets are named "<bucketPrefix>-<companyID>"
+}
+
+func NewObjectLayout(db *gorm.DB, strategy, bucketPrefix string) (*ObjectLayout, error) {
+	switch strategy {
+	case ObjectLayoutFlat, ObjectLayoutPrefix, ObjectLayoutBucket:
+	default:
+		return nil, fmt.Errorf("unknown object layout %q", strategy)
+	}
+	return &ObjectLayout{db: db, strategy: strategy, bucketPrefix: bucketPrefix}, nil
+}
+
+// Locate returns where the versions of fileID, owned by ownerID and held by
+// folderID, empty at the root, are stored
+func (l *ObjectLayout) Locate(fileID, ownerID, folderID string) (models.ObjectLocation, error) {
+	if l.strategy == ObjectLayoutFlat {
+		return models.ObjectLocation{ObjectKey: fileID}, nil
+	}
+
+	company, err := storageCompany(l.db, ownerID, folderID)
+	if err != nil {
+		return models.ObjectLocation{}, err
+	}
+	switch {
+	case company == "":
+		return models.ObjectLocation{ObjectKey: "users/" + ownerID + "/" + fileID}, nil
+	case l.strategy == ObjectLayoutBucket:
+		return models.ObjectLocation{StorageBucket: l.bucketPrefix + "-" + company, ObjectKey: fileID}, nil
+	default:
+		return models.ObjectLocation{ObjectKey: "companies/" + company + "/" + fileID}, nil
+	}
+}
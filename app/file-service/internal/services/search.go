@@ -0,0 +1,115 @@
+package services
+
+import (
+	"file-service/internal/models"
+	"fmt"
+	"html"
+	"strings"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// searchConfig is the text search configuration of the documents and queries
+const searchConfig = "english"
+
+// Markers ts_headline puts around matches. Extracted text holds no control
+// characters, so they are replaced by <mark> tags once the fragment is escaped.
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// SearchResult is a file matching a search, with its rank and an HTML excerpt
+// where the matching words are wrapped in <mark> tags
+type SearchResult struct {
+	models.FileMetadata `gorm:"embedded"`
+	Rank                float64
+	Highlight           string
+}
+
+// SearchService maintains the full-text index of the files and queries it
+type SearchService struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+func NewSearchService(db *gorm.DB, log *zap.Logger) *SearchService {
+	return &SearchService{db: db, logger: log}
+}
+
+// PendingFiles returns up to limit files whose current version is not indexed yet
+func (s *SearchService) PendingFiles(limit int) ([]models.FileMetadata, error) {
+	var files []models.FileMetadata
+	err := s.db.
+		Joins("LEFT JOIN file_search_documents ON file_search_documents.file_id = file_metadata.file_id").
+		Where("file_search_documents.file_id IS NULL OR file_search_documents.version_id IS DISTINCT FROM file_metadata.version_id").
+		Order("file_metadata.created_at").
+		Limit(limit).
+		Find(&files).Error
+	return files, err
+}
+
+// SaveDocument stores the text extracted from the current version of file and
+// rebuilds its search vector. The file name weighs more than the content.
+func (s *SearchService) SaveDocument(file *models.FileMetadata, status string, content string) error {
+	document := models.FileSearchDocument{
+		FileID:    file.FileID,
+		VersionID: file.VersionID,
+		Status:    status,
+		Content:   content,
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "file_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"version_id", "status", "content", "indexed_at"}),
+		}).Create(&document).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&models.FileSearchDocument{}).
+			Where("file_id = ?", file.FileID).
+			Update("document", gorm.Expr(
+				"setweight(to_tsvector(?::regconfig, ?), 'A') || setweight(to_tsvector(?::regconfig, content), 'B')",
+				searchConfig, file.FileName, searchConfig,
+			)).Error
+	})
+}
+
+// Search returns the files matching the web search syntax query q, best
+// matches first. scope restricts the files to the ones the caller may read.
+func (s *SearchService) Search(q string, limit, offset int, scope func(*gorm.DB) *gorm.DB) ([]SearchResult, error) {
+	tsQuery := gorm.Expr("websearch_to_tsquery(?::regconfig, ?)", searchConfig, q)
+
+	// Rank and page first, ts_headline is only computed for the returned page
+	ranked := s.db.Model(&models.FileMetadata{}).
+		Select("file_metadata.*, file_search_documents.content AS search_content, ts_rank(file_search_documents.document, query) AS rank").
+		Joins("JOIN file_search_documents ON file_search_documents.file_id = file_metadata.file_id").
+		Joins("CROSS JOIN (SELECT ? AS query) AS search_query", tsQuery).
+		Where("file_search_documents.document @@ query").
+		Scopes(scope).
+		Order("rank DESC, file_metadata.file_id").
+		Limit(limit).
+		Offset(offset)
+
+	var results []SearchResult
+	err := s.db.Table("(?) AS ranked", ranked).
+		Select("ranked.*, ts_headline(?::regconfig, ranked.search_content, ?, ?) AS highlight",
+			searchConfig, tsQuery,
+			fmt.Sprintf("StartSel=\"%s\", StopSel=\"%s\", MaxFragments=3, MaxWords=25, MinWords=8, FragmentDelimiter=\" … \"", highlightStart, highlightStop),
+		).
+		Order("ranked.rank DESC, ranked.file_id").
+		Scan(&results).Error
+	if err != nil {
+		return nil, fmt.Errorf("error searching files: %w", err)
+	}
+
+	for i := range results {
+		results[i].Highlight = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>").
+			Replace(html.EscapeString(results[i].Highlight))
+	}
+	return results, nil
+}
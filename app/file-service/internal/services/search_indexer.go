@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"file-service/internal/models"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var indexedDocumentsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "file_service_indexed_documents_total",
+	Help: "Number of file versions processed by the search indexer",
+}, []string{"status"})
+
+// SearchIndexer periodically extracts the text of the files whose current
+// version is not indexed yet. Indexing is idempotent, so replicas running
+// their own indexer at worst extract the same file twice.
+type SearchIndexer struct {
+	search      *SearchService
+	storage     *StorageService
+	maxFileSize int64
+	interval    time.Duration
+	logger      *zap.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewSearchIndexer(search *SearchService, storage *StorageService, maxFileSize int64, interval time.Duration, log *zap.Logger) *SearchIndexer {
+	return &SearchIndexer{
+		search:      search,
+		storage:     storage,
+		maxFileSize: maxFileSize,
+		interval:    interval,
+		logger:      log,
+	}
+}
+
+// Start runs the indexer in the background until Stop is called
+func (i *SearchIndexer) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	i.cancel = cancel
+
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+
+		ticker := time.NewTicker(i.interval)
+		defer ticker.Stop()
+
+		i.logger.Info("Search indexer started", zap.Duration("interval", i.interval), zap.Int64("maxFileSize", i.maxFileSize))
+		for {
+			select {
+			case <-ticker.C:
+				i.IndexPending(ctx)
+			case <-ctx.Done():
+				i.logger.Info("Search indexer stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop interrupts the current run, if any, and waits for the indexer to exit
+func (i *SearchIndexer) Stop() {
+	if i.cancel != nil {
+		i.cancel()
+	}
+	i.wg.Wait()
+}
+
+// IndexPending indexes one batch of pending files
+func (i *SearchIndexer) IndexPending(ctx context.Context) {
+	const batchSize = 50
+
+	files, err := i.search.PendingFiles(batchSize)
+	if err != nil {
+		i.logger.Error("Failed to list files to index", zap.Error(err))
+		return
+	}
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		i.indexFile(&file)
+	}
+}
+
+// indexFile extracts and stores the text of the current version of file.
+// Storage errors are left for the next run, every other outcome is recorded
+// so that the version is not processed again.
+func (i *SearchIndexer) indexFile(file *models.FileMetadata) {
+	status, content := models.SearchStatusIndexed, ""
+
+	switch {
+	case documentFormat(file.FileName, file.ContentType) == "":
+		status = models.SearchStatusUnsupported
+	case file.Size > i.maxFileSize:
+		status = models.SearchStatusTooLarge
+	default:
+		object, info, err := i.storage.GetFile(file)
+		if err != nil {
+			i.logger.Warn("Failed to fetch file to index", zap.String("fileID", file.FileID), zap.Error(err))
+			return
+		}
+		defer object.Close()
+
+		if info.Size > i.maxFileSize {
+			status = models.SearchStatusTooLarge
+			break
+		}
+		content, err = ExtractText(file.FileName, file.ContentType, object, info.Size)
+		if errors.Is(err, ErrUnsupportedFormat) {
+			status = models.SearchStatusUnsupported
+		} else if err != nil {
+			i.logger.Warn("Failed to extract text", zap.String("fileID", file.FileID), zap.String("fileName", file.FileName), zap.Error(err))
+			status = models.SearchStatusFailed
+		}
+	}
+
+	if err := i.search.SaveDocument(file, status, content); err != nil {
+		i.logger.Error("Failed to save search document", zap.String("fileID", file.FileID), zap.Error(err))
+		return
+	}
+
+	indexedDocumentsTotal.WithLabelValues(status).Inc()
+	i.logger.Debug("File indexed", zap.String("fileID", file.FileID), zap.String("status", status), zap.Int("textLength", len(content)))
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"database/sql"
+	"file-service/internal/models"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SharedFile is a file shared with a user, with the highest role they hold on it
+type SharedFile struct {
+	models.FileMetadata `gorm:"embedded"`
+	Role                string
+}
+
+// ShareService manages the shares of files with users and companies
+type ShareService struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+func NewShareService(db *gorm.DB, log *zap.Logger) *ShareService {
+	return &ShareService{db: db, logger: log}
+}
+
+// ShareFile grants role on a file to a recipient. Sharing again with the same
+// recipient replaces the role of the existing share.
+func (s *ShareService) ShareFile(fileID, recipientType, recipientID, role, createdBy string) (*models.FileShare, error) {
+	share := models.FileShare{
+		FileID:        fileID,
+		RecipientType: recipientType,
+		RecipientID:   recipientID,
+		Role:          role,
+		CreatedBy:     createdBy,
+	}
+
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}, {Name: "recipient_type"}, {Name: "recipient_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"role"}),
+	}, clause.Returning{}).Create(&share).Error
+	if err != nil {
+		s.logger.Error("Failed to share file", zap.String("FileID", fileID), zap.String("RecipientID", recipientID), zap.Error(err))
+		return nil, err
+	}
+
+	s.logger.Info("File shared",
+		zap.String("FileID", fileID),
+		zap.String("RecipientType", recipientType),
+		zap.String("RecipientID", recipientID),
+		zap.String("Role", role),
+	)
+	return &share, nil
+}
+
+// ListShares returns the shares of a file, oldest first
+func (s *ShareService) ListShares(fileID string) ([]models.FileShare, error) {
+	var shares []models.FileShare
+	err := s.db.Where("file_id = ?", fileID).Order("created_at, id").Find(&shares).Error
+	return shares, err
+}
+
+// RevokeShare deletes a share of a file, or returns gorm.ErrRecordNotFound
+func (s *ShareService) RevokeShare(fileID string, shareID uint) error {
+	result := s.db.Where("id = ? AND file_id = ?", shareID, fileID).Delete(&models.FileShare{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	s.logger.Info("File share revoked", zap.String("FileID", fileID), zap.Uint("ShareID", shareID))
+	return nil
+}
+
+// SharedWith returns the files shared with userID, directly or through one of
+// their companies, most recently shared first
+func (s *ShareService) SharedWith(userID string) ([]SharedFile, error) {
+	// The highest role wins when a file is shared several times with the user
+	roles := s.db.Model(&models.FileShare{}).
+		Select(`file_id, MAX(CASE role WHEN @editor THEN 3 WHEN @commenter THEN 2 ELSE 1 END) AS rank, MAX(created_at) AS shared_at`,
+			sql.Named("editor", models.FileRoleEditor), sql.Named("commenter", models.FileRoleCommenter)).
+		Where(sharedWithUser, sharedWithUserArgs(userID)...).
+		Group("file_id")
+
+	var files []SharedFile
+	err := s.db.Model(&models.FileMetadata{}).
+		Select(`file_metadata.*, CASE shares.rank WHEN 3 THEN @editor WHEN 2 THEN @commenter ELSE @viewer END AS role`,
+			sql.Named("editor", models.FileRoleEditor), sql.Named("commenter", models.FileRoleCommenter), sql.Named("viewer", models.FileRoleViewer)).
+		Joins("JOIN (?) AS shares ON shares.file_id = file_metadata.file_id", roles).
+		Where("file_metadata.user_id <> ?", userID).
+		Order("shares.shared_at DESC").
+		Scan(&files).Error
+	return files, err
+}
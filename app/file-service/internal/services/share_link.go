@@ -0,0 +1,204 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"file-service/internal/models"
+	"fmt"
+	"time"
+
+	"github.com/amine-bouhoula/safedocs-mvp/sdlib/utils"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrShareLinkNotFound  = errors.New("share link not found")
+	ErrShareLinkExpired   = errors.New("share link expired")
+	ErrShareLinkRevoked   = errors.New("share link revoked")
+	ErrShareLinkExhausted = errors.New("share link reached its download limit")
+)
+
+// ShareLinkService manages the public download links of files
+type ShareLinkService struct {
+	db     *gorm.DB
+	logger *zap.Logger
+}
+
+func NewShareLinkService(db *gorm.DB, log *zap.Logger) *ShareLinkService {
+	return &ShareLinkService{db: db, logger: log}
+}
+
+// hashLinkToken returns the hex encoded SHA-256 under which a token is stored
+func hashLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newLinkToken returns a random URL-safe token and the hash it is stored under
+func newLinkToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("error generating link token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashLinkToken(token), nil
+}
+
+// CreateLink creates a link to fileID and returns it with its token. A
+// non-empty password is hashed with bcrypt; maxDownloads 0 means unlimited.
+func (s *ShareLinkService) CreateLink(fileID, createdBy string, expiresAt time.Time, password string, maxDownloads int) (*models.ShareLink, string, error) {
+	token, tokenHash, err := newLinkToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	link := models.ShareLink{
+		FileID:       fileID,
+		TokenHash:    tokenHash,
+		ExpiresAt:    expiresAt,
+		MaxDownloads: maxDownloads,
+		CreatedBy:    createdBy,
+	}
+	if password != "" {
+		hash, err := utils.HashPassword(password)
+		if err != nil {
+			return nil, "", fmt.Errorf("error hashing link password: %w", err)
+		}
+		link.PasswordHash = hash
+		link.HasPassword = true
+	}
+
+	if err := s.db.Create(&link).Error; err != nil {
+		s.logger.Error("Failed to create share link", zap.String("FileID", fileID), zap.Error(err))
+		return nil, "", err
+	}
+
+	s.logger.Info("Share link created",
+		zap.String("FileID", fileID),
+		zap.Uint("LinkID", link.ID),
+		zap.Time("ExpiresAt", expiresAt),
+		zap.Int("MaxDownloads", maxDownloads),
+		zap.Bool("HasPassword", link.HasPassword),
+	)
+	return &link, token, nil
+}
+
+// ListLinks returns the links of a file, newest first
+func (s *ShareLinkService) ListLinks(fileID string) ([]models.ShareLink, error) {
+	var links []models.ShareLink
+	if err := s.db.Where("file_id = ?", fileID).Order("created_at DESC, id DESC").Find(&links).Error; err != nil {
+		return nil, err
+	}
+	for i := range links {
+		links[i].HasPassword = links[i].PasswordHash != ""
+	}
+	return links, nil
+}
+
+// RevokeLink disables a link of a file for good. It returns
+// ErrShareLinkNotFound when the file has no such link.
+func (s *ShareLinkService) RevokeLink(fileID string, linkID uint) error {
+	result := s.db.Model(&models.ShareLink{}).
+		Where("id = ? AND file_id = ? AND revoked_at IS NULL", linkID, fileID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrShareLinkNotFound
+	}
+
+	s.logger.Info("Share link revoked", zap.String("FileID", fileID), zap.Uint("LinkID", linkID))
+	return nil
+}
+
+// ListAccesses returns the recorded accesses of a link of a file, newest first
+func (s *ShareLinkService) ListAccesses(fileID string, linkID uint) ([]models.ShareLinkAccess, error) {
+	var count int64
+	if err := s.db.Model(&models.ShareLink{}).Where("id = ? AND file_id = ?", linkID, fileID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrShareLinkNotFound
+	}
+
+	var accesses []models.ShareLinkAccess
+	err := s.db.Where("link_id = ?", linkID).Order("accessed_at DESC, id DESC").Find(&accesses).Error
+	return accesses, err
+}
+
+// ResolveLink returns the link of token and the file it points to. Unknown
+// tokens and links to deleted files give ErrShareLinkNotFound; the link is
+// also returned with ErrShareLinkRevoked, ErrShareLinkExpired or
+// ErrShareLinkExhausted so that the refused access can be recorded.
+func (s *ShareLinkService) ResolveLink(token string) (*models.ShareLink, *models.FileMetadata, error) {
+	var link models.ShareLink
+	err := s.db.Where("token_hash = ?", hashLinkToken(token)).First(&link).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrShareLinkNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	link.HasPassword = link.PasswordHash != ""
+
+	var file models.FileMetadata
+	err = s.db.Where("file_id = ?", link.FileID).First(&file).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrShareLinkNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case link.RevokedAt != nil:
+		return &link, &file, ErrShareLinkRevoked
+	case !time.Now().Before(link.ExpiresAt):
+		return &link, &file, ErrShareLinkExpired
+	case link.MaxDownloads > 0 && link.DownloadCount >= link.MaxDownloads:
+		return &link, &file, ErrShareLinkExhausted
+	}
+	return &link, &file, nil
+}
+
+// CheckPassword reports whether password opens link
+func (s *ShareLinkService) CheckPassword(link *models.ShareLink, password string) bool {
+	if link.PasswordHash == "" {
+		return true
+	}
+	return password != "" && utils.CheckPasswordHash(password, link.PasswordHash)
+}
+
+// ConsumeDownload counts one download of a link. The check and the increment
+// are a single statement, so concurrent downloads cannot exceed the limit.
+func (s *ShareLinkService) ConsumeDownload(linkID uint) error {
+	result := s.db.Model(&models.ShareLink{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ? AND (max_downloads = 0 OR download_count < max_downloads)", linkID, time.Now()).
+		Update("download_count", gorm.Expr("download_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrShareLinkExhausted
+	}
+	return nil
+}
+
+// RecordAccess stores one access of a link. Failures are only logged, they
+// must not prevent the download.
+func (s *ShareLinkService) RecordAccess(linkID uint, outcome, clientIP, userAgent string) {
+	access := models.ShareLinkAccess{
+		LinkID:    linkID,
+		Outcome:   outcome,
+		ClientIP:  clientIP,
+		UserAgent: userAgent,
+	}
+	if err := s.db.Create(&access).Error; err != nil {
+		s.logger.Error("Failed to record share link access", zap.Uint("LinkID", linkID), zap.String("Outcome", outcome), zap.Error(err))
+	}
+}
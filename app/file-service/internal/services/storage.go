@@ -0,0 +1,543 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"file-service/internal/models"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrObjectNotFound        = errors.New("object not found")
+	ErrPresignNotSupported   = errors.New("storage driver cannot presign URLs")
+	ErrInvalidObjectKey      = errors.New("invalid object key")
+	ErrPresignEncrypted      = errors.New("encrypted content cannot be transferred directly with the storage")
+	ErrIncompleteMultipart   = errors.New("multipart upload is missing parts")
+	ErrMultipartNotSupported = errors.New("storage driver cannot take multipart uploads from clients")
+)
+
+// ObjectInfo describes one version of a stored object, or one of its delete markers
+type ObjectInfo struct {
+	Key            string
+	VersionID      string
+	Size           int64
+	ContentType    string
+	ETag           string // Hex encoded MD5 of single part uploads, opaque otherwise
+	LastModified   time.Time
+	IsLatest       bool
+	IsDeleteMarker bool
+}
+
+// Object is an opened version of a stored object. It can be read from any
+// offset, so ranges and documents indexed by offset are served without
+// buffering the whole content.
+type Object interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+// Storage is a versioned object store. Every Put creates a new version of its
+// key; deleting a key only hides it behind a delete marker, which can be
+// removed like any version to make the key visible again.
+type Storage interface {
+	// Put stores content as the latest version of key. size is -1 when the
+	// length is not known in advance.
+	Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) (ObjectInfo, error)
+	// Get opens one version of key, the latest one when versionID is empty
+	Get(ctx context.Context, key, versionID string) (Object, ObjectInfo, error)
+	// Stat describes one version of key, the latest one when versionID is empty
+	Stat(ctx context.Context, key, versionID string) (ObjectInfo, error)
+	// Copy stores a copy of one version of key as its latest version
+	Copy(ctx context.Context, key, versionID string) (ObjectInfo, error)
+	// Delete hides key behind a delete marker and returns the version ID of the marker
+	Delete(ctx context.Context, key string) (string, error)
+	// RemoveVersion permanently deletes one version or delete marker of key
+	RemoveVersion(ctx context.Context, key, versionID string) error
+	// ListVersions returns every version and delete marker of key, newest first
+	ListVersions(ctx context.Context, key string) ([]ObjectInfo, error)
+	// ListObjects calls fn with the latest version or delete marker of every
+	// key starting with prefix, stopping at the first error fn returns. Keys
+	// written during the listing may be missed.
+	ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+	// Presign returns a URL granting method, GET or PUT, on key until expiry.
+	// params are signed along, such as versionId or the part of a multipart upload.
+	Presign(ctx context.Context, method, key string, params url.Values, expiry time.Duration) (*url.URL, error)
+}
+
+// UploadedPart is one part of a multipart upload received by the storage
+type UploadedPart struct {
+	Number int
+	ETag   string
+	Size   int64
+}
+
+// incompleteUploadAborter is implemented by the drivers keeping the parts of
+// interrupted multipart uploads
+type incompleteUploadAborter interface {
+	AbortIncompleteUploads(ctx context.Context, olderThan time.Time) (int, int64, error)
+}
+
+// multipartUploader is implemented by the drivers letting clients send the
+// parts of an object themselves, to URLs presigned with the partNumber and
+// uploadId params
+type multipartUploader interface {
+	NewMultipartUpload(ctx context.Context, key, contentType string) (string, error)
+	// ListUploadedParts returns the parts received so far, by part number
+	ListUploadedParts(ctx context.Context, key, uploadID string) ([]UploadedPart, error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) (ObjectInfo, error)
+	// AbortMultipartUpload returns ErrObjectNotFound for uploads already
+	// completed or aborted
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
+
+// bucketOpener is implemented by the drivers able to hold several buckets
+type bucketOpener interface {
+	// Bucket returns a driver bound to bucket name, creating the bucket if needed
+	Bucket(ctx context.Context, name string) (Storage, error)
+}
+
+// StorageService stores the content of files in a Storage driver. The objects
+// of new files are placed by the layout; the ones of older files stay where
+// their FileMetadata says. With an encryptor, content is encrypted while it
+// streams in and decrypted while it streams out; versions stored before
+// encryption was enabled are still served as they are.
+type StorageService struct {
+	backend   Storage // Default bucket
+	layout    *ObjectLayout
+	encryptor *FileEncryptor // nil to store plaintext
+	logger    *zap.Logger
+
+	mu      sync.Mutex
+	buckets map[string]Storage // Company buckets opened so far, by name
+}
+
+func NewStorageService(backend Storage, layout *ObjectLayout, encryptor *FileEncryptor, log *zap.Logger) *StorageService {
+	return &StorageService{backend: backend, layout: layout, encryptor: encryptor, logger: log, buckets: make(map[string]Storage)}
+}
+
+// bucket returns the driver of a bucket, the default one when name is empty
+func (s *StorageService) bucket(name string) (Storage, error) {
+	if name == "" {
+		return s.backend, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if backend, ok := s.buckets[name]; ok {
+		return backend, nil
+	}
+	opener, ok := s.backend.(bucketOpener)
+	if !ok {
+		return nil, fmt.Errorf("storage driver cannot hold bucket %s", name)
+	}
+	backend, err := opener.Bucket(context.Background(), name)
+	if err != nil {
+		return nil, fmt.Errorf("error opening bucket %s: %w", name, err)
+	}
+	s.buckets[name] = backend
+	return backend, nil
+}
+
+// NewFileLocation generates the fileID of a new file of ownerID in folderID,
+// empty at the root, and returns it with the location the layout gives its
+// object
+func (s *StorageService) NewFileLocation(ownerID, folderID string) (string, models.ObjectLocation, error) {
+	fileID := uuid.New().String()
+	location, err := s.layout.Locate(fileID, ownerID, folderID)
+	if err != nil {
+		s.logger.Error("Failed to locate new file", zap.String("fileID", fileID), zap.String("ownerID", ownerID), zap.Error(err))
+		return "", models.ObjectLocation{}, err
+	}
+	return fileID, location, nil
+}
+
+// UploadFile streams file to the object at location, as a new version when it
+// already exists. size may be -1 when the length is not known in advance. The
+// content is encrypted with a new data key wrapped by a KEK of the company of
+// folderID, or of ownerID at the root, and the returned envelope must be saved
+// with the version to read it back.
+func (s *StorageService) UploadFile(file io.Reader, size int64, location models.ObjectLocation, fileName, contentType, ownerID, folderID string) (string, models.FileEncryption, error) {
+	backend, err := s.bucket(location.StorageBucket)
+	if err != nil {
+		s.logger.Error("Failed to upload file", zap.String("object", location.ObjectKey), zap.Error(err))
+		return "", models.FileEncryption{}, err
+	}
+
+	var encryption models.FileEncryption
+	if s.encryptor != nil {
+		aead, envelope, err := s.encryptor.newEnvelope(ownerID, folderID)
+		if err != nil {
+			s.logger.Error("Failed to create data key", zap.String("object", location.ObjectKey), zap.Error(err))
+			return "", encryption, err
+		}
+		encryption = envelope
+		file = newEncryptingReader(file, aead, envelope.Nonce)
+		size = EncryptedSize(size)
+	}
+
+	info, err := backend.Put(context.Background(), location.ObjectKey, file, size, contentType)
+	if err != nil {
+		s.logger.Error("Failed to upload file", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.Error(err))
+		return "", models.FileEncryption{}, err
+	}
+
+	// Log success with the version ID
+	s.logger.Info("File uploaded successfully",
+		zap.String("bucket", location.StorageBucket),
+		zap.String("object", location.ObjectKey),
+		zap.String("fileName", fileName),
+		zap.String("versionID", info.VersionID),
+		zap.String("contentType", contentType),
+		zap.Int64("size", info.Size),
+		zap.Bool("encrypted", encryption.Encrypted()),
+	)
+
+	return info.VersionID, encryption, nil
+}
+
+// RemoveFileVersion permanently deletes one version of an object
+func (s *StorageService) RemoveFileVersion(location models.ObjectLocation, versionID string) error {
+	backend, err := s.bucket(location.StorageBucket)
+	if err == nil {
+		err = backend.RemoveVersion(context.Background(), location.ObjectKey, versionID)
+	}
+	if err != nil {
+		s.logger.Error("Failed to remove file version", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.String("versionID", versionID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetFile opens the current version of a file
+func (s *StorageService) GetFile(file *models.FileMetadata) (Object, ObjectInfo, error) {
+	return s.GetFileVersion(file.Location(), file.VersionID, file.FileEncryption)
+}
+
+// GetFileVersion opens one version of an object, the latest one when
+// versionID is empty. Encrypted versions are decrypted with the data key of
+// their envelope and described by their plaintext size.
+func (s *StorageService) GetFileVersion(location models.ObjectLocation, versionID string, encryption models.FileEncryption) (Object, ObjectInfo, error) {
+	backend, err := s.bucket(location.StorageBucket)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	object, info, err := backend.Get(context.Background(), location.ObjectKey, versionID)
+	if err != nil || !encryption.Encrypted() {
+		return object, info, err
+	}
+
+	if s.encryptor == nil {
+		object.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("%w: encryption is disabled", ErrDecryptionFailed)
+	}
+	aead, err := s.encryptor.openEnvelope(encryption)
+	if err != nil {
+		object.Close()
+		s.logger.Error("Failed to open data key", zap.String("object", location.ObjectKey), zap.String("keyID", encryption.KeyID), zap.Error(err))
+		return nil, ObjectInfo{}, err
+	}
+	decrypted, err := newDecryptingObject(object, info.Size, aead, encryption.Nonce)
+	if err != nil {
+		object.Close()
+		return nil, ObjectInfo{}, err
+	}
+	info.Size = decrypted.size
+	return decrypted, info, nil
+}
+
+// StatFileVersion describes one version of an object, the latest one when
+// versionID is empty. Sizes are the stored sizes, encryption included.
+func (s *StorageService) StatFileVersion(location models.ObjectLocation, versionID string) (ObjectInfo, error) {
+	backend, err := s.bucket(location.StorageBucket)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return backend.Stat(context.Background(), location.ObjectKey, versionID)
+}
+
+// RestoreFileVersion copies an older version of an object on top of it, making
+// it the latest version. It returns the version ID of the copy, which shares
+// the envelope of the copied version.
+func (s *StorageService) RestoreFileVersion(location models.ObjectLocation, versionID string) (string, error) {
+	backend, err := s.bucket(location.StorageBucket)
+	if err != nil {
+		return "", err
+	}
+	info, err := backend.Copy(context.Background(), location.ObjectKey, versionID)
+	if err != nil {
+		s.logger.Error("Failed to restore file version", zap.String("object", location.ObjectKey), zap.String("versionID", versionID), zap.Error(err))
+		return "", err
+	}
+
+	s.logger.Info("File version restored",
+		zap.String("bucket", location.StorageBucket),
+		zap.String("object", location.ObjectKey),
+		zap.String("restoredVersionID", versionID),
+		zap.String("versionID", info.VersionID),
+	)
+	return info.VersionID, nil
+}
+
+// copyObjectVersion copies one version of the object at from, as stored, to be
+// the latest version of the object at to. It returns the version ID of the copy.
+func (s *StorageService) copyObjectVersion(from, to models.ObjectLocation, versionID string) (string, error) {
+	source, err := s.bucket(from.StorageBucket)
+	if err != nil {
+		return "", err
+	}
+	target, err := s.bucket(to.StorageBucket)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	object, info, err := source.Get(ctx, from.ObjectKey, versionID)
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	copied, err := target.Put(ctx, to.ObjectKey, object, info.Size, info.ContentType)
+	if err != nil {
+		return "", err
+	}
+	return copied.VersionID, nil
+}
+
+// ListFileVersions returns every version of an object, delete markers included
+func (s *StorageService) ListFileVersions(location models.ObjectLocation) ([]ObjectInfo, error) {
+	backend, err := s.bucket(location.StorageBucket)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ListVersions(context.Background(), location.ObjectKey)
+}
+
+// ListObjects calls fn with the latest version or delete marker of every
+// object of a bucket, the default one when bucket is empty
+func (s *StorageService) ListObjects(ctx context.Context, bucket string, fn func(ObjectInfo) error) error {
+	backend, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return backend.ListObjects(ctx, "", fn)
+}
+
+// DeleteFile hides an object behind a delete marker. Its versions are kept and
+// the deletion can be undone by removing the marker, whose version ID is returned.
+func (s *StorageService) DeleteFile(location models.ObjectLocation) (string, error) {
+	backend, err := s.bucket(location.StorageBucket)
+	var markerVersionID string
+	if err == nil {
+		markerVersionID, err = backend.Delete(context.Background(), location.ObjectKey)
+	}
+	if err != nil {
+		s.logger.Error("Failed to delete file", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.Error(err))
+		return "", err
+	}
+
+	s.logger.Info("File deleted", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.String("deleteMarkerVersionID", markerVersionID))
+	return markerVersionID, nil
+}
+
+// PurgeFile permanently removes every version and delete marker of an object
+func (s *StorageService) PurgeFile(location models.ObjectLocation) error {
+	versions, err := s.ListFileVersions(location)
+	if err != nil {
+		s.logger.Error("Failed to list file versions", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.Error(err))
+		return err
+	}
+
+	for _, version := range versions {
+		if err := s.RemoveFileVersion(location, version.VersionID); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Info("File purged", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.Int("versions", len(versions)))
+	return nil
+}
+
+// PresignDownload returns a URL downloading the current version of file
+// without credentials until expiry, with the name and type of the file.
+// Encrypted versions must be decrypted by file-service: they get
+// ErrPresignEncrypted.
+func (s *StorageService) PresignDownload(file *models.FileMetadata, contentDisposition string, expiry time.Duration) (*url.URL, error) {
+	if file.Encrypted() {
+		return nil, ErrPresignEncrypted
+	}
+	location := file.Location()
+	backend, err := s.bucket(location.StorageBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	if file.VersionID != "" {
+		params.Set("versionId", file.VersionID)
+	}
+	params.Set("response-content-type", file.ContentType)
+	params.Set("response-content-disposition", contentDisposition)
+	return backend.Presign(context.Background(), http.MethodGet, location.ObjectKey, params, expiry)
+}
+
+// checkDirectUpload makes sure content sent straight to the storage can be
+// stored: it would bypass the encryption at rest
+func (s *StorageService) checkDirectUpload() error {
+	if s.encryptor != nil {
+		return ErrPresignEncrypted
+	}
+	return nil
+}
+
+// multipart returns the driver of location when it takes multipart uploads from clients
+func (s *StorageService) multipart(location models.ObjectLocation) (multipartUploader, error) {
+	backend, err := s.bucket(location.StorageBucket)
+	if err != nil {
+		return nil, err
+	}
+	uploader, ok := backend.(multipartUploader)
+	if !ok {
+		return nil, ErrMultipartNotSupported
+	}
+	return uploader, nil
+}
+
+// StartMultipartUpload starts an upload of the object at location whose parts
+// are sent by the client to the URLs of PresignUploadPart. It returns the ID
+// of the multipart upload.
+func (s *StorageService) StartMultipartUpload(location models.ObjectLocation, contentType string) (string, error) {
+	if err := s.checkDirectUpload(); err != nil {
+		return "", err
+	}
+	uploader, err := s.multipart(location)
+	if err != nil {
+		return "", err
+	}
+	uploadID, err := uploader.NewMultipartUpload(context.Background(), location.ObjectKey, contentType)
+	if err != nil {
+		s.logger.Error("Failed to start multipart upload", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.Error(err))
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// PresignUploadPart returns a URL storing part number of a multipart upload
+// without credentials until expiry. Parts are numbered from 1.
+func (s *StorageService) PresignUploadPart(location models.ObjectLocation, uploadID string, number int, expiry time.Duration) (*url.URL, error) {
+	backend, err := s.bucket(location.StorageBucket)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("partNumber", strconv.Itoa(number))
+	params.Set("uploadId", uploadID)
+	return backend.Presign(context.Background(), http.MethodPut, location.ObjectKey, params, expiry)
+}
+
+// CompleteMultipartUpload assembles the parts received for a multipart upload
+// into a new version of the object and returns its version ID. Parts 1 to
+// parts must all have been received and hold size bytes together, the client
+// is not trusted to list them; ErrIncompleteMultipart is returned otherwise
+// and the upload can still receive the missing parts.
+func (s *StorageService) CompleteMultipartUpload(location models.ObjectLocation, uploadID string, parts int, size int64) (string, error) {
+	uploader, err := s.multipart(location)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	received, err := uploader.ListUploadedParts(ctx, location.ObjectKey, uploadID)
+	if err != nil {
+		return "", err
+	}
+	var total int64
+	for i, part := range received {
+		if part.Number != i+1 {
+			return "", fmt.Errorf("%w: part %d was not received", ErrIncompleteMultipart, i+1)
+		}
+		total += part.Size
+	}
+	if len(received) != parts || total != size {
+		return "", fmt.Errorf("%w: received %d parts holding %d bytes, expected %d parts holding %d bytes", ErrIncompleteMultipart, len(received), total, parts, size)
+	}
+
+	info, err := uploader.CompleteMultipartUpload(ctx, location.ObjectKey, uploadID, received)
+	if err != nil {
+		s.logger.Error("Failed to complete multipart upload", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.Error(err))
+		return "", err
+	}
+
+	s.logger.Info("Multipart upload completed",
+		zap.String("bucket", location.StorageBucket),
+		zap.String("object", location.ObjectKey),
+		zap.String("versionID", info.VersionID),
+		zap.Int("parts", parts),
+		zap.Int64("size", total),
+	)
+	return info.VersionID, nil
+}
+
+// DiscardDirectUpload drops what a client sent straight to the storage for
+// an upload that will not be recorded: the parts of its multipart upload, or
+// the object it stored at a location no file points to. The object is purged
+// even when the parts cannot be aborted: the upload may have been completed
+// before being given up.
+func (s *StorageService) DiscardDirectUpload(location models.ObjectLocation, uploadID string) error {
+	var abortErr error
+	if uploadID != "" {
+		uploader, err := s.multipart(location)
+		if err == nil {
+			err = uploader.AbortMultipartUpload(context.Background(), location.ObjectKey, uploadID)
+		}
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			s.logger.Error("Failed to abort multipart upload", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.Error(err))
+			abortErr = err
+		}
+	}
+
+	if err := s.PurgeFile(location); err != nil {
+		return err
+	}
+	return abortErr
+}
+
+// AbortIncompleteUploads removes the parts of multipart uploads started before
+// olderThan that were never completed, in the default bucket and the company
+// buckets opened since the service started. It returns how many uploads were
+// aborted and how many bytes their parts held. Drivers writing objects in one
+// piece have nothing to abort.
+func (s *StorageService) AbortIncompleteUploads(ctx context.Context, olderThan time.Time) (int, int64, error) {
+	s.mu.Lock()
+	backends := []Storage{s.backend}
+	for _, backend := range s.buckets {
+		backends = append(backends, backend)
+	}
+	s.mu.Unlock()
+
+	var aborted int
+	var reclaimed int64
+	for _, backend := range backends {
+		aborter, ok := backend.(incompleteUploadAborter)
+		if !ok {
+			continue
+		}
+		n, size, err := aborter.AbortIncompleteUploads(ctx, olderThan)
+		aborted += n
+		reclaimed += size
+		if err != nil {
+			return aborted, reclaimed, err
+		}
+	}
+	return aborted, reclaimed, nil
+}
@@ -0,0 +1,404 @@
+package services
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	localManifestName  = ".versions.json" // Versions of the object stored in a directory
+	localVersionPrefix = ".v-"            // Content of one version
+	localTempDir       = ".tmp"           // Uploads in progress, renamed into place once complete
+	localBucketsDir    = ".buckets"       // Other buckets, one root directory each
+)
+
+// LocalStorage stores objects on a local or mounted filesystem, for small
+// installations running without MinIO. Each key is a directory holding one
+// file per version and a manifest listing the versions, newest first, delete
+// markers included. Manifests are guarded by a mutex of the process: the
+// directory must not be shared by several file-service instances.
+type LocalStorage struct {
+	root string
+	mu   sync.Mutex
+}
+
+// localVersion is one entry of a manifest
+type localVersion struct {
+	VersionID    string    `json:"versionId"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"contentType,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+	DeleteMarker bool      `json:"deleteMarker,omitempty"`
+}
+
+// NewLocalStorage stores objects under root, creating it if needed. Uploads
+// interrupted by a previous crash are removed.
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	tempDir := filepath.Join(root, localTempDir)
+	if err := os.RemoveAll(tempDir); err != nil {
+		return nil, fmt.Errorf("error cleaning the temporary directory: %w", err)
+	}
+	if err := os.MkdirAll(tempDir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating storage directory: %w", err)
+	}
+	return &LocalStorage{root: root}, nil
+}
+
+// Bucket returns the storage of another bucket, kept in a directory of root.
+// It must be opened once per process, opening it again would drop the uploads
+// in progress.
+func (l *LocalStorage) Bucket(ctx context.Context, name string) (Storage, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid bucket name %q", name)
+	}
+	return NewLocalStorage(filepath.Join(l.root, localBucketsDir, name))
+}
+
+// objectDir returns the directory of key. Keys are slash separated; segments
+// starting with a dot are reserved for the files of the driver.
+func (l *LocalStorage) objectDir(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidObjectKey, key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || strings.HasPrefix(segment, ".") {
+			return "", fmt.Errorf("%w: %q", ErrInvalidObjectKey, key)
+		}
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// readManifest returns the versions of the object in dir, newest first. The
+// caller must hold the mutex.
+func (l *LocalStorage) readManifest(dir string) ([]localVersion, error) {
+	data, err := os.ReadFile(filepath.Join(dir, localManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []localVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("error decoding manifest of %s: %w", dir, err)
+	}
+	return versions, nil
+}
+
+// writeManifest replaces the manifest of the object in dir, removing it when
+// no version is left. The caller must hold the mutex.
+func (l *LocalStorage) writeManifest(dir string, versions []localVersion) error {
+	manifest := filepath.Join(dir, localManifestName)
+	if len(versions) == 0 {
+		if err := os.Remove(manifest); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, localManifestName+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// The rename is atomic, readers never see a partial manifest
+	if err := os.Rename(tmp.Name(), manifest); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func versionPath(dir, versionID string) string {
+	return filepath.Join(dir, localVersionPrefix+versionID)
+}
+
+func (v localVersion) info(key string, latest bool) ObjectInfo {
+	return ObjectInfo{
+		Key:            key,
+		VersionID:      v.VersionID,
+		Size:           v.Size,
+		ContentType:    v.ContentType,
+		ETag:           v.ETag,
+		LastModified:   v.LastModified,
+		IsLatest:       latest,
+		IsDeleteMarker: v.DeleteMarker,
+	}
+}
+
+// find returns a version of the object in dir, the latest one when versionID
+// is empty. The caller must hold the mutex.
+func (l *LocalStorage) find(key, dir, versionID string) (localVersion, bool, error) {
+	versions, err := l.readManifest(dir)
+	if err != nil {
+		return localVersion{}, false, err
+	}
+	for i, version := range versions {
+		if versionID == "" || version.VersionID == versionID {
+			if version.DeleteMarker {
+				break
+			}
+			return version, i == 0, nil
+		}
+	}
+	if versionID == "" {
+		return localVersion{}, false, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return localVersion{}, false, fmt.Errorf("%w: %s version %s", ErrObjectNotFound, key, versionID)
+}
+
+// prepend records version as the latest one of the object in dir. The caller
+// must hold the mutex.
+func (l *LocalStorage) prepend(dir string, version localVersion) error {
+	versions, err := l.readManifest(dir)
+	if err != nil {
+		return err
+	}
+	return l.writeManifest(dir, append([]localVersion{version}, versions...))
+}
+
+func (l *LocalStorage) Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	dir, err := l.objectDir(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// The content is written outside of the lock, then renamed into place
+	tmp, err := os.CreateTemp(filepath.Join(l.root, localTempDir), "put-*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	hash := md5.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if size >= 0 && written != size {
+		return ObjectInfo{}, fmt.Errorf("expected %d bytes, received %d", size, written)
+	}
+
+	version := localVersion{
+		VersionID:    uuid.New().String(),
+		Size:         written,
+		ContentType:  contentType,
+		ETag:         hex.EncodeToString(hash.Sum(nil)),
+		LastModified: time.Now().UTC(),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), versionPath(dir, version.VersionID)); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := l.prepend(dir, version); err != nil {
+		os.Remove(versionPath(dir, version.VersionID))
+		return ObjectInfo{}, err
+	}
+	return version.info(key, true), nil
+}
+
+// Get opens the file of a version. It stays readable if the version is
+// removed while being served.
+func (l *LocalStorage) Get(ctx context.Context, key, versionID string) (Object, ObjectInfo, error) {
+	dir, err := l.objectDir(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	version, latest, err := l.find(key, dir, versionID)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	file, err := os.Open(versionPath(dir, version.VersionID))
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return file, version.info(key, latest), nil
+}
+
+func (l *LocalStorage) Stat(ctx context.Context, key, versionID string) (ObjectInfo, error) {
+	dir, err := l.objectDir(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	version, latest, err := l.find(key, dir, versionID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return version.info(key, latest), nil
+}
+
+func (l *LocalStorage) Copy(ctx context.Context, key, versionID string) (ObjectInfo, error) {
+	content, info, err := l.Get(ctx, key, versionID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer content.Close()
+	return l.Put(ctx, key, content, info.Size, info.ContentType)
+}
+
+func (l *LocalStorage) Delete(ctx context.Context, key string) (string, error) {
+	dir, err := l.objectDir(key)
+	if err != nil {
+		return "", err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+	marker := localVersion{
+		VersionID:    uuid.New().String(),
+		LastModified: time.Now().UTC(),
+		DeleteMarker: true,
+	}
+	if err := l.prepend(dir, marker); err != nil {
+		return "", err
+	}
+	return marker.VersionID, nil
+}
+
+// RemoveVersion drops a version from the manifest, then its file. Like S3,
+// removing a version that does not exist succeeds.
+func (l *LocalStorage) RemoveVersion(ctx context.Context, key, versionID string) error {
+	dir, err := l.objectDir(key)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	versions, err := l.readManifest(dir)
+	if err != nil {
+		return err
+	}
+	for i, version := range versions {
+		if version.VersionID != versionID {
+			continue
+		}
+		remaining := append(versions[:i:i], versions[i+1:]...)
+		if err := l.writeManifest(dir, remaining); err != nil {
+			return err
+		}
+		if !version.DeleteMarker {
+			if err := os.Remove(versionPath(dir, versionID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if len(remaining) == 0 {
+			os.Remove(dir) // Fails while child keys live below, which is fine
+		}
+		return nil
+	}
+	return nil
+}
+
+func (l *LocalStorage) ListVersions(ctx context.Context, key string) ([]ObjectInfo, error) {
+	dir, err := l.objectDir(key)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	versions, err := l.readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []ObjectInfo
+	for i, version := range versions {
+		infos = append(infos, version.info(key, i == 0))
+	}
+	return infos, nil
+}
+
+// ListObjects walks the directories of root, skipping the ones of the driver
+// and of other buckets
+func (l *LocalStorage) ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(l.root, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // Removed during the listing
+		}
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() || path == l.root {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key+"/") {
+			return filepath.SkipDir
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil // Only a parent of the prefix
+		}
+
+		l.mu.Lock()
+		versions, err := l.readManifest(path)
+		l.mu.Unlock()
+		if err != nil || len(versions) == 0 {
+			return err
+		}
+		return fn(versions[0].info(key, true))
+	})
+}
+
+// Presign is not supported, local objects are only reachable through file-service
+func (l *LocalStorage) Presign(ctx context.Context, method, key string, params url.Values, expiry time.Duration) (*url.URL, error) {
+	return nil, ErrPresignNotSupported
+}
@@ -0,0 +1,254 @@
+package services
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStorage keeps objects in the process memory. It is meant for tests
+// and single instance development setups.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	objects map[string][]memoryVersion // Newest version first
+	buckets map[string]*MemoryStorage  // Other buckets, by name
+}
+
+// memoryChunkSize is the size of the blocks holding stored content, so that
+// storing an object allocates its size and not a growing buffer
+const memoryChunkSize = 64 * 1024
+
+type memoryVersion struct {
+	info    ObjectInfo
+	content memoryContent
+}
+
+// memoryContent is stored content split in blocks of memoryChunkSize bytes,
+// the last one possibly shorter
+type memoryContent [][]byte
+
+func (c memoryContent) ReadAt(p []byte, offset int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		chunk := int((offset + int64(read)) / memoryChunkSize)
+		if offset < 0 || chunk >= len(c) {
+			return read, io.EOF
+		}
+		within := int((offset + int64(read)) % memoryChunkSize)
+		if within >= len(c[chunk]) {
+			return read, io.EOF
+		}
+		read += copy(p[read:], c[chunk][within:])
+	}
+	return read, nil
+}
+
+// readMemoryContent stores content in blocks and returns its size and MD5
+func readMemoryContent(content io.Reader) (memoryContent, int64, []byte, error) {
+	hash := md5.New()
+	content = io.TeeReader(content, hash)
+
+	var chunks memoryContent
+	var size int64
+	for {
+		chunk := make([]byte, memoryChunkSize)
+		n, err := io.ReadFull(content, chunk)
+		if n > 0 {
+			chunks = append(chunks, chunk[:n])
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return chunks, size, hash.Sum(nil), nil
+		}
+		if err != nil {
+			return nil, 0, nil, err
+		}
+	}
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: make(map[string][]memoryVersion), buckets: make(map[string]*MemoryStorage)}
+}
+
+// Bucket returns the storage of another bucket, kept with this one
+func (m *MemoryStorage) Bucket(ctx context.Context, name string) (Storage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket, ok := m.buckets[name]
+	if !ok {
+		bucket = NewMemoryStorage()
+		m.buckets[name] = bucket
+	}
+	return bucket, nil
+}
+
+// memoryObject serves a stored version, which is never modified in place
+type memoryObject struct {
+	*io.SectionReader
+}
+
+func (memoryObject) Close() error { return nil }
+
+// find returns a version of key, the latest one when versionID is empty. The
+// caller must hold the mutex.
+func (m *MemoryStorage) find(key, versionID string) (memoryVersion, error) {
+	versions := m.objects[key]
+	if versionID == "" {
+		if len(versions) == 0 || versions[0].info.IsDeleteMarker {
+			return memoryVersion{}, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		return versions[0], nil
+	}
+	for _, version := range versions {
+		if version.info.VersionID == versionID && !version.info.IsDeleteMarker {
+			return version, nil
+		}
+	}
+	return memoryVersion{}, fmt.Errorf("%w: %s version %s", ErrObjectNotFound, key, versionID)
+}
+
+// add makes version the latest one of key. The caller must hold the mutex.
+func (m *MemoryStorage) add(key string, version memoryVersion) ObjectInfo {
+	versions := m.objects[key]
+	for i := range versions {
+		versions[i].info.IsLatest = false
+	}
+	version.info.Key = key
+	version.info.VersionID = uuid.New().String()
+	version.info.LastModified = time.Now().UTC()
+	version.info.IsLatest = true
+	m.objects[key] = append([]memoryVersion{version}, versions...)
+	return version.info
+}
+
+func (m *MemoryStorage) Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	if key == "" {
+		return ObjectInfo{}, ErrInvalidObjectKey
+	}
+	data, received, sum, err := readMemoryContent(content)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if size >= 0 && received != size {
+		return ObjectInfo{}, fmt.Errorf("expected %d bytes, received %d", size, received)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.add(key, memoryVersion{
+		info: ObjectInfo{
+			Size:        received,
+			ContentType: contentType,
+			ETag:        hex.EncodeToString(sum),
+		},
+		content: data,
+	}), nil
+}
+
+func (m *MemoryStorage) Get(ctx context.Context, key, versionID string) (Object, ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	version, err := m.find(key, versionID)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return memoryObject{io.NewSectionReader(version.content, 0, version.info.Size)}, version.info, nil
+}
+
+func (m *MemoryStorage) Stat(ctx context.Context, key, versionID string) (ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	version, err := m.find(key, versionID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return version.info, nil
+}
+
+func (m *MemoryStorage) Copy(ctx context.Context, key, versionID string) (ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	version, err := m.find(key, versionID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	// Versions are never modified, the copy shares its content
+	return m.add(key, memoryVersion{info: version.info, content: version.content}), nil
+}
+
+func (m *MemoryStorage) Delete(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	marker := m.add(key, memoryVersion{info: ObjectInfo{IsDeleteMarker: true}})
+	return marker.VersionID, nil
+}
+
+func (m *MemoryStorage) RemoveVersion(ctx context.Context, key, versionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	versions := m.objects[key]
+	for i, version := range versions {
+		if version.info.VersionID != versionID {
+			continue
+		}
+		versions = append(versions[:i:i], versions[i+1:]...)
+		if len(versions) == 0 {
+			delete(m.objects, key)
+			return nil
+		}
+		versions[0].info.IsLatest = true
+		m.objects[key] = versions
+		return nil
+	}
+	// Like S3, removing a version that does not exist succeeds
+	return nil
+}
+
+func (m *MemoryStorage) ListVersions(ctx context.Context, key string) ([]ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var versions []ObjectInfo
+	for _, version := range m.objects[key] {
+		versions = append(versions, version.info)
+	}
+	return versions, nil
+}
+
+func (m *MemoryStorage) ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	// fn is called without the mutex, it may use the storage
+	m.mu.Lock()
+	var latest []ObjectInfo
+	for key, versions := range m.objects {
+		if len(versions) > 0 && strings.HasPrefix(key, prefix) {
+			latest = append(latest, versions[0].info)
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(latest, func(i, j int) bool { return latest[i].Key < latest[j].Key })
+	for _, info := range latest {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Presign is not supported, memory objects are only reachable through file-service
+func (m *MemoryStorage) Presign(ctx context.Context, method, key string, params url.Values, expiry time.Duration) (*url.URL, error) {
+	return nil, ErrPresignNotSupported
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"file-service/internal/models"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const migrationBatchSize = 200
+
+var errFileChangedDuringMigration = errors.New("file changed while its object was moved")
+
+// StorageMigrationReport sums up a run of StorageMigrator
+type StorageMigrationReport struct {
+	Checked int // Files looked at, trashed ones included
+	Moved   int // Files whose versions were copied to their new location
+	Failed  int // Files left where they were, see the logs
+}
+
+// StorageMigrator moves the objects of existing files to the location the
+// current layout gives them. Every version is copied as stored, encrypted
+// versions keep their envelope, then the metadata is pointed at the copies
+// and the old object is removed. Files uploaded meanwhile get their new
+// versions at the old location, so it must run while file-service is stopped.
+type StorageMigrator struct {
+	db      *gorm.DB
+	storage *StorageService
+	logger  *zap.Logger
+}
+
+func NewStorageMigrator(db *gorm.DB, storage *StorageService, log *zap.Logger) *StorageMigrator {
+	return &StorageMigrator{db: db, storage: storage, logger: log}
+}
+
+// Run moves every misplaced file. With dryRun nothing is changed, the files
+// that would move are only logged and counted as moved.
+func (m *StorageMigrator) Run(ctx context.Context, dryRun bool) (StorageMigrationReport, error) {
+	var report StorageMigrationReport
+
+	lastFileID := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		var files []models.FileMetadata
+		err := m.db.Unscoped().Where("file_id > ?", lastFileID).
+			Order("file_id").Limit(migrationBatchSize).Find(&files).Error
+		if err != nil {
+			return report, fmt.Errorf("error listing files to migrate: %w", err)
+		}
+		if len(files) == 0 {
+			return report, nil
+		}
+
+		for i := range files {
+			file := &files[i]
+			lastFileID = file.FileID
+			report.Checked++
+
+			moved, err := m.migrateFile(file, dryRun)
+			switch {
+			case err != nil:
+				report.Failed++
+				m.logger.Error("Failed to migrate file", zap.String("fileID", file.FileID), zap.Error(err))
+			case moved:
+				report.Moved++
+			}
+		}
+	}
+}
+
+// migrateFile moves the object of file if the layout places it elsewhere and
+// reports whether it did
+func (m *StorageMigrator) migrateFile(file *models.FileMetadata, dryRun bool) (bool, error) {
+	source := file.Location()
+	var folderID string
+	if file.FolderID != nil {
+		folderID = *file.FolderID
+	}
+	target, err := m.storage.layout.Locate(file.FileID, file.UserID, folderID)
+	if err != nil {
+		return false, err
+	}
+
+	if target == source {
+		// Files stored before locations were recorded are already in place
+		if file.ObjectKey == "" && !dryRun {
+			err := m.db.Unscoped().Model(&models.FileMetadata{}).
+				Where("file_id = ? AND object_key = ''", file.FileID).
+				Updates(map[string]interface{}{"storage_bucket": target.StorageBucket, "object_key": target.ObjectKey}).Error
+			if err != nil {
+				return false, fmt.Errorf("error recording location: %w", err)
+			}
+		}
+		return false, nil
+	}
+
+	m.logger.Info("Moving file",
+		zap.String("fileID", file.FileID),
+		zap.String("fromBucket", source.StorageBucket),
+		zap.String("fromObject", source.ObjectKey),
+		zap.String("toBucket", target.StorageBucket),
+		zap.String("toObject", target.ObjectKey),
+		zap.Bool("dryRun", dryRun),
+	)
+	if dryRun {
+		return true, nil
+	}
+
+	versionIDs, markerVersionID, err := m.copyVersions(file, source, target)
+	if err == nil {
+		err = m.relocate(file, target, versionIDs, markerVersionID)
+	}
+	if err != nil {
+		// The copies are not referenced, the file stays where it was
+		if purgeErr := m.storage.PurgeFile(target); purgeErr != nil {
+			m.logger.Error("Failed to remove the copies of a file", zap.String("fileID", file.FileID), zap.Error(purgeErr))
+		}
+		return false, err
+	}
+
+	if err := m.storage.PurgeFile(source); err != nil {
+		// The file is served from its new location, only storage is wasted
+		m.logger.Warn("Failed to remove the old object of a moved file", zap.String("fileID", file.FileID), zap.Error(err))
+	}
+	return true, nil
+}
+
+// copyVersions copies the versions of the object at source, oldest first so
+// the latest stays the latest, and hides the copy again when file is
+// trashed. It returns the new version IDs by old version ID and the version
+// ID of the new delete marker.
+func (m *StorageMigrator) copyVersions(file *models.FileMetadata, source, target models.ObjectLocation) (map[string]string, string, error) {
+	versions, err := m.storage.ListFileVersions(source)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing versions: %w", err)
+	}
+
+	versionIDs := make(map[string]string)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].IsDeleteMarker {
+			continue
+		}
+		copied, err := m.storage.copyObjectVersion(source, target, versions[i].VersionID)
+		if err != nil {
+			return nil, "", fmt.Errorf("error copying version %s: %w", versions[i].VersionID, err)
+		}
+		versionIDs[versions[i].VersionID] = copied
+	}
+
+	if file.DeleteMarkerVersionID == "" {
+		return versionIDs, "", nil
+	}
+	markerVersionID, err := m.storage.DeleteFile(target)
+	if err != nil {
+		return nil, "", err
+	}
+	return versionIDs, markerVersionID, nil
+}
+
+// relocate points the metadata of file and of its versions at the copies
+func (m *StorageMigrator) relocate(file *models.FileMetadata, target models.ObjectLocation, versionIDs map[string]string, markerVersionID string) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		var current models.FileMetadata
+		err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("file_id = ?", file.FileID).First(&current).Error
+		if err != nil {
+			return err
+		}
+		if current.VersionID != file.VersionID || current.DeleteMarkerVersionID != file.DeleteMarkerVersionID || current.Location() != file.Location() {
+			return errFileChangedDuringMigration
+		}
+
+		updates := map[string]interface{}{
+			"storage_bucket":           target.StorageBucket,
+			"object_key":               target.ObjectKey,
+			"delete_marker_version_id": markerVersionID,
+		}
+		if current.VersionID != "" {
+			versionID, ok := versionIDs[current.VersionID]
+			if !ok {
+				return fmt.Errorf("current version %s is not stored", current.VersionID)
+			}
+			updates["version_id"] = versionID
+		}
+		if err := tx.Unscoped().Model(&models.FileMetadata{}).Where("file_id = ?", file.FileID).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		var versions []models.FileVersion
+		if err := tx.Where("file_id = ?", file.FileID).Find(&versions).Error; err != nil {
+			return err
+		}
+		for _, version := range versions {
+			versionID, ok := versionIDs[version.VersionID]
+			if !ok {
+				return fmt.Errorf("version %d (%s) is not stored", version.Version, version.VersionID)
+			}
+			if err := tx.Model(&version).Update("version_id", versionID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,466 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"file-service/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	reconcileBatchSize = 200
+	quarantinePrefix   = "quarantine/" // Orphan objects are moved below this prefix of their bucket
+	reconcileLockKey   = "storage-reconciler"
+)
+
+// ErrReconcileRunning is returned by Run while another replica reconciles
+var ErrReconcileRunning = errors.New("storage reconciliation already running")
+
+var (
+	reconcileOrphanObjects = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "file_service_reconcile_orphan_objects",
+		Help: "Stored objects without file metadata found by the last reconciliation",
+	})
+	reconcileOrphanBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "file_service_reconcile_orphan_bytes",
+		Help: "Bytes held by the versions of the orphan objects found by the last reconciliation",
+	})
+	reconcileBrokenFiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "file_service_reconcile_broken_files",
+		Help: "Files whose stored versions were missing at the last reconciliation",
+	})
+	reconcileFailedChecks = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "file_service_reconcile_failed_checks",
+		Help: "Objects and files the last reconciliation could not check or repair",
+	})
+	reconcileLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "file_service_reconcile_last_run_timestamp_seconds",
+		Help: "Time the last complete reconciliation finished",
+	})
+	reconcileRepairsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "file_service_reconcile_repairs_total",
+		Help: "Drift repaired by the reconciler, by action: quarantine, flag or unflag",
+	}, []string{"action"})
+)
+
+// ReconcileReport sums up a run of StorageReconciler
+type ReconcileReport struct {
+	ObjectsChecked int   // Objects old enough to be checked
+	OrphanObjects  int   // Objects no file points at
+	OrphanBytes    int64 // Bytes of all the versions of the orphan objects
+	Quarantined    int   // Orphan objects moved below quarantinePrefix
+	FilesChecked   int   // Files looked at, trashed ones included
+	BrokenFiles    int   // Files with versions missing from the storage
+	Flagged        int   // Broken files newly flagged with StorageMissingAt
+	Unflagged      int   // Flagged files whose versions are stored again
+	Failed         int   // Objects and files that could not be checked or repaired, see the logs
+}
+
+// StorageReconciler finds the drift between the storage and the file_metadata
+// table: objects left behind by uploads whose metadata was never saved, and
+// files whose versions are missing from the storage. When repairing, orphan
+// objects are moved below quarantinePrefix so they can still be inspected,
+// and broken files are flagged with StorageMissingAt, which is cleared once
+// their versions are found again.
+//
+// Objects younger than minAge are skipped: they may belong to uploads whose
+// metadata is not saved yet. Only the default bucket and the buckets holding
+// files are walked.
+type StorageReconciler struct {
+	db       *gorm.DB
+	storage  *StorageService
+	minAge   time.Duration
+	interval time.Duration
+	repair   bool // Repair the drift found by the scheduled runs
+	logger   *zap.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewStorageReconciler(db *gorm.DB, storage *StorageService, minAge, interval time.Duration, repair bool, log *zap.Logger) *StorageReconciler {
+	return &StorageReconciler{
+		db:       db,
+		storage:  storage,
+		minAge:   minAge,
+		interval: interval,
+		repair:   repair,
+		logger:   log,
+	}
+}
+
+// Start runs the reconciler in the background until Stop is called. Nothing is
+// scheduled with a zero interval.
+func (r *StorageReconciler) Start() {
+	if r.interval <= 0 {
+		r.logger.Info("Storage reconciler disabled")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		r.logger.Info("Storage reconciler started", zap.Duration("interval", r.interval), zap.Duration("minAge", r.minAge), zap.Bool("repair", r.repair))
+		for {
+			select {
+			case <-ticker.C:
+				report, err := r.Run(ctx, r.repair)
+				if errors.Is(err, ErrReconcileRunning) {
+					r.logger.Info("Storage reconciliation skipped, another replica is running it")
+					continue
+				}
+				if err != nil {
+					r.logger.Error("Storage reconciliation stopped", zap.Error(err))
+					continue
+				}
+				r.logger.Info("Storage reconciled",
+					zap.Int("orphanObjects", report.OrphanObjects),
+					zap.Int("brokenFiles", report.BrokenFiles),
+					zap.Int("quarantined", report.Quarantined),
+					zap.Int("flagged", report.Flagged),
+					zap.Int("failed", report.Failed),
+				)
+			case <-ctx.Done():
+				r.logger.Info("Storage reconciler stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop interrupts the current run, if any, and waits for the reconciler to exit
+func (r *StorageReconciler) Stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+}
+
+// Run checks every object and every file once, repairing the drift when
+// repair is set. The drift gauges are only updated by complete runs. Replicas
+// take turns through a session advisory lock, held on a connection of its own
+// for the whole run.
+func (r *StorageReconciler) Run(ctx context.Context, repair bool) (ReconcileReport, error) {
+	var report ReconcileReport
+	err := r.db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		var locked bool
+		if err := conn.Raw("SELECT pg_try_advisory_lock(hashtext(?))", reconcileLockKey).Scan(&locked).Error; err != nil {
+			return fmt.Errorf("error taking the reconciliation lock: %w", err)
+		}
+		if !locked {
+			return ErrReconcileRunning
+		}
+		defer func() {
+			// The connection goes back to the pool, the lock must not stay on it
+			err := conn.WithContext(context.Background()).Exec("SELECT pg_advisory_unlock(hashtext(?))", reconcileLockKey).Error
+			if err != nil {
+				r.logger.Error("Failed to release the reconciliation lock", zap.Error(err))
+			}
+		}()
+
+		var err error
+		report, err = r.reconcile(ctx, repair)
+		return err
+	})
+	return report, err
+}
+
+// reconcile does the work of Run once the lock is taken
+func (r *StorageReconciler) reconcile(ctx context.Context, repair bool) (ReconcileReport, error) {
+	var report ReconcileReport
+
+	if err := r.checkObjects(ctx, &report, repair); err != nil {
+		return report, err
+	}
+	if err := r.checkFiles(ctx, &report, repair); err != nil {
+		return report, err
+	}
+
+	reconcileOrphanObjects.Set(float64(report.OrphanObjects))
+	reconcileOrphanBytes.Set(float64(report.OrphanBytes))
+	reconcileBrokenFiles.Set(float64(report.BrokenFiles))
+	reconcileFailedChecks.Set(float64(report.Failed))
+	reconcileLastRun.SetToCurrentTime()
+	return report, nil
+}
+
+// checkObjects walks the buckets and looks for the objects no file points at
+func (r *StorageReconciler) checkObjects(ctx context.Context, report *ReconcileReport, repair bool) error {
+	var buckets []string
+	err := r.db.Unscoped().Model(&models.FileMetadata{}).
+		Where("COALESCE(storage_bucket, '') <> ''").Distinct().Pluck("storage_bucket", &buckets).Error
+	if err != nil {
+		return fmt.Errorf("error listing buckets: %w", err)
+	}
+	buckets = append([]string{""}, buckets...)
+
+	cutoff := time.Now().Add(-r.minAge)
+	for _, bucket := range buckets {
+		// Orphans are handled once listed, moving objects could disturb the listing
+		var orphans []models.ObjectLocation
+		var batch []ObjectInfo
+		flush := func() error {
+			found, err := r.orphanObjects(bucket, batch)
+			orphans = append(orphans, found...)
+			batch = batch[:0]
+			return err
+		}
+
+		err := r.storage.ListObjects(ctx, bucket, func(info ObjectInfo) error {
+			if strings.HasPrefix(info.Key, quarantinePrefix) || info.LastModified.After(cutoff) {
+				return nil
+			}
+			report.ObjectsChecked++
+			batch = append(batch, info)
+			if len(batch) < reconcileBatchSize {
+				return nil
+			}
+			return flush()
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return fmt.Errorf("error checking the objects of bucket %q: %w", bucket, err)
+		}
+
+		for _, location := range orphans {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			r.handleOrphan(location, report, repair)
+		}
+	}
+	return nil
+}
+
+// orphanObjects returns the objects of batch no file points at
+func (r *StorageReconciler) orphanObjects(bucket string, batch []ObjectInfo) ([]models.ObjectLocation, error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(batch))
+	for i, info := range batch {
+		keys[i] = info.Key
+	}
+
+	known, err := r.knownObjects(bucket, keys)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []models.ObjectLocation
+	for _, info := range batch {
+		if !known[info.Key] {
+			orphans = append(orphans, models.ObjectLocation{StorageBucket: bucket, ObjectKey: info.Key})
+		}
+	}
+	return orphans, nil
+}
+
+// knownObjects returns which keys of bucket are the object of a file, trashed
+// files included. Files stored before locations were recorded have no key and
+// are found by fileID in the default bucket.
+func (r *StorageReconciler) knownObjects(bucket string, keys []string) (map[string]bool, error) {
+	query := r.db.Unscoped().Model(&models.FileMetadata{}).Select("file_id", "storage_bucket", "object_key").
+		Where("COALESCE(storage_bucket, '') = ?", bucket)
+	if bucket == "" {
+		query = query.Where("object_key IN ? OR (COALESCE(object_key, '') = '' AND file_id IN ?)", keys, keys)
+	} else {
+		query = query.Where("object_key IN ?", keys)
+	}
+
+	var files []models.FileMetadata
+	if err := query.Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("error looking up objects: %w", err)
+	}
+	known := make(map[string]bool, len(files))
+	for _, file := range files {
+		known[file.Location().ObjectKey] = true
+	}
+	return known, nil
+}
+
+// handleOrphan reports an orphan object and, when repairing, quarantines it
+func (r *StorageReconciler) handleOrphan(location models.ObjectLocation, report *ReconcileReport, repair bool) {
+	versions, err := r.storage.ListFileVersions(location)
+	if err != nil {
+		report.Failed++
+		r.logger.Error("Failed to list the versions of an orphan object", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.Error(err))
+		return
+	}
+	var size int64
+	for _, version := range versions {
+		size += version.Size
+	}
+
+	report.OrphanObjects++
+	report.OrphanBytes += size
+	r.logger.Warn("Orphan object",
+		zap.String("bucket", location.StorageBucket),
+		zap.String("object", location.ObjectKey),
+		zap.Int("versions", len(versions)),
+		zap.Int64("size", size),
+	)
+	if !repair {
+		return
+	}
+
+	// The metadata of a slow upload may have been saved since the lookup
+	known, err := r.knownObjects(location.StorageBucket, []string{location.ObjectKey})
+	if err != nil || known[location.ObjectKey] {
+		if err != nil {
+			report.Failed++
+			r.logger.Error("Failed to look up an orphan object", zap.String("object", location.ObjectKey), zap.Error(err))
+		}
+		return
+	}
+
+	if err := r.quarantine(location, versions); err != nil {
+		report.Failed++
+		r.logger.Error("Failed to quarantine an orphan object", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey), zap.Error(err))
+		return
+	}
+	report.Quarantined++
+	reconcileRepairsTotal.WithLabelValues("quarantine").Inc()
+	r.logger.Info("Orphan object quarantined", zap.String("bucket", location.StorageBucket), zap.String("object", location.ObjectKey))
+}
+
+// quarantine moves the versions of the object at location below
+// quarantinePrefix of its bucket, oldest first, as stored
+func (r *StorageReconciler) quarantine(location models.ObjectLocation, versions []ObjectInfo) error {
+	target := models.ObjectLocation{StorageBucket: location.StorageBucket, ObjectKey: quarantinePrefix + location.ObjectKey}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].IsDeleteMarker {
+			continue
+		}
+		if _, err := r.storage.copyObjectVersion(location, target, versions[i].VersionID); err != nil {
+			return fmt.Errorf("error copying version %s: %w", versions[i].VersionID, err)
+		}
+	}
+	return r.storage.PurgeFile(location)
+}
+
+// checkFiles walks the file_metadata table and looks for the files whose
+// versions are missing from the storage
+func (r *StorageReconciler) checkFiles(ctx context.Context, report *ReconcileReport, repair bool) error {
+	lastFileID := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var files []models.FileMetadata
+		err := r.db.Unscoped().Where("file_id > ?", lastFileID).
+			Order("file_id").Limit(reconcileBatchSize).Find(&files).Error
+		if err != nil {
+			return fmt.Errorf("error listing files to reconcile: %w", err)
+		}
+		if len(files) == 0 {
+			return nil
+		}
+
+		fileIDs := make([]string, len(files))
+		for i := range files {
+			fileIDs[i] = files[i].FileID
+		}
+		var versions []models.FileVersion
+		if err := r.db.Where("file_id IN ?", fileIDs).Find(&versions).Error; err != nil {
+			return fmt.Errorf("error listing file versions to reconcile: %w", err)
+		}
+		versionIDs := make(map[string][]string)
+		for _, version := range versions {
+			versionIDs[version.FileID] = append(versionIDs[version.FileID], version.VersionID)
+		}
+
+		for i := range files {
+			file := &files[i]
+			lastFileID = file.FileID
+			report.FilesChecked++
+			r.checkFile(file, versionIDs[file.FileID], report, repair)
+		}
+	}
+}
+
+// checkFile reports the versions of file missing from the storage and, when
+// repairing, flags or unflags the file
+func (r *StorageReconciler) checkFile(file *models.FileMetadata, versionIDs []string, report *ReconcileReport, repair bool) {
+	location := file.Location()
+	objects, err := r.storage.ListFileVersions(location)
+	if err != nil {
+		report.Failed++
+		r.logger.Error("Failed to list the versions of a file", zap.String("fileID", file.FileID), zap.Error(err))
+		return
+	}
+	stored := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		if !object.IsDeleteMarker {
+			stored[object.VersionID] = true
+		}
+	}
+
+	var missing []string
+	if file.VersionID != "" && !stored[file.VersionID] {
+		missing = append(missing, file.VersionID)
+	}
+	if file.VersionID == "" && len(stored) == 0 {
+		missing = append(missing, "latest")
+	}
+	for _, versionID := range versionIDs {
+		if versionID != file.VersionID && !stored[versionID] {
+			missing = append(missing, versionID)
+		}
+	}
+
+	if len(missing) > 0 {
+		report.BrokenFiles++
+		r.logger.Warn("File with missing versions",
+			zap.String("fileID", file.FileID),
+			zap.String("bucket", location.StorageBucket),
+			zap.String("object", location.ObjectKey),
+			zap.Strings("missingVersions", missing),
+		)
+	}
+	if !repair {
+		return
+	}
+
+	switch {
+	case len(missing) > 0 && file.StorageMissingAt == nil:
+		// A file changed meanwhile is left for the next run
+		err = r.db.Unscoped().Model(&models.FileMetadata{}).
+			Where("file_id = ? AND version_id = ? AND storage_missing_at IS NULL", file.FileID, file.VersionID).
+			Update("storage_missing_at", time.Now()).Error
+		if err == nil {
+			report.Flagged++
+			reconcileRepairsTotal.WithLabelValues("flag").Inc()
+		}
+	case len(missing) == 0 && file.StorageMissingAt != nil:
+		err = r.db.Unscoped().Model(&models.FileMetadata{}).
+			Where("file_id = ?", file.FileID).
+			Update("storage_missing_at", nil).Error
+		if err == nil {
+			report.Unflagged++
+			reconcileRepairsTotal.WithLabelValues("unflag").Inc()
+			r.logger.Info("File versions found again", zap.String("fileID", file.FileID))
+		}
+	}
+	if err != nil {
+		report.Failed++
+		r.logger.Error("Failed to flag a file", zap.String("fileID", file.FileID), zap.Error(err))
+	}
+}
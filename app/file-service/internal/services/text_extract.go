@@ -0,0 +1,258 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported document format")
+
+// maxExtractedText bounds the text kept for a document, in bytes. Postgres
+// refuses tsvectors over 1MB, the rest of a longer document is not searchable.
+const maxExtractedText = 512 * 1024
+
+// Document formats the text extractor understands
+const (
+	formatPlainText = "text"
+	formatPDF       = "pdf"
+	formatDocx      = "docx"
+	formatXlsx      = "xlsx"
+)
+
+// documentFormat picks the extractor of a file from its extension, or from its
+// content type when the extension is unknown
+func documentFormat(fileName, contentType string) string {
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".txt", ".md", ".csv", ".log", ".json", ".xml", ".yaml", ".yml":
+		return formatPlainText
+	case ".pdf":
+		return formatPDF
+	case ".docx":
+		return formatDocx
+	case ".xlsx":
+		return formatXlsx
+	}
+
+	switch {
+	case strings.HasPrefix(contentType, "text/"):
+		return formatPlainText
+	case contentType == "application/pdf":
+		return formatPDF
+	case contentType == "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+		return formatDocx
+	case contentType == "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
+		return formatXlsx
+	}
+	return ""
+}
+
+// ExtractText returns the searchable text of a plain-text, PDF, docx or xlsx
+// document of size bytes, truncated to maxExtractedText. Other formats fail
+// with ErrUnsupportedFormat.
+func ExtractText(fileName, contentType string, r io.ReaderAt, size int64) (string, error) {
+	var text string
+	var err error
+
+	switch documentFormat(fileName, contentType) {
+	case formatPlainText:
+		text, err = readText(io.NewSectionReader(r, 0, size))
+	case formatPDF:
+		text, err = extractPDF(r, size)
+	case formatDocx:
+		text, err = extractFromZip(r, size, func(name string) bool {
+			return name == "word/document.xml"
+		}, docxText)
+	case formatXlsx:
+		text, err = extractFromZip(r, size, func(name string) bool {
+			return name == "xl/sharedStrings.xml" || strings.HasPrefix(name, "xl/worksheets/sheet")
+		}, xlsxText)
+	default:
+		return "", ErrUnsupportedFormat
+	}
+	if err != nil {
+		return "", err
+	}
+	return cleanText(text), nil
+}
+
+// readText reads at most maxExtractedText bytes of r
+func readText(r io.Reader) (string, error) {
+	content, err := io.ReadAll(io.LimitReader(r, maxExtractedText))
+	if err != nil {
+		return "", fmt.Errorf("error reading text: %w", err)
+	}
+	return string(content), nil
+}
+
+// extractPDF returns the text of the pages of a PDF. The parser panics on some
+// malformed documents, which is reported as an error instead.
+func extractPDF(r io.ReaderAt, size int64) (text string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("error parsing pdf: %v", recovered)
+		}
+	}()
+
+	reader, err := pdf.NewReader(r, size)
+	if err != nil {
+		return "", fmt.Errorf("error opening pdf: %w", err)
+	}
+	content, err := reader.GetPlainText()
+	if err != nil {
+		return "", fmt.Errorf("error extracting pdf text: %w", err)
+	}
+	return readText(content)
+}
+
+// extractFromZip runs extract over the XML parts of an Office Open XML package
+// selected by match, in name order. Each part is read through a limit so that
+// a highly compressed entry cannot exhaust memory.
+func extractFromZip(r io.ReaderAt, size int64, match func(name string) bool, extract func(name string, part io.Reader, out *strings.Builder) error) (string, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", fmt.Errorf("error opening document archive: %w", err)
+	}
+
+	var parts []*zip.File
+	for _, file := range archive.File {
+		if match(file.Name) {
+			parts = append(parts, file)
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Name < parts[j].Name })
+
+	var out strings.Builder
+	for _, file := range parts {
+		if out.Len() >= maxExtractedText {
+			break
+		}
+		part, err := file.Open()
+		if err != nil {
+			return "", fmt.Errorf("error opening %s: %w", file.Name, err)
+		}
+		err = extract(file.Name, io.LimitReader(part, 16*maxExtractedText), &out)
+		part.Close()
+		if err != nil {
+			return "", fmt.Errorf("error reading %s: %w", file.Name, err)
+		}
+	}
+	return out.String(), nil
+}
+
+// docxText writes the text runs of a word/document.xml part, one paragraph per line
+func docxText(_ string, part io.Reader, out *strings.Builder) error {
+	decoder := xml.NewDecoder(part)
+	inText := false
+	for out.Len() < maxExtractedText {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				out.WriteByte('\t')
+			case "br":
+				out.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				out.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				out.Write(t)
+			}
+		}
+	}
+	return nil
+}
+
+// xlsxText writes the shared strings of a workbook and the inline strings and
+// values of its sheets. Cells referencing a shared string are skipped, their
+// text is already part of the shared strings.
+func xlsxText(name string, part io.Reader, out *strings.Builder) error {
+	decoder := xml.NewDecoder(part)
+	sheet := name != "xl/sharedStrings.xml"
+	inText, sharedCell := false, false
+	for out.Len() < maxExtractedText {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "c":
+				sharedCell = false
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "t" && attr.Value == "s" {
+						sharedCell = true
+					}
+				}
+			case "t":
+				inText = true
+			case "v":
+				inText = sheet && !sharedCell
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t", "v":
+				if inText {
+					out.WriteByte(' ')
+				}
+				inText = false
+			case "si", "row":
+				out.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				out.Write(t)
+			}
+		}
+	}
+	return nil
+}
+
+// cleanText makes extracted text safe to store: valid UTF-8 without control
+// characters, which Postgres text columns and ts_headline markers rely on
+func cleanText(text string) string {
+	if len(text) > maxExtractedText {
+		text = text[:maxExtractedText]
+	}
+	text = strings.ToValidUTF8(text, "")
+
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return ' '
+		}
+		return r
+	}, text)
+}
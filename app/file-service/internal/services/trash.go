@@ -0,0 +1,149 @@
+package services
+
+import (
+	"database/sql"
+	"file-service/internal/models"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ListTrash returns the trashed files of a user, most recently deleted first
+func (m *MetadataService) ListTrash(userID string) ([]models.FileMetadata, error) {
+	var files []models.FileMetadata
+	err := m.db.Unscoped().
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at DESC").
+		Find(&files).Error
+	return files, err
+}
+
+// RestoreFile takes a file out of the trash. storageOp receives the location
+// of its object and the delete marker version ID and must make the object
+// visible again; it runs inside the
+// transaction. It returns gorm.ErrRecordNotFound when the user has no such
+// trashed file.
+func (m *MetadataService) RestoreFile(userID string, fileID string, storageOp func(location models.ObjectLocation, markerVersionID string) error) (*models.FileMetadata, error) {
+	var metadata models.FileMetadata
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND file_id = ? AND deleted_at IS NOT NULL", userID, fileID).
+			First(&metadata).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Unscoped().Model(&metadata).Updates(map[string]interface{}{
+			"deleted_at":               nil,
+			"deleted_by":               "",
+			"delete_marker_version_id": "",
+		}).Error
+		if err != nil {
+			m.logger.Error("Failed to restore metadata", zap.Error(err))
+			return err
+		}
+
+		if metadata.DeleteMarkerVersionID == "" {
+			return nil
+		}
+		return storageOp(metadata.Location(), metadata.DeleteMarkerVersionID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.logger.Info("File restored from the trash", zap.String("FileID", fileID), zap.String("UserID", userID))
+	metadata.DeletedAt = gorm.DeletedAt{}
+	metadata.DeletedBy = ""
+	metadata.DeleteMarkerVersionID = ""
+	return &metadata, nil
+}
+
+// PurgeFileMetadata permanently deletes a trashed file, its versions, its shares,
+// its share links with their access log, its file request tag and its search
+// document.
+// storageOp runs inside the transaction and must remove the stored object.
+func (m *MetadataService) PurgeFileMetadata(fileID string, storageOp func() error) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("file_id = ?", fileID).Delete(&models.FileVersion{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", fileID).Delete(&models.FileSearchDocument{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", fileID).Delete(&models.FileShare{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", fileID).Delete(&models.FileRequestUpload{}).Error; err != nil {
+			return err
+		}
+		links := tx.Model(&models.ShareLink{}).Select("id").Where("file_id = ?", fileID)
+		if err := tx.Where("link_id IN (?)", links).Delete(&models.ShareLinkAccess{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", fileID).Delete(&models.ShareLink{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("file_id = ? AND deleted_at IS NOT NULL", fileID).Delete(&models.FileMetadata{}).Error; err != nil {
+			return err
+		}
+		return storageOp()
+	})
+}
+
+// TrashedBefore returns up to limit files trashed before cutoff, oldest first.
+// Pages are read with keyset pagination on the deletion time and the file ID,
+// as for the file listing: after is the last file of the previous page, nil
+// for the first one, so files trashed at the same time are neither skipped
+// nor returned twice.
+func (m *MetadataService) TrashedBefore(cutoff time.Time, after *models.FileMetadata, limit int) ([]models.FileMetadata, error) {
+	db := m.db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff)
+	if after != nil {
+		db = db.Where("(deleted_at, file_id) > (?, ?)", after.DeletedAt.Time, after.FileID)
+	}
+
+	var files []models.FileMetadata
+	err := db.Order("deleted_at, file_id").
+		Limit(limit).
+		Find(&files).Error
+	return files, err
+}
+
+// TrashRetention returns how long trashed files of userID are kept. A member
+// of several companies gets the longest of their retention windows.
+func (m *MetadataService) TrashRetention(userID string, defaultRetention time.Duration) (time.Duration, error) {
+	var days sql.NullInt64
+	err := m.db.Model(&models.TrashRetentionPolicy{}).
+		Select("MAX(trash_retention_policies.retention_days)").
+		Joins("JOIN company_users ON company_users.company_id = trash_retention_policies.company_id AND company_users.deleted_at IS NULL").
+		Where("company_users.user_id = ?", userID).
+		Scan(&days).Error
+	if err != nil {
+		return 0, err
+	}
+	if !days.Valid {
+		return defaultRetention, nil
+	}
+	return time.Duration(days.Int64) * 24 * time.Hour, nil
+}
+
+// SetTrashRetention creates or updates the retention policy of a company
+func (m *MetadataService) SetTrashRetention(companyID string, retentionDays int, userID string) (*models.TrashRetentionPolicy, error) {
+	policy := models.TrashRetentionPolicy{
+		CompanyID:     companyID,
+		RetentionDays: retentionDays,
+		UpdatedBy:     userID,
+	}
+	err := m.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "company_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"retention_days", "updated_at", "updated_by"}),
+	}).Create(&policy).Error
+	if err != nil {
+		m.logger.Error("Failed to save trash retention policy", zap.String("CompanyID", companyID), zap.Error(err))
+		return nil, err
+	}
+	return &policy, nil
+}
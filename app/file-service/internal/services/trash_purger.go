@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"file-service/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var purgedTrashFilesTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "file_service_purged_trash_files_total",
+	Help: "Number of trashed files permanently removed after their retention window",
+})
+
+// TrashPurger periodically and permanently removes the files that stayed in
+// the trash longer than the retention window of their owner's company.
+type TrashPurger struct {
+	metadata         *MetadataService
+	storage          *StorageService
+	defaultRetention time.Duration
+	interval         time.Duration
+	logger           *zap.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewTrashPurger(metadata *MetadataService, storage *StorageService, defaultRetention, interval time.Duration, log *zap.Logger) *TrashPurger {
+	return &TrashPurger{
+		metadata:         metadata,
+		storage:          storage,
+		defaultRetention: defaultRetention,
+		interval:         interval,
+		logger:           log,
+	}
+}
+
+// Start runs the purger in the background until Stop is called
+func (p *TrashPurger) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		p.logger.Info("Trash purger started", zap.Duration("defaultRetention", p.defaultRetention), zap.Duration("interval", p.interval))
+		for {
+			select {
+			case <-ticker.C:
+				p.Purge(ctx)
+			case <-ctx.Done():
+				p.logger.Info("Trash purger stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop interrupts the current purge, if any, and waits for the purger to exit
+func (p *TrashPurger) Stop() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.wg.Wait()
+}
+
+// Purge removes every file whose retention window has elapsed. Policies can be
+// shorter than the default, so every file trashed for at least a day is checked.
+func (p *TrashPurger) Purge(ctx context.Context) {
+	const batchSize = 100
+
+	now := time.Now()
+	cutoff := now.Add(-24 * time.Hour)
+	retentions := make(map[string]time.Duration)
+
+	var after *models.FileMetadata
+	for {
+		files, err := p.metadata.TrashedBefore(cutoff, after, batchSize)
+		if err != nil {
+			p.logger.Error("Failed to list trashed files", zap.Error(err))
+			return
+		}
+
+		for _, file := range files {
+			if ctx.Err() != nil {
+				return
+			}
+
+			retention, known := retentions[file.UserID]
+			if !known {
+				retention, err = p.metadata.TrashRetention(file.UserID, p.defaultRetention)
+				if err != nil {
+					p.logger.Error("Failed to resolve trash retention", zap.String("userID", file.UserID), zap.Error(err))
+					continue
+				}
+				retentions[file.UserID] = retention
+			}
+			if file.DeletedAt.Time.Add(retention).After(now) {
+				continue
+			}
+
+			err := p.metadata.PurgeFileMetadata(file.FileID, func() error {
+				return p.storage.PurgeFile(file.Location())
+			})
+			if err != nil {
+				p.logger.Error("Failed to purge trashed file", zap.String("fileID", file.FileID), zap.Error(err))
+				continue
+			}
+
+			p.logger.Info("Purged trashed file",
+				zap.String("fileID", file.FileID),
+				zap.String("userID", file.UserID),
+				zap.Time("deletedAt", file.DeletedAt.Time),
+				zap.Duration("retention", retention),
+			)
+			purgedTrashFilesTotal.Inc()
+		}
+
+		if len(files) < batchSize {
+			return
+		}
+		// Files kept by a longer retention stay in the result, move past them
+		after = &files[len(files)-1]
+	}
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	reclaimedUploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "file_service_reclaimed_uploads_total",
+		Help: "Number of abandoned uploads reclaimed by the upload janitor",
+	}, []string{"source"})
+
+	reclaimedUploadBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "file_service_reclaimed_upload_bytes_total",
+		Help: "Number of bytes freed by the upload janitor",
+	}, []string{"source"})
+)
+
+// Sources of reclaimed uploads, used as the "source" metric label
+const (
+	reclaimedFromSession   = "session"
+	reclaimedFromTempDir   = "temp_dir"
+	reclaimedFromMultipart = "multipart"
+)
+
+// UploadJanitor periodically reclaims abandoned uploads: sessions older than
+// maxAge with their chunk directories or the content sent directly to the
+// storage, chunk directories whose session already expired, and multipart
+// uploads MinIO never saw completed.
+type UploadJanitor struct {
+	sessions UploadSessionStore
+	storage  *StorageService
+	tempRoot string
+	maxAge   time.Duration
+	interval time.Duration
+	logger   *zap.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewUploadJanitor(sessions UploadSessionStore, storage *StorageService, tempRoot string, maxAge, interval time.Duration, log *zap.Logger) *UploadJanitor {
+	return &UploadJanitor{
+		sessions: sessions,
+		storage:  storage,
+		tempRoot: tempRoot,
+		maxAge:   maxAge,
+		interval: interval,
+		logger:   log,
+	}
+}
+
+// Start runs the janitor in the background until Stop is called
+func (j *UploadJanitor) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+
+		j.logger.Info("Upload janitor started", zap.Duration("maxAge", j.maxAge), zap.Duration("interval", j.interval))
+		for {
+			select {
+			case <-ticker.C:
+				j.Sweep(ctx)
+			case <-ctx.Done():
+				j.logger.Info("Upload janitor stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop interrupts the current sweep, if any, and waits for the janitor to exit
+func (j *UploadJanitor) Stop() {
+	if j.cancel != nil {
+		j.cancel()
+	}
+	j.wg.Wait()
+}
+
+// Sweep reclaims everything older than maxAge in a single pass
+func (j *UploadJanitor) Sweep(ctx context.Context) {
+	cutoff := time.Now().Add(-j.maxAge)
+
+	j.expireSessions(ctx, cutoff)
+	if ctx.Err() != nil {
+		return
+	}
+	j.removeOrphanTempDirs(ctx, cutoff)
+	if ctx.Err() != nil {
+		return
+	}
+	j.removeStaleArchives(ctx, cutoff)
+	if ctx.Err() != nil {
+		return
+	}
+
+	if j.storage != nil {
+		aborted, reclaimed, err := j.storage.AbortIncompleteUploads(ctx, cutoff)
+		if err != nil && ctx.Err() == nil {
+			j.logger.Error("Failed to abort incomplete multipart uploads", zap.Error(err))
+		}
+		reclaimedUploadsTotal.WithLabelValues(reclaimedFromMultipart).Add(float64(aborted))
+		reclaimedUploadBytesTotal.WithLabelValues(reclaimedFromMultipart).Add(float64(reclaimed))
+	}
+}
+
+func (j *UploadJanitor) expireSessions(ctx context.Context, cutoff time.Time) {
+	sessions, err := j.sessions.List(ctx)
+	if err != nil {
+		j.logger.Error("Failed to list upload sessions", zap.Error(err))
+		return
+	}
+
+	for _, session := range sessions {
+		if ctx.Err() != nil {
+			return
+		}
+		// Sessions being assembled are left alone, the completion removes them
+		if session.Completing || session.CreatedAt.After(cutoff) {
+			continue
+		}
+
+		if err := j.sessions.Delete(ctx, session.ID); err != nil {
+			j.logger.Error("Failed to delete expired upload session", zap.String("uploadSessionId", session.ID), zap.Error(err))
+			continue
+		}
+
+		var size int64
+		if session.Direct {
+			// The client may have sent content to the storage, it is never recorded
+			if j.storage != nil {
+				if err := j.storage.DiscardDirectUpload(session.Location(), session.MultipartUploadID); err != nil {
+					j.logger.Error("Failed to discard direct upload", zap.String("uploadSessionId", session.ID), zap.Error(err))
+				}
+			}
+		} else {
+			size = dirSize(session.TempDir)
+			if err := os.RemoveAll(session.TempDir); err != nil {
+				j.logger.Error("Failed to remove temporary chunk directory", zap.String("tempDir", session.TempDir), zap.Error(err))
+			}
+		}
+
+		j.logger.Info("Expired abandoned upload session",
+			zap.String("uploadSessionId", session.ID),
+			zap.String("userID", session.UserID),
+			zap.Time("createdAt", session.CreatedAt),
+			zap.Int64("reclaimedBytes", size),
+		)
+		reclaimedUploadsTotal.WithLabelValues(reclaimedFromSession).Inc()
+		reclaimedUploadBytesTotal.WithLabelValues(reclaimedFromSession).Add(float64(size))
+	}
+}
+
+// chunkDirsName names the directory of the temporary root holding the chunk
+// directories and the staged archives. The janitor only ever deletes below it,
+// the root itself may be shared with other programs, such as /tmp.
+const chunkDirsName = "file-service-chunks"
+
+// chunkRoot creates, if needed, the directory of tempRoot owned by file-service
+func chunkRoot(tempRoot string) (string, error) {
+	root := filepath.Join(tempRoot, chunkDirsName)
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return "", err
+	}
+	return root, nil
+}
+
+// NewChunkDir creates the directory receiving the chunks of session sessionID
+// below tempRoot
+func NewChunkDir(tempRoot, sessionID string) (string, error) {
+	root, err := chunkRoot(tempRoot)
+	if err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(root, "upload-"+sessionID+"-")
+}
+
+// removeOrphanTempDirs deletes chunk directories left behind by sessions the
+// store already dropped, e.g. after their TTL elapsed
+func (j *UploadJanitor) removeOrphanTempDirs(ctx context.Context, cutoff time.Time) {
+	dirs, err := filepath.Glob(filepath.Join(j.tempRoot, chunkDirsName, "upload-*"))
+	if err != nil {
+		j.logger.Error("Failed to list temporary chunk directories", zap.Error(err))
+		return
+	}
+
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		// Directories are named upload-<sessionID>-<random>
+		parts := strings.SplitN(filepath.Base(dir), "-", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if _, err := j.sessions.Get(ctx, parts[1]); !errors.Is(err, ErrUploadSessionNotFound) {
+			continue // Still referenced by a live session, or the store is unreachable
+		}
+
+		size := dirSize(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			j.logger.Error("Failed to remove orphan chunk directory", zap.String("tempDir", dir), zap.Error(err))
+			continue
+		}
+
+		j.logger.Info("Removed orphan chunk directory", zap.String("tempDir", dir), zap.Int64("reclaimedBytes", size))
+		reclaimedUploadsTotal.WithLabelValues(reclaimedFromTempDir).Inc()
+		reclaimedUploadBytesTotal.WithLabelValues(reclaimedFromTempDir).Add(float64(size))
+	}
+}
+
+// removeStaleArchives deletes the archives staged for an import that never
+// removed them, e.g. because the replica stopped while expanding them
+func (j *UploadJanitor) removeStaleArchives(ctx context.Context, cutoff time.Time) {
+	archives, err := filepath.Glob(filepath.Join(j.tempRoot, chunkDirsName, "import-*.zip"))
+	if err != nil {
+		j.logger.Error("Failed to list staged archives", zap.Error(err))
+		return
+	}
+
+	for _, archive := range archives {
+		if ctx.Err() != nil {
+			return
+		}
+
+		info, err := os.Stat(archive)
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(archive); err != nil {
+			j.logger.Error("Failed to remove stale archive", zap.String("archive", archive), zap.Error(err))
+			continue
+		}
+
+		j.logger.Info("Removed stale archive", zap.String("archive", archive), zap.Int64("reclaimedBytes", info.Size()))
+		reclaimedUploadsTotal.WithLabelValues(reclaimedFromTempDir).Inc()
+		reclaimedUploadBytesTotal.WithLabelValues(reclaimedFromTempDir).Add(float64(info.Size()))
+	}
+}
+
+// dirSize returns the total size of the regular files below dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
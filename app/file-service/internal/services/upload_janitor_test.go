@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestUploadJanitorRemovesOnlyOrphanChunkDirs(t *testing.T) {
+	ctx := context.Background()
+	tempRoot := t.TempDir()
+	store := NewMemoryUploadSessionStore(time.Hour)
+	old := time.Now().Add(-2 * time.Hour)
+
+	liveDir, err := NewChunkDir(tempRoot, "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Create(ctx, &UploadSession{ID: "live", TempDir: liveDir, CreatedAt: time.Now()})
+	orphanDir, err := NewChunkDir(tempRoot, "expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(orphanDir, "chunk_000000"), []byte("chunk"), 0o600)
+	recentDir, err := NewChunkDir(tempRoot, "recent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other programs may name their files alike in a shared root
+	foreignDir := filepath.Join(tempRoot, "upload-foreign-1")
+	if err := os.Mkdir(foreignDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{liveDir, orphanDir, foreignDir} {
+		os.Chtimes(dir, old, old)
+	}
+
+	NewUploadJanitor(store, nil, tempRoot, time.Hour, time.Hour, zap.NewNop()).Sweep(ctx)
+
+	tests := []struct {
+		name string
+		dir  string
+		kept bool
+	}{
+		{"chunks of a live session", liveDir, true},
+		{"chunks of an expired session", orphanDir, false},
+		{"recent chunks", recentDir, true},
+		{"directory of another program", foreignDir, true},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(tt.dir)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s: kept = %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+}
+
+func TestUploadJanitorRemovesStaleArchives(t *testing.T) {
+	ctx := context.Background()
+	tempRoot := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+
+	staleArchive, err := SaveArchiveUpload(tempRoot, strings.NewReader("zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recentArchive, err := SaveArchiveUpload(tempRoot, strings.NewReader("zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreignArchive := filepath.Join(tempRoot, "import-foreign.zip")
+	if err := os.WriteFile(foreignArchive, []byte("zip"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, archive := range []string{staleArchive, foreignArchive} {
+		os.Chtimes(archive, old, old)
+	}
+
+	NewUploadJanitor(NewMemoryUploadSessionStore(time.Hour), nil, tempRoot, time.Hour, time.Hour, zap.NewNop()).Sweep(ctx)
+
+	tests := []struct {
+		name    string
+		archive string
+		kept    bool
+	}{
+		{"archive of an interrupted import", staleArchive, false},
+		{"archive being imported", recentArchive, true},
+		{"file of another program", foreignArchive, true},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(tt.archive)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s: kept = %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"file-service/internal/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrUploadSessionNotFound = errors.New("upload session not found")
+
+type UploadSession struct {
+	ID             string       `json:"id"`
+	UserID         string       `json:"userId"` // Owner of the session, the only user allowed to push chunks
+	FileName       string       `json:"fileName"`
+	FileSize       int64        `json:"fileSize"`
+	ChunkSize      int64        `json:"chunkSize"`
+	SHA256         string       `json:"sha256,omitempty"`   // Digest announced by the client, checked on completion
+	FolderID       string       `json:"folderId,omitempty"` // Folder receiving the file, empty for the root
+	UploadedChunks map[int]bool `json:"-"`                  // Track received chunks
+	TotalChunks    int          `json:"totalChunks"`
+	TempDir        string       `json:"tempDir"`   // Directory for storing temporary chunks
+	CreatedAt      time.Time    `json:"createdAt"` // Timestamp for session creation
+	Completing     bool         `json:"-"`         // Set while the chunks are being assembled
+
+	// Direct uploads are sent by the client straight to the storage, through
+	// presigned URLs, in TotalChunks parts of ChunkSize bytes. They have no TempDir.
+	Direct            bool   `json:"direct,omitempty"`
+	FileID            string `json:"fileId,omitempty"`            // File recorded on completion
+	StorageBucket     string `json:"storageBucket,omitempty"`     // Bucket of the object receiving the content, empty for the default one
+	ObjectKey         string `json:"objectKey,omitempty"`         // Key of the object receiving the content
+	MultipartUploadID string `json:"multipartUploadId,omitempty"` // Multipart upload receiving the parts
+}
+
+// Location returns where a direct upload stores its content
+func (s *UploadSession) Location() models.ObjectLocation {
+	return models.ObjectLocation{StorageBucket: s.StorageBucket, ObjectKey: s.ObjectKey}
+}
+
+// ExpectedChunkSize returns the number of bytes chunk index must carry. Every
+// chunk is ChunkSize bytes long except the last one, which holds the remainder.
+func (s *UploadSession) ExpectedChunkSize(index int) int64 {
+	if index == s.TotalChunks-1 {
+		return s.FileSize - int64(s.TotalChunks-1)*s.ChunkSize
+	}
+	return s.ChunkSize
+}
+
+// MissingChunks returns the sorted indexes of the chunks not received yet
+func (s *UploadSession) MissingChunks() []int {
+	missing := []int{}
+	for i := 0; i < s.TotalChunks; i++ {
+		if !s.UploadedChunks[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// UploadSessionStore keeps track of resumable upload sessions. Sessions expire
+// after the store TTL unless chunks keep coming in.
+type UploadSessionStore interface {
+	Create(ctx context.Context, session *UploadSession) error
+	Get(ctx context.Context, sessionID string) (*UploadSession, error)
+	// MarkChunkUploaded records a received chunk and returns the number of chunks received so far
+	MarkChunkUploaded(ctx context.Context, sessionID string, index int) (int, error)
+	// StartCompleting flags the session as being assembled. It returns false if
+	// another request is already completing it.
+	StartCompleting(ctx context.Context, sessionID string) (bool, error)
+	StopCompleting(ctx context.Context, sessionID string) error
+	Delete(ctx context.Context, sessionID string) error
+	// List returns every live session, used by the janitor to find abandoned uploads
+	List(ctx context.Context) ([]*UploadSession, error)
+}
+
+// RedisUploadSessionStore shares upload sessions between file-service replicas
+// and keeps them across restarts
+type RedisUploadSessionStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisUploadSessionStore(client *redis.Client, ttl time.Duration) *RedisUploadSessionStore {
+	return &RedisUploadSessionStore{client: client, ttl: ttl}
+}
+
+func sessionKey(sessionID string) string {
+	return "upload_session:" + sessionID
+}
+
+func sessionChunksKey(sessionID string) string {
+	return "upload_session:" + sessionID + ":chunks"
+}
+
+func sessionCompletingKey(sessionID string) string {
+	return "upload_session:" + sessionID + ":completing"
+}
+
+func (r *RedisUploadSessionStore) Create(ctx context.Context, session *UploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("error encoding upload session: %w", err)
+	}
+	if err := r.client.Set(ctx, sessionKey(session.ID), data, r.ttl).Err(); err != nil {
+		return fmt.Errorf("error saving upload session: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisUploadSessionStore) Get(ctx context.Context, sessionID string) (*UploadSession, error) {
+	pipe := r.client.Pipeline()
+	dataCmd := pipe.Get(ctx, sessionKey(sessionID))
+	chunksCmd := pipe.SMembers(ctx, sessionChunksKey(sessionID))
+	completingCmd := pipe.Exists(ctx, sessionCompletingKey(sessionID))
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("error loading upload session: %w", err)
+	}
+
+	data, err := dataCmd.Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrUploadSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading upload session: %w", err)
+	}
+
+	var session UploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("error decoding upload session: %w", err)
+	}
+
+	session.UploadedChunks = make(map[int]bool)
+	for _, member := range chunksCmd.Val() {
+		index, err := strconv.Atoi(member)
+		if err != nil {
+			continue
+		}
+		session.UploadedChunks[index] = true
+	}
+	session.Completing = completingCmd.Val() > 0
+
+	return &session, nil
+}
+
+// markChunkScript records a chunk of a session and extends the lifetime of
+// the session, which must still exist. It returns the number of chunks
+// received, or -1 when the session expired. Running it as a script keeps a
+// chunk from reviving the chunk set of a session deleted meanwhile.
+var markChunkScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+redis.call("SADD", KEYS[2], ARGV[1])
+redis.call("EXPIRE", KEYS[2], ARGV[2])
+redis.call("EXPIRE", KEYS[1], ARGV[2])
+return redis.call("SCARD", KEYS[2])
+`)
+
+func (r *RedisUploadSessionStore) MarkChunkUploaded(ctx context.Context, sessionID string, index int) (int, error) {
+	// Every received chunk extends the lifetime of the session
+	keys := []string{sessionKey(sessionID), sessionChunksKey(sessionID)}
+	count, err := markChunkScript.Run(ctx, r.client, keys, index, int(r.ttl.Seconds())).Int()
+	if err != nil {
+		return 0, fmt.Errorf("error recording chunk: %w", err)
+	}
+	if count < 0 {
+		return 0, ErrUploadSessionNotFound
+	}
+	return count, nil
+}
+
+func (r *RedisUploadSessionStore) StartCompleting(ctx context.Context, sessionID string) (bool, error) {
+	acquired, err := r.client.SetNX(ctx, sessionCompletingKey(sessionID), 1, r.ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("error locking upload session: %w", err)
+	}
+	return acquired, nil
+}
+
+func (r *RedisUploadSessionStore) StopCompleting(ctx context.Context, sessionID string) error {
+	return r.client.Del(ctx, sessionCompletingKey(sessionID)).Err()
+}
+
+func (r *RedisUploadSessionStore) Delete(ctx context.Context, sessionID string) error {
+	return r.client.Del(ctx, sessionKey(sessionID), sessionChunksKey(sessionID), sessionCompletingKey(sessionID)).Err()
+}
+
+func (r *RedisUploadSessionStore) List(ctx context.Context) ([]*UploadSession, error) {
+	var sessions []*UploadSession
+
+	iter := r.client.Scan(ctx, 0, sessionKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		sessionID := strings.TrimPrefix(iter.Val(), sessionKey(""))
+		if strings.Contains(sessionID, ":") {
+			continue // Chunk set or completion flag of a session
+		}
+
+		session, err := r.Get(ctx, sessionID)
+		if errors.Is(err, ErrUploadSessionNotFound) {
+			continue // Expired between the scan and the read
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("error listing upload sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// MemoryUploadSessionStore keeps upload sessions in the process memory. It is
+// meant for tests and single instance development setups.
+type MemoryUploadSessionStore struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	sessions  map[string]*UploadSession
+	expiresAt map[string]time.Time
+}
+
+func NewMemoryUploadSessionStore(ttl time.Duration) *MemoryUploadSessionStore {
+	return &MemoryUploadSessionStore{
+		ttl:       ttl,
+		sessions:  make(map[string]*UploadSession),
+		expiresAt: make(map[string]time.Time),
+	}
+}
+
+// lookup returns a live session, dropping it if it has expired. The caller must hold the mutex.
+func (m *MemoryUploadSessionStore) lookup(sessionID string) (*UploadSession, bool) {
+	session, exists := m.sessions[sessionID]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(m.expiresAt[sessionID]) {
+		delete(m.sessions, sessionID)
+		delete(m.expiresAt, sessionID)
+		return nil, false
+	}
+	return session, true
+}
+
+func (m *MemoryUploadSessionStore) Create(ctx context.Context, session *UploadSession) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored := *session
+	stored.UploadedChunks = make(map[int]bool)
+	m.sessions[session.ID] = &stored
+	m.expiresAt[session.ID] = time.Now().Add(m.ttl)
+	return nil
+}
+
+func (m *MemoryUploadSessionStore) Get(ctx context.Context, sessionID string) (*UploadSession, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session, exists := m.lookup(sessionID)
+	if !exists {
+		return nil, ErrUploadSessionNotFound
+	}
+
+	// Hand out a copy so callers never race with concurrent chunk uploads
+	copied := *session
+	copied.UploadedChunks = make(map[int]bool, len(session.UploadedChunks))
+	for index := range session.UploadedChunks {
+		copied.UploadedChunks[index] = true
+	}
+	return &copied, nil
+}
+
+func (m *MemoryUploadSessionStore) MarkChunkUploaded(ctx context.Context, sessionID string, index int) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session, exists := m.lookup(sessionID)
+	if !exists {
+		return 0, ErrUploadSessionNotFound
+	}
+	session.UploadedChunks[index] = true
+	m.expiresAt[sessionID] = time.Now().Add(m.ttl)
+	return len(session.UploadedChunks), nil
+}
+
+func (m *MemoryUploadSessionStore) StartCompleting(ctx context.Context, sessionID string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session, exists := m.lookup(sessionID)
+	if !exists {
+		return false, ErrUploadSessionNotFound
+	}
+	if session.Completing {
+		return false, nil
+	}
+	session.Completing = true
+	return true, nil
+}
+
+func (m *MemoryUploadSessionStore) StopCompleting(ctx context.Context, sessionID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if session, exists := m.lookup(sessionID); exists {
+		session.Completing = false
+	}
+	return nil
+}
+
+func (m *MemoryUploadSessionStore) Delete(ctx context.Context, sessionID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.sessions, sessionID)
+	delete(m.expiresAt, sessionID)
+	return nil
+}
+
+func (m *MemoryUploadSessionStore) List(ctx context.Context) ([]*UploadSession, error) {
+	m.mutex.Lock()
+	sessionIDs := make([]string, 0, len(m.sessions))
+	for sessionID := range m.sessions {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	m.mutex.Unlock()
+
+	sessions := make([]*UploadSession, 0, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		session, err := m.Get(ctx, sessionID)
+		if err != nil {
+			continue // Expired meanwhile
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadSessionChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		fileSize  int64
+		chunkSize int64
+		total     int
+		uploaded  []int
+		sizes     []int64
+		missing   []int
+	}{
+		{"single chunk", 10, 16, 1, nil, []int64{10}, []int{0}},
+		{"exact multiple", 32, 16, 2, []int{1}, []int64{16, 16}, []int{0}},
+		{"short last chunk", 35, 16, 3, []int{0, 2}, []int64{16, 16, 3}, []int{1}},
+		{"all received", 35, 16, 3, []int{2, 0, 1}, []int64{16, 16, 3}, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &UploadSession{FileSize: tt.fileSize, ChunkSize: tt.chunkSize, TotalChunks: tt.total, UploadedChunks: map[int]bool{}}
+			for _, index := range tt.uploaded {
+				session.UploadedChunks[index] = true
+			}
+
+			var total int64
+			for index, want := range tt.sizes {
+				if got := session.ExpectedChunkSize(index); got != want {
+					t.Errorf("ExpectedChunkSize(%d) = %d, want %d", index, got, want)
+				}
+				total += session.ExpectedChunkSize(index)
+			}
+			if total != tt.fileSize {
+				t.Errorf("chunks hold %d bytes, want %d", total, tt.fileSize)
+			}
+			if got := session.MissingChunks(); !reflect.DeepEqual(got, tt.missing) {
+				t.Errorf("MissingChunks() = %v, want %v", got, tt.missing)
+			}
+		})
+	}
+}
+
+func newTestSession(id string) *UploadSession {
+	return &UploadSession{
+		ID:             id,
+		UserID:         "owner",
+		FileName:       "report.pdf",
+		FileSize:       40,
+		ChunkSize:      16,
+		TotalChunks:    3,
+		UploadedChunks: map[int]bool{0: true},
+		CreatedAt:      time.Now(),
+	}
+}
+
+func TestMemoryUploadSessionStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUploadSessionStore(time.Hour)
+
+	session := newTestSession("session")
+	if err := store.Create(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	// The store keeps its own copy, chunks are only recorded through it
+	session.FileName = "changed.pdf"
+	session.UploadedChunks[1] = true
+
+	stored, err := store.Get(ctx, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FileName != "report.pdf" || stored.UserID != "owner" || len(stored.UploadedChunks) != 0 {
+		t.Fatalf("stored session = %+v", stored)
+	}
+
+	tests := []struct {
+		index int
+		want  int
+	}{
+		{2, 1},
+		{0, 2},
+		{2, 2}, // A retried chunk is counted once
+		{1, 3},
+	}
+	for _, tt := range tests {
+		received, err := store.MarkChunkUploaded(ctx, "session", tt.index)
+		if err != nil || received != tt.want {
+			t.Errorf("MarkChunkUploaded(%d) = %d, %v, want %d", tt.index, received, err, tt.want)
+		}
+	}
+	// Sessions handed out earlier are not affected
+	if len(stored.UploadedChunks) != 0 {
+		t.Errorf("earlier copy sees chunks %v", stored.UploadedChunks)
+	}
+	stored, _ = store.Get(ctx, "session")
+	if missing := stored.MissingChunks(); len(missing) != 0 {
+		t.Errorf("missing chunks %v after receiving them all", missing)
+	}
+
+	if _, err := store.Get(ctx, "unknown"); !errors.Is(err, ErrUploadSessionNotFound) {
+		t.Errorf("Get(unknown) = %v, want ErrUploadSessionNotFound", err)
+	}
+	if _, err := store.MarkChunkUploaded(ctx, "unknown", 0); !errors.Is(err, ErrUploadSessionNotFound) {
+		t.Errorf("MarkChunkUploaded(unknown) = %v, want ErrUploadSessionNotFound", err)
+	}
+
+	if err := store.Delete(ctx, "session"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "session"); !errors.Is(err, ErrUploadSessionNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrUploadSessionNotFound", err)
+	}
+}
+
+func TestMemoryUploadSessionStoreCompleting(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUploadSessionStore(time.Hour)
+	store.Create(ctx, newTestSession("session"))
+
+	// Only one of concurrent completions gets the session
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	acquired := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := store.StartCompleting(ctx, "session")
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mutex.Lock()
+				acquired++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired != 1 {
+		t.Fatalf("%d completions acquired the session, want 1", acquired)
+	}
+
+	if session, _ := store.Get(ctx, "session"); !session.Completing {
+		t.Error("session is not flagged as completing")
+	}
+	if err := store.StopCompleting(ctx, "session"); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ := store.Get(ctx, "session"); session.Completing {
+		t.Error("session is still flagged as completing")
+	}
+	if ok, err := store.StartCompleting(ctx, "session"); !ok || err != nil {
+		t.Errorf("StartCompleting after StopCompleting = %v, %v", ok, err)
+	}
+
+	if _, err := store.StartCompleting(ctx, "unknown"); !errors.Is(err, ErrUploadSessionNotFound) {
+		t.Errorf("StartCompleting(unknown) = %v, want ErrUploadSessionNotFound", err)
+	}
+}
+
+func TestMemoryUploadSessionStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	const ttl = 50 * time.Millisecond
+	store := NewMemoryUploadSessionStore(ttl)
+	store.Create(ctx, newTestSession("active"))
+	store.Create(ctx, newTestSession("idle"))
+
+	// Chunks keep a session alive past its initial TTL
+	for i := 0; i < 3; i++ {
+		time.Sleep(ttl / 2)
+		if _, err := store.MarkChunkUploaded(ctx, "active", i); err != nil {
+			t.Fatalf("MarkChunkUploaded(%d) = %v", i, err)
+		}
+	}
+
+	sessions, err := store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "active" {
+		t.Errorf("List() returned %d sessions, want only the active one", len(sessions))
+	}
+	if _, err := store.Get(ctx, "idle"); !errors.Is(err, ErrUploadSessionNotFound) {
+		t.Errorf("Get(idle) = %v, want ErrUploadSessionNotFound", err)
+	}
+	if _, err := store.MarkChunkUploaded(ctx, "idle", 1); !errors.Is(err, ErrUploadSessionNotFound) {
+		t.Errorf("MarkChunkUploaded(idle) = %v, want ErrUploadSessionNotFound", err)
+	}
+
+	time.Sleep(2 * ttl)
+	if sessions, _ := store.List(ctx); len(sessions) != 0 {
+		t.Errorf("List() returned %d sessions after expiry, want none", len(sessions))
+	}
+}
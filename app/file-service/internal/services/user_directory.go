@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UserDirectory looks users up in user-service
+type UserDirectory struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewUserDirectory(baseURL string) *UserDirectory {
+	return &UserDirectory{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// UserExists reports whether user-service knows userID
+func (d *UserDirectory) UserExists(ctx context.Context, userID string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.baseURL+"/api/v1/users/"+url.PathEscape(userID), nil)
+	if err != nil {
+		return false, fmt.Errorf("error building user-service request: %w", err)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error contacting user-service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected user-service status %d", resp.StatusCode)
+	}
+}
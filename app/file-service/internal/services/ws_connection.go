@@ -163,7 +163,10 @@ func (ws *WebSocketServer) keepConnectionAlive(connection *WebSocketConnection)
 		select {
 		case <-time.After(30 * time.Second):
 			// Send a ping message to keep the connection alive
-			if err := connection.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			connection.mutex.Lock()
+			err := connection.conn.WriteMessage(websocket.PingMessage, nil)
+			connection.mutex.Unlock()
+			if err != nil {
 				ws.logger.Error("Failed to send ping", zap.Error(err))
 				return
 			}
@@ -174,6 +177,28 @@ func (ws *WebSocketServer) keepConnectionAlive(connection *WebSocketConnection)
 	}
 }
 
+// SendJSON pushes message to the WebSocket connection of userID. It reports
+// false when the user has no open connection; delivery is best effort.
+func (ws *WebSocketServer) SendJSON(userID string, message interface{}) bool {
+	ws.mutex.Lock()
+	connection, exists := ws.connections[userID]
+	ws.mutex.Unlock()
+	if !exists {
+		return false
+	}
+
+	// gorilla/websocket supports a single concurrent writer per connection
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	defer connection.conn.SetWriteDeadline(time.Time{})
+	if err := connection.conn.WriteJSON(message); err != nil {
+		ws.logger.Warn("Failed to send WebSocket message", zap.String("userID", userID), zap.Error(err))
+		return false
+	}
+	return true
+}
+
 // Close the WebSocket connection
 func (ws *WebSocketServer) CloseConnection(userID string) {
 	ws.mutex.Lock()
@@ -37,6 +37,7 @@ func main() {
 	// Register Routes
 	router.POST("/api/v1/users", handlers.CreateUserHandler())
 	router.GET("/api/v1/user/info", handlers.GetUserHandler())
+	router.GET("/api/v1/users/:user_id", handlers.GetUserHandler())
 	router.POST("/api/v1/users/check", handlers.GetUserHandlerByEmail())
 
 	// Start the Server